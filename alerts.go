@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxAlerts bounds how many recent alerts are kept for the dashboard.
+const maxAlerts = 20
+
+// Alert is an operational problem surfaced to operators on the dashboard.
+type Alert struct {
+	Time    time.Time
+	Message string
+}
+
+// alertLog keeps the most recent alerts in memory.
+type alertLog struct {
+	mu    sync.Mutex
+	items []Alert
+}
+
+func (a *alertLog) add(msg string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.items = append(a.items, Alert{Time: time.Now(), Message: msg})
+	if len(a.items) > maxAlerts {
+		a.items = a.items[len(a.items)-maxAlerts:]
+	}
+}
+
+// recent returns the kept alerts, newest first.
+func (a *alertLog) recent() []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]Alert, len(a.items))
+	for i, alert := range a.items {
+		out[len(a.items)-1-i] = alert
+	}
+	return out
+}
+
+var alerts alertLog
+
+// alertf logs a message and records it as an alert for the dashboard.
+func alertf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println("ALERT:", msg)
+	alerts.add(msg)
+}
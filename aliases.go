@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ErrAliasTaken is returned by addAlias when the code is already a product
+// key or an alias of another product.
+var ErrAliasTaken = errors.New("code already names another product")
+
+// Aliases maps extra decoded codes to the canonical product key they stand
+// for, such as a replacement label stuck over a worn QR code. They apply at
+// every location and are persisted with the inventory.
+type Aliases map[string]string
+
+// byKey groups the aliases by product key.
+func (a Aliases) byKey() map[string][]string {
+	out := map[string][]string{}
+	for code, key := range a {
+		out[key] = append(out[key], code)
+	}
+	for _, codes := range out {
+		slices.Sort(codes)
+	}
+	return out
+}
+
+// addAlias makes code resolve to key. The key must exist at some location.
+func (db *DB_Type) addAlias(key, code string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.knownLocked(key) {
+		return ErrUnknownProduct
+	}
+	if other, ok := db.aliases[code]; ok && other != key || db.knownLocked(code) {
+		return ErrAliasTaken
+	}
+	if db.aliases == nil {
+		db.aliases = Aliases{}
+	}
+	db.aliases[code] = key
+	db.notify()
+	return nil
+}
+
+// removeAlias drops code as an alias of key, reporting whether it was one.
+func (db *DB_Type) removeAlias(key, code string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.aliases[code] != key {
+		return false
+	}
+	delete(db.aliases, code)
+	db.notify()
+	return true
+}
+
+// canonicalKey returns the product key code is an alias of, or code itself.
+func (db *DB_Type) canonicalKey(code string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if key, ok := db.aliases[code]; ok {
+		return key
+	}
+	return code
+}
+
+// snapshotAliases returns a copy of the aliases taken under the lock.
+func (db *DB_Type) snapshotAliases() Aliases {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return maps.Clone(db.aliases)
+}
+
+// HandleAddAlias registers the posted code as another code for the product
+// in the path.
+func HandleAddAlias(w http.ResponseWriter, req *http.Request) {
+	code := strings.TrimSpace(req.FormValue("code"))
+	if code == "" {
+		httpError(w, req, "error.keyRequired", http.StatusBadRequest)
+		return
+	}
+	switch err := db.addAlias(req.PathValue("key"), code); {
+	case errors.Is(err, ErrUnknownProduct):
+		httpError(w, req, "error.unknownProduct", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrAliasTaken):
+		httpError(w, req, "error.aliasTaken", http.StatusConflict)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(locationFor(req)), http.StatusSeeOther)
+}
+
+// HandleRemoveAlias stops the code in the path resolving to the product in
+// the path.
+func HandleRemoveAlias(w http.ResponseWriter, req *http.Request) {
+	if !db.removeAlias(req.PathValue("key"), req.PathValue("code")) {
+		httpError(w, req, "error.unknownAlias", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(locationFor(req)), http.StatusSeeOther)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// apiMux serves the JSON API under /api/. It is mounted behind the CORS middleware.
+var apiMux = http.NewServeMux()
+
+func init() {
+	routes := newRouter(apiMux)
+	routes.HandleFunc("/api/", HandleNotFound)
+	routes.HandleFunc("GET /api/inventory", HandleAPIInventory)
+	routes.HandleFunc("POST /api/inventory/batch", HandleAPIBatch)
+	routes.HandleFunc("GET /api/inventory/sum", HandleAPISum)
+	routes.HandleFunc("POST /api/diff", HandleAPIDiff)
+	routes.HandleSlowFunc("POST /api/scan", HandleAPIScan)
+	routes.HandleSlowFunc("POST /api/scan/frames", HandleAPIScanFrames)
+	routes.HandleFunc("GET /api/reorder-suggestions", HandleAPIReorder)
+	routes.HandleFunc("GET /api/lots", HandleAPILots)
+	routes.HandleSlowFunc("POST /api/quick-adjust", HandleQuickAdjust)
+	routes.HandleFunc("GET /api/template", HandleAPITemplate)
+	routes.HandleFunc("GET /api/template/{name}", HandleAPITemplate)
+	routes.HandleFunc("PUT /api/template/{name}", requireAdmin(HandleAPIPutTemplate))
+}
+
+// HandleAPIInventory returns the current inventory of ?location= (the default
+// location when absent) as JSON. ?location=* returns every location.
+func HandleAPIInventory(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("location") == "*" {
+		writeJSON(w, http.StatusOK, db.snapshot())
+		return
+	}
+	writeJSON(w, http.StatusOK, db.snapshotLocation(locationFor(req)))
+}
+
+// batchResponse is the JSON body returned by HandleAPIBatch.
+type batchResponse struct {
+	Applied bool          `json:"applied"`
+	Results []BatchResult `json:"results"`
+}
+
+// HandleAPIBatch applies a JSON array of BatchItem adjustments at once to
+// ?location=. With ?transactional=true nothing is applied unless every item is valid.
+func HandleAPIBatch(w http.ResponseWriter, req *http.Request) {
+	var items []BatchItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&items); err != nil {
+		httpError(w, req, "error.invalidJSON", http.StatusBadRequest)
+		return
+	}
+	transactional, _ := strconv.ParseBool(req.URL.Query().Get("transactional"))
+
+	results, applied := db.applyBatch(locationFor(req), items, transactional)
+	status := http.StatusOK
+	if !applied {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, batchResponse{Applied: applied, Results: results})
+}
+
+// sumResponse is the JSON body returned by HandleAPISum.
+type sumResponse struct {
+	Location string         `json:"location"`
+	Total    int            `json:"total"`
+	Items    map[string]int `json:"items"`
+	Missing  []string       `json:"missing,omitempty"` // listed keys that don't exist
+}
+
+// HandleAPISum returns the summed count of ?keys=a,b,c and/or every product
+// in ?category= at ?location=, with the per-key breakdown.
+func HandleAPISum(w http.ResponseWriter, req *http.Request) {
+	keys := splitList(req.FormValue("keys"))
+	category := strings.TrimSpace(req.FormValue("category"))
+	if len(keys) == 0 && category == "" {
+		httpError(w, req, "error.keyRequired", http.StatusBadRequest)
+		return
+	}
+	loc := locationFor(req)
+	total, items, missing := db.sum(loc, keys, category)
+	writeJSON(w, http.StatusOK, sumResponse{Location: loc, Total: total, Items: items, Missing: missing})
+}
+
+// diffEntry compares one key of the inventory with a supplied baseline.
+type diffEntry struct {
+	Key        string `json:"key"`
+	Current    int    `json:"current"`
+	Supplied   int    `json:"supplied"`
+	Difference int    `json:"difference"` // current minus supplied
+	InCurrent  bool   `json:"inCurrent"`  // false: only in the baseline
+	InSupplied bool   `json:"inSupplied"` // false: only in the inventory
+}
+
+// diffResponse is the JSON body returned by HandleAPIDiff.
+type diffResponse struct {
+	Location string      `json:"location"`
+	Keys     []diffEntry `json:"keys"`
+	Changed  int         `json:"changed"` // keys whose difference is not zero
+}
+
+// HandleAPIDiff compares the inventory at ?location= with a posted JSON map
+// of key to value, such as a physical count, and returns every key found on
+// either side with the difference, sorted by key. The inventory is read in
+// one snapshot.
+func HandleAPIDiff(w http.ResponseWriter, req *http.Request) {
+	var supplied map[string]int
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&supplied); err != nil {
+		httpError(w, req, "error.invalidJSON", http.StatusBadRequest)
+		return
+	}
+	loc := locationFor(req)
+	stock := db.snapshotLocation(loc)
+	resp := diffResponse{Location: loc, Keys: []diffEntry{}}
+	for key, prod := range stock {
+		value, ok := supplied[key]
+		resp.Keys = append(resp.Keys, diffEntry{Key: key, Current: prod.Value, Supplied: value, Difference: prod.Value - value, InCurrent: true, InSupplied: ok})
+	}
+	for key, value := range supplied {
+		if _, ok := stock[key]; !ok {
+			resp.Keys = append(resp.Keys, diffEntry{Key: key, Supplied: value, Difference: -value, InSupplied: true})
+		}
+	}
+	slices.SortFunc(resp.Keys, func(a, b diffEntry) int { return strings.Compare(a.Key, b.Key) })
+	for _, e := range resp.Keys {
+		if e.Difference != 0 {
+			resp.Changed++
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// HandleAPITemplate returns the geometry of the scan template named in the
+// path, or of the default template, so a client can draw its regions over a
+// sheet preview.
+func HandleAPITemplate(w http.ResponseWriter, req *http.Request) {
+	tmpl, ok := configFor(req).template(req.PathValue("name"))
+	if !ok {
+		httpError(w, req, "error.unknownTemplate", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, tmpl)
+}
+
+// HandleAPIPutTemplate validates the posted template JSON, saves it to the
+// templates directory as {name}.json and makes it available under {name}.
+// Fields missing from the body keep the values of the template already
+// registered under {name}, or take the default template's for a new one.
+// It needs the -admin-password, as it writes files and can change the
+// template live decodes use.
+func HandleAPIPutTemplate(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if !validTemplateName(name) {
+		httpError(w, req, "error.unknownTemplate", http.StatusBadRequest)
+		return
+	}
+	base, ok := scanTemplates.lookup(name)
+	if !ok {
+		base = defaultTemplate
+	}
+	// Start from a deep copy: decoding into the registered template's
+	// slices would write through to it. Templates always encode.
+	data, _ := json.Marshal(base)
+	var tmpl ScanTemplate
+	json.Unmarshal(data, &tmpl)
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&tmpl); err != nil {
+		httpError(w, req, "error.invalidJSON", http.StatusBadRequest)
+		return
+	}
+	tmpl.Name = name
+	if err := tmpl.validate(); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, apiError{Error: err.Error()})
+		return
+	}
+	switch err := scanTemplates.save(tmpl); {
+	case errors.Is(err, ErrNoTemplateDir):
+		httpError(w, req, "error.noTemplateDir", http.StatusConflict)
+	case err != nil:
+		log.Printf("[%s] saving template %s: %v", requestID(req), name, err)
+		httpError(w, req, "error.saveFile", http.StatusInternalServerError)
+	default:
+		log.Printf("[%s] Template %s updated", requestID(req), name)
+		writeJSON(w, http.StatusOK, tmpl)
+	}
+}
+
+// validTemplateName reports whether name can be used as a template file name.
+func validTemplateName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeJSON encodes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// corsConfig lists what cross-origin callers of the API may do.
+type corsConfig struct {
+	Origins []string // allowed origins; "*" allows any
+	Methods string
+	Headers string
+}
+
+// allowsOrigin reports whether origin may call the API.
+func (c corsConfig) allowsOrigin(origin string) bool {
+	return slices.Contains(c.Origins, "*") || slices.Contains(c.Origins, origin)
+}
+
+// cors wraps next with CORS headers for allowed origins and answers preflight
+// OPTIONS requests itself.
+func cors(cfg corsConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+		if !cfg.allowsOrigin(origin) {
+			if preflight {
+				httpError(w, req, "error.corsOrigin", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", cfg.Methods)
+			w.Header().Set("Access-Control-Allow-Headers", cfg.Headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// envOr returns the environment variable name, or def when it is unset.
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"scantron_inventory/utils"
+)
+
+// archiveConfig configures where the original bytes of every upload and its
+// annotated sheet are kept on disk, beyond the few retained in memory.
+type archiveConfig struct {
+	Dir  string // one subdirectory per upload; empty disables the archive
+	Keep int    // how many upload subdirectories to keep
+}
+
+// annotatedName is the file name of an archived upload's annotated sheet.
+const annotatedName = "annotated.png"
+
+// archiveDir returns the archive directory of an upload. Upload IDs are hex,
+// so anything else is rejected to keep paths inside a.Dir.
+func (a archiveConfig) archiveDir(id string) (string, bool) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", false
+	}
+	return filepath.Join(a.Dir, id), true
+}
+
+// archiveOriginal writes the uploaded bytes to the upload's archive directory
+// as original.<format> and returns the file name. Old uploads are pruned.
+func (a archiveConfig) archiveOriginal(id string, data []byte) (string, error) {
+	dir, ok := a.archiveDir(id)
+	if !ok {
+		return "", os.ErrInvalid
+	}
+	format, err := utils.DetectImageFormat(bytes.NewReader(data))
+	if err != nil {
+		format = "img"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := "original." + format
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+		return "", err
+	}
+	return name, pruneSubdirs(a.Dir, a.Keep)
+}
+
+// archiveAnnotated writes the annotated sheet of an upload decoded with tmpl
+// next to its original and returns the file name.
+func (a archiveConfig) archiveAnnotated(id string, data []byte, tmpl ScanTemplate) (string, error) {
+	dir, ok := a.archiveDir(id)
+	if !ok {
+		return "", os.ErrInvalid
+	}
+	_, png, err := scanner.Annotate(data, tmpl)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, annotatedName), png, 0o644); err != nil {
+		return "", err
+	}
+	return annotatedName, nil
+}
+
+// HandleArchivedOriginal serves the original bytes of an archived upload.
+func HandleArchivedOriginal(w http.ResponseWriter, req *http.Request) {
+	archive := configFor(req).Archive
+	dir, ok := archive.archiveDir(req.PathValue("id"))
+	if !ok || archive.Dir == "" {
+		httpError(w, req, "error.noUpload", http.StatusNotFound)
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "original.*"))
+	if len(matches) == 0 {
+		httpError(w, req, "error.noUpload", http.StatusNotFound)
+		return
+	}
+	serveArchived(w, req, matches[0])
+}
+
+// HandleArchivedAnnotated serves the annotated sheet of an archived upload.
+func HandleArchivedAnnotated(w http.ResponseWriter, req *http.Request) {
+	archive := configFor(req).Archive
+	dir, ok := archive.archiveDir(req.PathValue("id"))
+	if !ok || archive.Dir == "" {
+		httpError(w, req, "error.noUpload", http.StatusNotFound)
+		return
+	}
+	serveArchived(w, req, filepath.Join(dir, annotatedName))
+}
+
+// serveArchived sends an archived file as a download named after its upload.
+func serveArchived(w http.ResponseWriter, req *http.Request, path string) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		httpError(w, req, "error.noUpload", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, req, "error.readFile", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, req, "error.readFile", http.StatusInternalServerError)
+		return
+	}
+	name := filepath.Base(filepath.Dir(path)) + "-" + filepath.Base(path)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeContent(w, req, name, info.ModTime(), f)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxAuditEntries bounds how many recent audit entries are kept in memory.
+const maxAuditEntries = 200
+
+// AuditEntry records one change to a product's count at a location.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // what caused the change: scan, adjust, set, batch, transfer-out, transfer-in, reprocess, admit, correct, restore or restore-remove
+	Location string    `json:"location"`
+	Key      string    `json:"key"`
+	Delta    int       `json:"delta"`
+	Value    int       `json:"value"`         // count after the change
+	Ref      string    `json:"ref,omitempty"` // related location or sheet
+}
+
+// auditLog appends entries to a JSON lines file, when one is configured, and
+// keeps the most recent ones in memory.
+type auditLog struct {
+	mu    sync.Mutex
+	path  string
+	items []AuditEntry
+}
+
+var audit auditLog
+
+// record stamps and stores entries. A failure to write the file raises an
+// alert but never blocks the change being audited.
+func (a *auditLog) record(entries ...AuditEntry) {
+	now := time.Now()
+	for i := range entries {
+		if entries[i].Time.IsZero() {
+			entries[i].Time = now
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.items = append(a.items, entries...)
+	if len(a.items) > maxAuditEntries {
+		a.items = a.items[len(a.items)-maxAuditEntries:]
+	}
+	if a.path == "" {
+		return
+	}
+	if err := appendJSONLines(a.path, entries); err != nil {
+		alertf("Writing audit log %s failed: %v", a.path, err)
+	}
+}
+
+// recent returns the kept entries, newest first.
+func (a *auditLog) recent() []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]AuditEntry, len(a.items))
+	for i, e := range a.items {
+		out[len(a.items)-1-i] = e
+	}
+	return out
+}
+
+// since returns the entries recorded at or after t, oldest first. They are
+// read from the audit file when there is one, since memory only holds the
+// most recent entries. A last line without its newline is being written, or
+// was torn by a crash, and is skipped.
+func (a *auditLog) since(t time.Time) ([]AuditEntry, error) {
+	a.mu.Lock()
+	path := a.path
+	kept := slices.Clone(a.items)
+	a.mu.Unlock()
+
+	if path == "" {
+		return slices.DeleteFunc(kept, func(e AuditEntry) bool { return e.Time.Before(t) }), nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []AuditEntry
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return out, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return out, err
+		}
+		if !e.Time.Before(t) {
+			out = append(out, e)
+		}
+	}
+}
+
+// appendJSONLines appends one JSON document per value to the file at path.
+func appendJSONLines[T any](path string, values []T) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
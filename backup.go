@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// backupPrefix and backupSuffix frame the timestamp in backup file names.
+const (
+	backupPrefix = "inventory-"
+	backupSuffix = ".json"
+)
+
+// ErrUnknownBackup is returned when a restore names a backup that does not exist.
+var ErrUnknownBackup = errors.New("unknown backup")
+
+// backupRotator writes timestamped inventory snapshots to a directory and
+// keeps only the newest Keep of them. It is separate from the live file, so a
+// corrupt write there can be undone from here.
+type backupRotator struct {
+	Dir      string        // empty disables backups
+	Keep     int           // how many backups to keep
+	Interval time.Duration // how often to write one
+}
+
+// enabled reports whether a backup directory is configured.
+func (b backupRotator) enabled() bool {
+	return b.Dir != "" && b.Keep > 0 && b.Interval > 0
+}
+
+// runBackups writes a backup every interval until done is closed, each with
+// the -backup-* settings in force at the time; see hotSettings.
+func runBackups(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b := currentConfig().Backups
+			if !b.enabled() {
+				continue
+			}
+			if _, err := b.backup(); err != nil {
+				alertf("Inventory backup failed: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// backup writes the current inventory to a new backup file, removes the
+// oldest backups beyond Keep, and returns the new backup's name.
+func (b backupRotator) backup() (string, error) {
+	if err := os.MkdirAll(b.Dir, 0o755); err != nil {
+		return "", err
+	}
+	name := backupPrefix + time.Now().Format("20060102-150405.000") + backupSuffix
+	if err := (fileStore{path: filepath.Join(b.Dir, name)}).Save(storedState()); err != nil {
+		return "", err
+	}
+	names, err := b.list()
+	if err != nil {
+		return name, err
+	}
+	for len(names) > b.Keep {
+		if err := os.Remove(filepath.Join(b.Dir, names[len(names)-1])); err != nil {
+			return name, err
+		}
+		names = names[:len(names)-1]
+	}
+	return name, nil
+}
+
+// list returns the backup names, newest first.
+func (b backupRotator) list() ([]string, error) {
+	entries, err := os.ReadDir(b.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			names = append(names, name)
+		}
+	}
+	// The timestamp format sorts chronologically.
+	slices.Sort(names)
+	slices.Reverse(names)
+	return names, nil
+}
+
+// restore replaces the inventory with the named backup. The current
+// inventory is backed up first so a restore can itself be undone.
+func (b backupRotator) restore(name string) error {
+	names, err := b.list()
+	if err != nil {
+		return err
+	}
+	// Only names from the listing are accepted, so the path can't escape Dir.
+	if !slices.Contains(names, name) {
+		return ErrUnknownBackup
+	}
+	state, err := (fileStore{path: filepath.Join(b.Dir, name)}).Load()
+	if err != nil {
+		return err
+	}
+	saved, err := b.backup()
+	if err != nil {
+		return err
+	}
+	db.replace(state.Items, state.Aliases, name)
+	log.Printf("Inventory restored from backup %s (previous inventory saved as %s)", name, saved)
+	return nil
+}
+
+// HandleBackups lists the available backups, newest first.
+func HandleBackups(w http.ResponseWriter, req *http.Request) {
+	names, err := configFor(req).Backups.list()
+	if err != nil {
+		httpError(w, req, "error.backup", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, names)
+}
+
+// HandleRestore replaces the inventory with the backup named by ?backup=.
+func HandleRestore(w http.ResponseWriter, req *http.Request) {
+	backups := configFor(req).Backups
+	if !backups.enabled() {
+		httpError(w, req, "error.backup", http.StatusNotFound)
+		return
+	}
+	switch err := backups.restore(req.FormValue("backup")); {
+	case errors.Is(err, ErrUnknownBackup):
+		httpError(w, req, "error.unknownBackup", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("[%s] restore: %v", requestID(req), err)
+		httpError(w, req, "error.backup", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds every setting of the server. The flags, their environment
+// variables and the -config file fill one in at startup; the settings page
+// replaces it with a changed copy. A Config is never modified once stored,
+// so code holding one sees a consistent set of settings however long it
+// runs.
+type Config struct {
+	Addr          string
+	TLSCert       string
+	TLSKey        string
+	HTTPRedirect  string
+	CORSOrigins   string        // comma separated; "*" allows any
+	CORSMethods   string        // allowed for cross-origin API calls
+	CORSHeaders   string        // allowed for cross-origin API calls
+	Timeout       time.Duration // ordinary requests; 0 = no limit
+	SlowTimeout   time.Duration // uploads, decodes and exports; 0 = no limit
+	PprofAddr     string        // empty disables profiling
+	AdminPassword string        // empty disables the admin pages
+
+	DataFile  string // empty keeps the inventory in memory only
+	AuditFile string // empty keeps the audit log in memory only
+	Backups   backupRotator
+	Archive   archiveConfig
+
+	TimeZone   string // IANA name; empty uses the server's local zone
+	TimeFormat string // Go time layout
+
+	TemplateDir      string
+	Template         string // used when an upload does not pick one
+	Decode           decodeConfig
+	Commit           commitConfig
+	RulesFile        string
+	SKUNamesFile     string
+	MaxProducts      int // distinct keys scans may create; 0 = no limit
+	ReprocessWorkers int
+
+	Watchdog          watchdogConfig
+	Reorder           reorderConfig
+	ExpiryWarning     time.Duration // lots expiring within this are flagged
+	ResultsWebhook    string
+	NewProductWebhook string
+
+	Export           string // "sheets", "webhook" or empty
+	ExportSheetID    string
+	ExportSheetRange string
+	ExportWebhook    string
+	ExportInterval   time.Duration // 0 exports on demand only
+}
+
+// defaultConfig returns the settings used where no flag, environment
+// variable or config file says otherwise.
+func defaultConfig() *Config {
+	return &Config{
+		Addr:          ":3000",
+		CORSOrigins:   envOr("CORS_ORIGINS", ""),
+		CORSMethods:   envOr("CORS_METHODS", "GET, POST, PUT, DELETE, OPTIONS"),
+		CORSHeaders:   envOr("CORS_HEADERS", "Content-Type, Authorization"),
+		Timeout:       15 * time.Second,
+		SlowTimeout:   2 * time.Minute,
+		AdminPassword: envOr("ADMIN_PASSWORD", ""),
+		DataFile:      "inventory.json",
+		AuditFile:     "audit.jsonl",
+		Backups:       backupRotator{Dir: "backups", Keep: 10, Interval: time.Hour},
+		Archive:       archiveConfig{Keep: 100},
+		TimeFormat:    timeDisplay.Layout,
+		Template:      defaultTemplate.Name,
+		Decode: decodeConfig{
+			Limits:        dimensionLimits{MaxWidth: 10000, MaxHeight: 10000},
+			Duplicates:    DuplicatesSum,
+			BlankTensFill: 0.25,
+			Review:        reviewConfig{MinConfidence: 0.3},
+			Crops:         cropConfig{Keep: 100},
+		},
+		Commit:           commitConfig{Policy: CommitAuto, MinConfidence: 0.5},
+		ReprocessWorkers: 2,
+		Watchdog:         watchdogConfig{Window: 20, Threshold: 0.5},
+		Reorder:          reorderConfig{Window: 30 * 24 * time.Hour, Cover: 14},
+		ExpiryWarning:    30 * 24 * time.Hour,
+		ExportSheetRange: "Inventory!A1:H",
+	}
+}
+
+// registerFlags defines a flag on fs for every setting, filling in c and
+// defaulting to its current values.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file; serves HTTPS when set with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file")
+	fs.StringVar(&c.DataFile, "data", c.DataFile, "file the inventory is persisted to (empty keeps it in memory only)")
+	fs.StringVar(&c.HTTPRedirect, "http-redirect", c.HTTPRedirect, "with TLS, also listen on this address and redirect HTTP to HTTPS (e.g. :80)")
+	fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "comma separated origins allowed to call /api (\"*\" for any; env CORS_ORIGINS)")
+	fs.StringVar(&c.CORSMethods, "cors-methods", c.CORSMethods, "methods allowed for cross-origin API calls (env CORS_METHODS)")
+	fs.StringVar(&c.CORSHeaders, "cors-headers", c.CORSHeaders, "headers allowed for cross-origin API calls (env CORS_HEADERS)")
+	fs.IntVar(&c.Decode.Limits.MaxWidth, "max-width", c.Decode.Limits.MaxWidth, "reject uploaded images wider than this many pixels")
+	fs.IntVar(&c.Decode.Limits.MaxHeight, "max-height", c.Decode.Limits.MaxHeight, "reject uploaded images taller than this many pixels")
+	fs.StringVar(&c.TimeZone, "tz", c.TimeZone, "IANA time zone used to display timestamps (default: server local time)")
+	fs.StringVar(&c.TimeFormat, "time-format", c.TimeFormat, "Go time layout used to display timestamps in the UI and reports")
+	fs.BoolVar(&c.Decode.NoAnnotate, "no-annotate", c.Decode.NoAnnotate, "decode uploads without drawing on them or writing example.png, for throughput")
+	fs.BoolVar(&c.Decode.QuarterTurns, "try-quarter-turns", c.Decode.QuarterTurns, "also retry unreadable sheets rotated 90° and 270° (180° is always tried)")
+	fs.BoolVar(&c.Decode.RequireSheetID, "require-sheet-id", c.Decode.RequireSheetID, "reject sheets whose sheet-ID QR code does not read instead of giving them a generated ID")
+	fs.Float64Var(&c.Decode.BlankTensFill, "blank-tens-fill", c.Decode.BlankTensFill, "warn on rows whose unmarked tens column has a bubble filled beyond this fraction, instead of taking it as blank (0 disables)")
+	fs.StringVar(&c.TemplateDir, "templates", c.TemplateDir, "directory of additional *.json scan templates")
+	fs.StringVar(&c.Template, "template", c.Template, "scan template used when an upload does not pick one")
+	fs.StringVar(&c.AuditFile, "audit", c.AuditFile, "file audit entries are appended to (empty keeps them in memory only)")
+	fs.StringVar(&c.Backups.Dir, "backup-dir", c.Backups.Dir, "directory timestamped inventory backups are written to (empty disables backups)")
+	fs.IntVar(&c.Backups.Keep, "backup-keep", c.Backups.Keep, "number of inventory backups to keep")
+	fs.DurationVar(&c.Backups.Interval, "backup-interval", c.Backups.Interval, "how often to back up the inventory")
+	fs.StringVar(&c.Decode.Review.Path, "review-queue", c.Decode.Review.Path, "append failed and low-confidence rows to this JSON lines file")
+	fs.Float64Var(&c.Decode.Review.MinConfidence, "review-below", c.Decode.Review.MinConfidence, "queue rows whose confidence is below this for review")
+	fs.StringVar(&c.Decode.Crops.Dir, "crop-dir", c.Decode.Crops.Dir, "save PNG crops of failed rows under this directory, one folder per sheet")
+	fs.IntVar(&c.Decode.Crops.Keep, "crop-keep", c.Decode.Crops.Keep, "number of per-sheet crop folders to keep")
+	fs.StringVar(&c.Archive.Dir, "upload-dir", c.Archive.Dir, "keep every upload's original bytes and annotated sheet under this directory, one folder per upload")
+	fs.IntVar(&c.Archive.Keep, "upload-keep", c.Archive.Keep, "number of per-upload folders to keep under -upload-dir")
+	fs.Var(&c.Decode.Duplicates, "duplicate-keys", "how rows of one sheet with the same key count: sum, max (only the highest) or error (none)")
+	fs.Var(&c.Commit.Policy, "commit-policy", "when uploads change the inventory: auto, confident (only rows above -commit-min-confidence) or confirm (operator confirms every sheet)")
+	fs.Float64Var(&c.Commit.MinConfidence, "commit-min-confidence", c.Commit.MinConfidence, "with -commit-policy confident, rows below this confidence wait for confirmation")
+	fs.BoolVar(&c.Commit.AllOrNothing, "all-or-nothing", c.Commit.AllOrNothing, "reject a sheet unless every row decodes, instead of applying the rows that did")
+	fs.IntVar(&c.ReprocessWorkers, "reprocess-workers", c.ReprocessWorkers, "how many retained uploads /reprocess decodes at once")
+	fs.IntVar(&c.Watchdog.Window, "watchdog-window", c.Watchdog.Window, "number of recent sheets the decode success rate is averaged over")
+	fs.Float64Var(&c.Watchdog.Threshold, "watchdog-threshold", c.Watchdog.Threshold, "alert when the average share of valid rows drops below this (0 disables)")
+	fs.StringVar(&c.Watchdog.Webhook, "watchdog-webhook", c.Watchdog.Webhook, "URL the success-rate alert is also POSTed to as JSON")
+	fs.DurationVar(&c.Reorder.Window, "velocity-window", c.Reorder.Window, "audit history the consumption rate behind reorder suggestions is averaged over")
+	fs.IntVar(&c.Reorder.Cover, "reorder-cover", c.Reorder.Cover, "days of consumption a suggested reorder quantity covers")
+	fs.IntVar(&c.MaxProducts, "max-products", c.MaxProducts, "distinct products scans may create; new keys beyond it are quarantined for review (0 = no limit)")
+	fs.StringVar(&c.Export, "export", c.Export, "mirror the inventory to: sheets (a Google Sheet; token from env GOOGLE_SHEETS_TOKEN) or webhook (JSON POST); empty disables")
+	fs.StringVar(&c.ExportSheetID, "export-sheet-id", c.ExportSheetID, "with -export sheets, the spreadsheet ID")
+	fs.StringVar(&c.ExportSheetRange, "export-sheet-range", c.ExportSheetRange, "with -export sheets, the A1 range the rows replace")
+	fs.StringVar(&c.ExportWebhook, "export-webhook", c.ExportWebhook, "with -export webhook, the URL the rows are POSTed to")
+	fs.DurationVar(&c.ExportInterval, "export-interval", c.ExportInterval, "how often to export the inventory (0 = only on POST /export/sheet)")
+	fs.DurationVar(&c.Timeout, "timeout", c.Timeout, "cut off ordinary requests with a 503 after this long (0 = no limit)")
+	fs.DurationVar(&c.SlowTimeout, "slow-timeout", c.SlowTimeout, "cut off uploads, decodes and exports with a 503 after this long (0 = no limit)")
+	fs.DurationVar(&c.ExpiryWarning, "expiry-warning", c.ExpiryWarning, "flag lots on the dashboard that expire within this")
+	fs.StringVar(&c.ResultsWebhook, "results-webhook", c.ResultsWebhook, "URL every decoded upload's sheet and results are POSTed to as JSON, whether or not it is applied")
+	fs.StringVar(&c.NewProductWebhook, "new-product-webhook", c.NewProductWebhook, "URL a JSON notice is POSTed to when a scan creates a product key that did not exist")
+	fs.StringVar(&c.SKUNamesFile, "sku-names", c.SKUNamesFile, "CSV file of key,name[,category] lines naming products that scans create")
+	fs.StringVar(&c.PprofAddr, "pprof", c.PprofAddr, "serve runtime profiles under /debug/pprof on this separate address, e.g. localhost:6060; they need the -admin-password when one is set (empty disables)")
+	fs.StringVar(&c.RulesFile, "rules", c.RulesFile, "JSON file of validation rules every decoded sheet is checked against before it is applied")
+	fs.StringVar(&c.AdminPassword, "admin-password", c.AdminPassword, "password for the /settings page, the /admin endpoints and PUT /api/template, given with HTTP basic auth; empty disables them (env ADMIN_PASSWORD)")
+}
+
+// flagSet returns a FlagSet of the settings whose flags fill in c.
+func (c *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("settings", flag.ContinueOnError)
+	c.registerFlags(fs)
+	return fs
+}
+
+// validate checks what the flags cannot check one at a time.
+func (c *Config) validate() error {
+	if _, ok := scanTemplates.lookup(c.Template); !ok {
+		return fmt.Errorf("template: unknown template %q", c.Template)
+	}
+	return nil
+}
+
+// template returns the named scan template, or the -template one when name
+// is empty, set to decode with c.Decode.
+func (c *Config) template(name string) (ScanTemplate, bool) {
+	if name == "" {
+		name = c.Template
+	}
+	tmpl, ok := scanTemplates.lookup(name)
+	if !ok {
+		return ScanTemplate{}, false
+	}
+	return c.decoding(tmpl), true
+}
+
+// decoding returns tmpl set to decode with c.Decode.
+func (c *Config) decoding(tmpl ScanTemplate) ScanTemplate {
+	tmpl.Decode = c.Decode
+	return tmpl
+}
+
+// liveConfig holds the Config in force. main stores the one it starts with
+// and the settings page swaps in changed copies.
+var liveConfig atomic.Pointer[Config]
+
+// currentConfig returns the Config in force, or the defaults before main
+// has stored one. Callers must not modify it.
+func currentConfig() *Config {
+	if c := liveConfig.Load(); c != nil {
+		return c
+	}
+	return defaultConfig()
+}
+
+type configKey struct{}
+
+// withConfig loads the Config in force once per request and stores it in
+// the request context, so a settings change that lands mid-request can't
+// give one handler a mix of old and new values.
+func withConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), configKey{}, currentConfig())))
+	})
+}
+
+// configFor returns the Config withConfig stored for req, or the one in
+// force for requests that didn't pass through it. Callers must not modify it.
+func configFor(req *http.Request) *Config {
+	if c, ok := req.Context().Value(configKey{}).(*Config); ok {
+		return c
+	}
+	return currentConfig()
+}
+
+// flagEnv names the environment variables that also set a flag. They take
+// precedence over the config file, and flags given on the command line take
+// precedence over both.
+var flagEnv = map[string]string{
+	"cors-origins":   "CORS_ORIGINS",
+	"cors-methods":   "CORS_METHODS",
+	"cors-headers":   "CORS_HEADERS",
+	"admin-password": "ADMIN_PASSWORD",
+}
+
+// loadConfigFile applies a JSON config file to the flags of fs. The file is
+// one object keyed by flag name, e.g. {"addr": ":8080", "backup-keep": 5},
+// so every setting has the same name in the file and on the command line
+// and lands in the Config the flags fill in. Flags
+// already set on the command line or through their environment variable
+// are left alone; unknown keys are an error.
+func loadConfigFile(path string, fs *flag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for name, v := range values {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if env, ok := flagEnv[name]; ok {
+			if _, set := os.LookupEnv(env); set {
+				continue
+			}
+		}
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			s = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("%s: %q must be a string, number or boolean", path, name)
+		}
+		if err := fs.Set(name, s); err != nil {
+			return fmt.Errorf("%s: %q: %w", path, name, err)
+		}
+	}
+	return nil
+}
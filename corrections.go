@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errUnknownSheet is returned by sheetContribution when no applied row
+	// of the sheet is on record.
+	errUnknownSheet = errors.New("no applied rows of this sheet are on record")
+	// errCountSheet is returned by sheetContribution for full count sheets,
+	// whose rows replaced counts rather than adding to them; correct those
+	// by posting a new count.
+	errCountSheet = errors.New("sheet was a full count")
+)
+
+// correctionMu serializes sheet corrections, so two corrections of one sheet
+// posted together do not both apply the difference from the same history.
+var correctionMu sync.Mutex
+
+// sheetCorrection is how one product's contribution from a sheet changed.
+type sheetCorrection struct {
+	Location string `json:"location"`
+	Key      string `json:"key"`
+	Before   int    `json:"before"` // units the sheet had contributed, counting earlier corrections
+	After    int    `json:"after"`  // units from the corrected count
+	Delta    int    `json:"delta"`
+	Value    int    `json:"value"` // count after the correction
+}
+
+// correctionReport is the JSON body returned by HandleCorrectSheet.
+type correctionReport struct {
+	Sheet   string            `json:"sheet"`
+	Changes []sheetCorrection `json:"changes"`
+}
+
+// sheetContribution returns the location sheet id was applied at and the
+// units its audited scans, and any corrections since, added per key. Only
+// the audit file goes back further than the entries kept in memory.
+func sheetContribution(id string) (string, map[string]int, error) {
+	entries, err := audit.since(time.Time{})
+	if err != nil {
+		return "", nil, err
+	}
+	var loc string
+	units := map[string]int{}
+	for _, e := range entries {
+		if e.Ref != id {
+			continue
+		}
+		switch e.Action {
+		case "set":
+			return "", nil, errCountSheet
+		case "scan", "correct":
+			loc = e.Location
+			units[e.Key] += e.Delta
+		}
+	}
+	if loc == "" {
+		return "", nil, errUnknownSheet
+	}
+	return loc, units, nil
+}
+
+// HandleCorrectSheet replaces what a past sheet contributed to the inventory.
+// The form repeats key and count pairs, count being the marks the row should
+// have read; each key's count is changed by the difference between those
+// units and what the sheet added so far. Keys not posted are left alone, so
+// a misread key is dropped by posting it with a count of 0.
+func HandleCorrectSheet(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		httpError(w, req, "error.parseForm", http.StatusBadRequest)
+		return
+	}
+	keys, counts := req.Form["key"], req.Form["count"]
+	if len(keys) == 0 || len(keys) != len(counts) {
+		httpError(w, req, "error.keyRequired", http.StatusBadRequest)
+		return
+	}
+	corrected := map[string]int{}
+	for i, key := range keys {
+		key = strings.TrimSpace(key)
+		count, err := strconv.Atoi(strings.TrimSpace(counts[i]))
+		if key == "" || err != nil || count < 0 {
+			httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+			return
+		}
+		corrected[key] = count
+	}
+
+	id := req.PathValue("id")
+	correctionMu.Lock()
+	defer correctionMu.Unlock()
+	loc, before, err := sheetContribution(id)
+	switch {
+	case errors.Is(err, errUnknownSheet):
+		httpError(w, req, "error.unknownSheet", http.StatusNotFound)
+		return
+	case errors.Is(err, errCountSheet):
+		httpError(w, req, "error.countSheet", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("[%s] correct sheet %s: %v", requestID(req), id, err)
+		httpError(w, req, "error.readAudit", http.StatusInternalServerError)
+		return
+	}
+
+	report := correctionReport{Sheet: id}
+	stock := db.snapshotLocation(loc)
+	for key, count := range corrected {
+		c := sheetCorrection{Location: loc, Key: key, Before: before[key], After: stock[key].Units(count)}
+		if c.Delta = c.After - c.Before; c.Delta == 0 {
+			continue
+		}
+		prod, err := db.inc(loc, key, c.Delta, "correct", id)
+		if errors.Is(err, ErrProductLimit) {
+			alertf("Correcting sheet %s: product limit of %d reached; new key %q at %s quarantined for review", id, db.maxProducts, key, loc)
+			continue
+		}
+		c.Value = prod.Value
+		report.Changes = append(report.Changes, c)
+	}
+	slices.SortFunc(report.Changes, func(a, b sheetCorrection) int { return cmp.Compare(a.Key, b.Key) })
+	log.Printf("[%s] Corrected sheet %s at %s: %d products changed", requestID(req), id, loc, len(report.Changes))
+	writeJSON(w, http.StatusOK, report)
+}
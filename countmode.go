@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+// CountMode says what the counts on a sheet mean.
+type CountMode string
+
+const (
+	CountAdd CountMode = "add" // counts are added to the stock (the default)
+	CountSet CountMode = "set" // counts are a full physical count that replaces the stock
+)
+
+// parseCountMode validates a count mode; empty means CountAdd.
+func parseCountMode(s string) (CountMode, error) {
+	switch m := CountMode(s); m {
+	case "":
+		return CountAdd, nil
+	case CountAdd, CountSet:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown count mode %q (want add or set)", s)
+}
+
+// countModeFor returns the count mode chosen on upload, or the template's
+// when none was chosen.
+func countModeFor(chosen string, tmpl ScanTemplate) (CountMode, error) {
+	if chosen == "" {
+		chosen = string(tmpl.Mode)
+	}
+	return parseCountMode(chosen)
+}
@@ -0,0 +1,849 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"scantron_inventory/utils"
+)
+
+// ScanTemplate describes where each row's fields sit on a scanned sheet.
+// Rectangles are given for the first row; every following row is shifted
+// down by RowPitch pixels. Width and Height are the expected sheet size.
+type ScanTemplate struct {
+	Name     string              `json:"name"`
+	Width    int                 `json:"width"`
+	Height   int                 `json:"height"`
+	Rows     int                 `json:"rows"`
+	RowPitch float64             `json:"rowPitch"`
+	KeyRect  image.Rectangle     `json:"keyRect"`
+	TensRect image.Rectangle     `json:"tensRect"`
+	OnesRect image.Rectangle     `json:"onesRect"`
+	Sections utils.SectionConfig `json:"sections"`
+	QR       utils.QRConfig      `json:"qr"`
+
+	// SheetIDRect locates an optional sheet-level QR code identifying the
+	// sheet (the client QR printed by make_document.py). Empty means none.
+	SheetIDRect image.Rectangle `json:"sheetIdRect"`
+	// LocationRect locates an optional QR code naming the stock room the
+	// sheet counts. When it decodes, it overrides the location chosen on upload.
+	LocationRect image.Rectangle `json:"locationRect"`
+	// RowMarkerRect locates the square marker printed at the start of the
+	// first row; it repeats every RowPitch. Rows without a marker before the
+	// last marker seen are reported as missing, which catches sheets fed
+	// crooked. Empty skips the check.
+	RowMarkerRect image.Rectangle `json:"rowMarkerRect"`
+
+	// ReferenceRect is searched for a solid square marker ReferenceSize
+	// inches wide; it must contain the marker at every resolution the
+	// template should accept. DPI is the resolution the coordinates are laid
+	// out for. When all three are set, the template is scaled by the measured
+	// resolution over DPI before decoding, so one template serves 150, 200
+	// and 300 DPI scans.
+	ReferenceRect image.Rectangle `json:"referenceRect"`
+	ReferenceSize float64         `json:"referenceSize,omitempty"`
+	DPI           float64         `json:"dpi,omitempty"`
+
+	// Digits maps each bubble section, left to right, to the digit printed
+	// on it, for forms whose labels are not 0-9 in order. Empty means the
+	// section index is the digit.
+	Digits []int `json:"digits,omitempty"`
+
+	// Reanchor lets a row's other fields follow its key QR code: when the
+	// code is found up to this many pixels above or below the middle of the
+	// key rectangle, the row's other fields move by as much, so a slightly
+	// skewed row is still read where it was printed. 0 disables it. It
+	// assumes the key rectangle is centered on the printed code.
+	Reanchor int `json:"reanchor,omitempty"`
+
+	// Fields describes every field of a row and how to decode it. When empty,
+	// KeyRect, TensRect and OnesRect describe a QR key and two bubble columns.
+	Fields []FieldSpec `json:"fields,omitempty"`
+	// Keys lists the product keys a sheet's key bubbles choose from, for
+	// forms that print a fixed product list instead of a QR code per row:
+	// marking number n selects Keys[n].
+	Keys []string `json:"keys,omitempty"`
+
+	// Mode is the count mode of sheets printed from the template: "add"
+	// (the default) or "set" for full physical count sheets. A mode chosen
+	// on upload overrides it.
+	Mode CountMode `json:"mode,omitempty"`
+
+	// Only restricts decoding to some rows while troubleshooting a sheet. It
+	// is set per request by the debug endpoints and never loaded from JSON.
+	Only RowRange `json:"-"`
+
+	// Decode is the decoder behavior of the settings the template was
+	// looked up with; see Config.template. It is never loaded from JSON.
+	Decode decodeConfig `json:"-"`
+}
+
+// RowRange selects Count rows starting at the 0-based row Start. A zero Count
+// runs through the last row, so the zero RowRange is the whole sheet.
+type RowRange struct {
+	Start, Count int
+}
+
+// digit returns the value of a digit column's reading through t.Digits: the
+// digit printed on the marked section, or 0 when no section stood out.
+func (t ScanTemplate) digit(r utils.SectionReading) int {
+	switch {
+	case !r.Marked:
+		return 0
+	case r.Standout < len(t.Digits):
+		return t.Digits[r.Standout]
+	}
+	return r.Standout
+}
+
+// section returns the index of the bubble section printed with digit d; it
+// is the inverse of digit.
+func (t ScanTemplate) section(d int) int {
+	if i := slices.Index(t.Digits, d); i >= 0 {
+		return i
+	}
+	return d
+}
+
+// markedIndex returns the section that stood out in r, or -1 for none.
+func markedIndex(r utils.SectionReading) int {
+	if !r.Marked {
+		return -1
+	}
+	return r.Standout
+}
+
+// rowSpan returns the first row to decode and the row after the last,
+// clamped to the template's rows.
+func (t ScanTemplate) rowSpan() (start, end int) {
+	start, end = max(t.Only.Start, 0), t.Rows
+	if t.Only.Count > 0 {
+		end = min(start+t.Only.Count, t.Rows)
+	}
+	return min(start, end), end
+}
+
+// FieldType selects the decoder used for a field.
+type FieldType string
+
+const (
+	FieldQR        FieldType = "qr"
+	FieldBubbles   FieldType = "bubbles"
+	FieldNumberOCR FieldType = "number-ocr" // handwritten number box; not decoded yet
+)
+
+// FieldRole says what a field contributes to a row's ScanResult. Fields
+// without a role end up in ScanResult.Fields.
+type FieldRole string
+
+const (
+	// RoleKey fields give the product key: a qr field's text, or the number
+	// marked on one or more bubbles fields, most significant first, picking
+	// an entry of ScanTemplate.Keys.
+	RoleKey FieldRole = "key"
+	// RoleTens and RoleOnes bubbles fields give the count's two digits.
+	RoleTens FieldRole = "tens"
+	RoleOnes FieldRole = "ones"
+	// A RoleCount qr field gives the whole count as a number.
+	RoleCount FieldRole = "count"
+)
+
+// Field names that take the role of the same name when a field sets none,
+// as in templates written before roles existed.
+const (
+	fieldKey  = "key"
+	fieldTens = "tens"
+	fieldOnes = "ones"
+)
+
+// FieldSpec is one field of a row: its name, type and first-row rectangle.
+type FieldSpec struct {
+	Name string          `json:"name"`
+	Type FieldType       `json:"type"`
+	Rect image.Rectangle `json:"rect"`
+	// Role is what the field is decoded into. Empty means the role named by
+	// the field's name, if any.
+	Role FieldRole `json:"role,omitempty"`
+	// Weights scores a bubbles field: the value of marking each section, in
+	// section order, such as a condition grade. The score is reported in
+	// ScanResult.Scores alongside the digit; it does not change the count.
+	Weights []float64 `json:"weights,omitempty"`
+}
+
+// FieldScore is the reading of a weighted bubbles field.
+type FieldScore struct {
+	Section int     `json:"section"` // marked section; -1 when none stood out
+	Score   float64 `json:"score"`   // its weight; 0 when none stood out
+}
+
+// role returns f.Role, defaulting to the role named by f.Name.
+func (f FieldSpec) role() FieldRole {
+	if f.Role != "" {
+		return f.Role
+	}
+	switch f.Name {
+	case fieldKey, fieldTens, fieldOnes:
+		return FieldRole(f.Name)
+	}
+	return ""
+}
+
+// score weighs a reading of f by f.Weights.
+func (f FieldSpec) score(r utils.SectionReading) FieldScore {
+	s := FieldScore{Section: markedIndex(r)}
+	if s.Section >= 0 && s.Section < len(f.Weights) {
+		s.Score = f.Weights[s.Section]
+	}
+	return s
+}
+
+// errUnsupportedField is returned by decoders for field types that are not
+// implemented yet.
+var errUnsupportedField = errors.New("field type not supported yet")
+
+// fields returns the template's fields, deriving them from KeyRect, TensRect
+// and OnesRect for templates that list none.
+func (t ScanTemplate) fields() []FieldSpec {
+	if len(t.Fields) > 0 {
+		return t.Fields
+	}
+	return []FieldSpec{
+		{Name: fieldKey, Type: FieldQR, Rect: t.KeyRect},
+		{Name: fieldTens, Type: FieldBubbles, Rect: t.TensRect},
+		{Name: fieldOnes, Type: FieldBubbles, Rect: t.OnesRect},
+	}
+}
+
+// rowRegions returns the pixel regions the decoder reads for row i of an
+// image with the given bounds, keyed by field name ("marker" for the row
+// marker). Field rects are grown by the padding of their type. The fields
+// read after the key are moved down by dy, the amount the row was
+// reanchored by.
+func (t ScanTemplate) rowRegions(i, dy int, bounds image.Rectangle) map[string]image.Rectangle {
+	offset := t.rowOffset(i)
+	regions := make(map[string]image.Rectangle)
+	for _, f := range t.fields() {
+		rect := f.Rect.Add(offset)
+		if f.role() != RoleKey {
+			rect = rect.Add(image.Pt(0, dy))
+		}
+		switch f.Type {
+		case FieldQR:
+			rect = t.QR.Padding.Expand(rect, bounds)
+		case FieldBubbles:
+			rect = t.Sections.Padding.Expand(rect, bounds)
+		}
+		regions[f.Name] = rect
+	}
+	if !t.RowMarkerRect.Empty() {
+		regions["marker"] = t.RowMarkerRect.Add(offset)
+	}
+	return regions
+}
+
+// Bounds returns the smallest rectangle holding every region the decoder
+// reads on a sheet of the template: each row's fields and marker and the
+// sheet-level codes and reference marker.
+func (t ScanTemplate) Bounds() image.Rectangle {
+	b := t.SheetIDRect.Union(t.LocationRect).Union(t.ReferenceRect)
+	last := t.rowOffset(max(t.Rows-1, 0))
+	rects := []image.Rectangle{t.RowMarkerRect}
+	for _, f := range t.fields() {
+		rects = append(rects, f.Rect)
+	}
+	for _, r := range rects {
+		if !r.Empty() {
+			b = b.Union(r).Union(r.Add(last))
+		}
+	}
+	return b
+}
+
+// validate checks that the template is usable: positive dimensions, valid
+// fields, every region of every row inside the sheet, and no two regions of
+// a row overlapping.
+func (t ScanTemplate) validate() error {
+	if t.Width <= 0 || t.Height <= 0 || t.Rows <= 0 || t.RowPitch <= 0 || t.Sections.NumSections <= 0 {
+		return errors.New("width, height, rows, rowPitch and sections.numSections must be positive")
+	}
+	if err := t.validateFields(); err != nil {
+		return err
+	}
+	if _, err := parseCountMode(string(t.Mode)); err != nil {
+		return err
+	}
+	if t.Reanchor < 0 {
+		return errors.New("reanchor must not be negative")
+	}
+	if c := t.Sections.SmudgeCloseness; c < 0 || c > 1 {
+		return errors.New("sections.smudgeCloseness must be between 0 and 1")
+	}
+	sheet := image.Rect(0, 0, t.Width, t.Height)
+	regions := map[string]image.Rectangle{}
+	for _, f := range t.fields() {
+		regions[f.Name] = f.Rect
+	}
+	if !t.RowMarkerRect.Empty() {
+		regions["rowMarker"] = t.RowMarkerRect
+	}
+	names := slices.Sorted(maps.Keys(regions))
+	last := t.rowOffset(t.Rows - 1)
+	for i, name := range names {
+		r := regions[name]
+		if r.Empty() {
+			return fmt.Errorf("region %q is empty", name)
+		}
+		if !r.In(sheet) || !r.Add(last).In(sheet) {
+			return fmt.Errorf("region %q falls outside the %dx%d sheet", name, t.Width, t.Height)
+		}
+		for _, other := range names[i+1:] {
+			if r.Overlaps(regions[other]) {
+				return fmt.Errorf("regions %q and %q overlap", name, other)
+			}
+		}
+	}
+	if len(t.Digits) > 0 {
+		if len(t.Digits) != t.Sections.NumSections {
+			return fmt.Errorf("digits lists %d values for %d sections", len(t.Digits), t.Sections.NumSections)
+		}
+		for i, d := range t.Digits {
+			if d < 0 || d > 9 || slices.Index(t.Digits, d) != i {
+				return fmt.Errorf("digits must be distinct values from 0 to 9, got %v", t.Digits)
+			}
+		}
+	}
+	sc := t.Sections
+	if sc.LeftInset < 0 || sc.RightInset < 0 || sc.Gap < 0 {
+		return errors.New("sections.leftInset, rightInset and gap must not be negative")
+	}
+	for _, f := range t.fields() {
+		if f.Type == FieldBubbles && sc.LeftInset+sc.RightInset+(sc.NumSections-1)*sc.Gap+sc.NumSections > f.Rect.Dx() {
+			return fmt.Errorf("region %q is too narrow for %d bubbles with the given insets and gap", f.Name, sc.NumSections)
+		}
+	}
+	for name, r := range map[string]image.Rectangle{"sheetIdRect": t.SheetIDRect, "locationRect": t.LocationRect} {
+		if !r.Empty() && !r.In(sheet) {
+			return fmt.Errorf("region %q falls outside the %dx%d sheet", name, t.Width, t.Height)
+		}
+	}
+	return nil
+}
+
+// validateFields checks that the template's fields have known types, roles
+// that suit them and unique names, and that they give every row a key and a
+// count: a qr key or bubbles keys picking from Keys, and bubble tens and ones
+// columns or a qr count.
+func (t ScanTemplate) validateFields() error {
+	seen := make(map[string]FieldType)
+	roles := make(map[FieldRole]int)
+	for _, f := range t.Fields {
+		switch f.Type {
+		case FieldQR, FieldBubbles, FieldNumberOCR:
+		default:
+			return fmt.Errorf("field %q: unknown type %q", f.Name, f.Type)
+		}
+		if _, dup := seen[f.Name]; dup {
+			return fmt.Errorf("field %q listed twice", f.Name)
+		}
+		if len(f.Weights) > 0 && f.Type != FieldBubbles {
+			return fmt.Errorf("field %q: only bubbles fields take weights", f.Name)
+		}
+		if len(f.Weights) > 0 && !t.Sections.AutoSections && len(f.Weights) != t.Sections.NumSections {
+			return fmt.Errorf("field %q: weights lists %d values for %d sections", f.Name, len(f.Weights), t.Sections.NumSections)
+		}
+		switch role := f.role(); {
+		case role == "":
+		case role == RoleKey && (f.Type == FieldQR || f.Type == FieldBubbles):
+		case (role == RoleTens || role == RoleOnes) && f.Type == FieldBubbles:
+		case role == RoleCount && f.Type == FieldQR:
+		case role != RoleKey && role != RoleTens && role != RoleOnes && role != RoleCount:
+			return fmt.Errorf("field %q: unknown role %q", f.Name, role)
+		default:
+			return fmt.Errorf("field %q: a %s field cannot have role %q", f.Name, f.Type, role)
+		}
+		seen[f.Name] = f.Type
+		roles[f.role()]++
+	}
+	if len(t.Fields) == 0 {
+		if len(t.Keys) > 0 {
+			return errors.New("keys needs bubbles fields with role key")
+		}
+		return nil
+	}
+	for _, role := range []FieldRole{RoleTens, RoleOnes, RoleCount} {
+		if roles[role] > 1 {
+			return fmt.Errorf("more than one field has role %q", role)
+		}
+	}
+	l := t.layout()
+	switch {
+	case len(l.key) == 0:
+		return errors.New("a field with role key is required")
+	case slices.ContainsFunc(l.key, func(f FieldSpec) bool { return f.Type == FieldQR }) && len(l.key) > 1:
+		return errors.New("the key is read from one qr field or from bubbles fields, not both")
+	case l.keyFromBubbles() && len(t.Keys) == 0:
+		return errors.New("bubbles fields with role key need the template's keys")
+	case !l.keyFromBubbles() && len(t.Keys) > 0:
+		return errors.New("keys needs bubbles fields with role key")
+	case l.count != nil && (l.tens != nil || l.ones != nil):
+		return errors.New("a count field replaces the tens and ones fields")
+	case l.count == nil && (l.tens == nil || l.ones == nil):
+		return errors.New("the count needs a field with role count or fields with roles tens and ones")
+	}
+	if i := slices.Index(t.Keys, ""); i >= 0 {
+		return fmt.Errorf("keys: entry %d is empty", i)
+	}
+	return nil
+}
+
+// rowLayout is the template's fields grouped by their role.
+type rowLayout struct {
+	key               []FieldSpec // one qr field, or bubbles fields most significant first
+	tens, ones, count *FieldSpec  // nil when no field has the role
+	extra             []FieldSpec
+}
+
+// layout groups the template's fields by role.
+func (t ScanTemplate) layout() rowLayout {
+	var l rowLayout
+	for _, f := range t.fields() {
+		switch f.role() {
+		case RoleKey:
+			l.key = append(l.key, f)
+		case RoleTens:
+			l.tens = &f
+		case RoleOnes:
+			l.ones = &f
+		case RoleCount:
+			l.count = &f
+		default:
+			l.extra = append(l.extra, f)
+		}
+	}
+	return l
+}
+
+// keyFromBubbles reports whether the key is marked on bubbles rather than
+// read from a QR code.
+func (l rowLayout) keyFromBubbles() bool {
+	return len(l.key) > 0 && l.key[0].Type == FieldBubbles
+}
+
+// defaultTemplate matches the sheet produced by python/make_document.py
+// scanned at 200 DPI.
+var defaultTemplate = ScanTemplate{
+	Name:     "default",
+	Width:    1654, // A4 at 200 DPI
+	Height:   2339,
+	Rows:     21,
+	RowPitch: 83.47,
+	KeyRect:  image.Rect(450, 540, 515, 605),
+	TensRect: image.Rect(534, 541, 951, 576),
+	OnesRect: image.Rect(980, 541, 1395, 576),
+	Sections: utils.DefaultSectionConfig(10),
+
+	SheetIDRect:   image.Rect(130, 115, 400, 385),
+	RowMarkerRect: image.Rect(28, 556, 56, 583),
+}
+
+// Shift returns a copy of the template with every region moved by (dx, dy).
+func (t ScanTemplate) Shift(dx, dy int) ScanTemplate {
+	d := image.Pt(dx, dy)
+	if !t.SheetIDRect.Empty() {
+		t.SheetIDRect = t.SheetIDRect.Add(d)
+	}
+	if !t.LocationRect.Empty() {
+		t.LocationRect = t.LocationRect.Add(d)
+	}
+	if !t.RowMarkerRect.Empty() {
+		t.RowMarkerRect = t.RowMarkerRect.Add(d)
+	}
+	if !t.ReferenceRect.Empty() {
+		t.ReferenceRect = t.ReferenceRect.Add(d)
+	}
+	t.KeyRect = t.KeyRect.Add(d)
+	t.TensRect = t.TensRect.Add(d)
+	t.OnesRect = t.OnesRect.Add(d)
+	if len(t.Fields) > 0 {
+		t.Fields = slices.Clone(t.Fields)
+		for i := range t.Fields {
+			t.Fields[i].Rect = t.Fields[i].Rect.Add(d)
+		}
+	}
+	return t
+}
+
+// Scale returns a copy of the template with every coordinate and pixel
+// distance multiplied by f. The reference marker settings are left alone.
+func (t ScanTemplate) Scale(f float64) ScanTemplate {
+	scale := func(r image.Rectangle) image.Rectangle {
+		return image.Rect(int(float64(r.Min.X)*f), int(float64(r.Min.Y)*f), int(float64(r.Max.X)*f), int(float64(r.Max.Y)*f))
+	}
+	t.Width, t.Height = int(float64(t.Width)*f), int(float64(t.Height)*f)
+	t.RowPitch *= f
+	t.KeyRect, t.TensRect, t.OnesRect = scale(t.KeyRect), scale(t.TensRect), scale(t.OnesRect)
+	t.SheetIDRect, t.LocationRect, t.RowMarkerRect = scale(t.SheetIDRect), scale(t.LocationRect), scale(t.RowMarkerRect)
+	if len(t.Fields) > 0 {
+		t.Fields = slices.Clone(t.Fields)
+		for i := range t.Fields {
+			t.Fields[i].Rect = scale(t.Fields[i].Rect)
+		}
+	}
+	t.Sections.InnerMargin = int(float64(t.Sections.InnerMargin) * f)
+	t.Sections.LeftInset = int(float64(t.Sections.LeftInset) * f)
+	t.Sections.RightInset = int(float64(t.Sections.RightInset) * f)
+	t.Sections.Gap = int(float64(t.Sections.Gap) * f)
+	t.QR.SearchMargin = int(float64(t.QR.SearchMargin) * f)
+	t.Reanchor = int(float64(t.Reanchor) * f)
+	t.Sections.Padding = utils.Padding{X: int(float64(t.Sections.Padding.X) * f), Y: int(float64(t.Sections.Padding.Y) * f)}
+	t.QR.Padding = utils.Padding{X: int(float64(t.QR.Padding.X) * f), Y: int(float64(t.QR.Padding.Y) * f)}
+	return t
+}
+
+// hasReference reports whether the template measures the scan resolution.
+func (t ScanTemplate) hasReference() bool {
+	return !t.ReferenceRect.Empty() && t.ReferenceSize > 0 && t.DPI > 0
+}
+
+// reanchor returns how far below the middle of the key rectangle rect the
+// row's QR code was found, and false when the row's fields should stay where
+// the template puts them: reanchoring is off, the code was not located, or it
+// is further off than t.Reanchor allows.
+func (t ScanTemplate) reanchor(rect image.Rectangle, qr *utils.QRReading) (int, bool) {
+	if t.Reanchor <= 0 || qr == nil || !qr.Located {
+		return 0, false
+	}
+	dy := qr.Center.Y - (rect.Min.Y+rect.Max.Y)/2
+	if dy == 0 || dy < -t.Reanchor || dy > t.Reanchor {
+		return 0, false
+	}
+	return dy, true
+}
+
+// rowOffset is how far row i's regions sit from the first row's.
+func (t ScanTemplate) rowOffset(i int) image.Point {
+	return image.Pt(0, int(float64(i)*t.RowPitch))
+}
+
+// ScanResult is the decoded content of one row of a sheet.
+type ScanResult struct {
+	Row int    `json:"row"`
+	Key string `json:"key"`
+	// Code is the decoded code when it was an alias of Key; see Aliases.
+	Code string `json:"code,omitempty"`
+	Tens int    `json:"tens"`
+	Ones int    `json:"ones"`
+	// TensIndex and OnesIndex are the bubble sections that were marked,
+	// before the template's Digits mapping; -1 when none stood out or the
+	// count came from a count field.
+	TensIndex int    `json:"tensIndex"`
+	OnesIndex int    `json:"onesIndex"`
+	Count     int    `json:"count"` // as decoded from the sheet
+	Units     int    `json:"units"` // Count scaled by the product's pack size
+	Error     string `json:"error,omitempty"`
+	// Lot and Expiry come from a JSON product code (see
+	// utils.QRConfig.JSONPayload); empty for bare keys.
+	Lot    string `json:"lot,omitempty"`
+	Expiry string `json:"expiry,omitempty"`
+	// Reanchored is how many pixels down (negative: up) the row's fields
+	// were moved to follow its QR code; see ScanTemplate.Reanchor.
+	Reanchored int `json:"reanchored,omitempty"`
+
+	// Confidence is the lowest confidence of the bubbles fields giving the
+	// key and count (see utils.SectionReading.Confidence; a blank tens
+	// column rates 1, see tensConfidence), or 1 when both came from QR
+	// codes; rows that failed have 0.
+	Confidence float64 `json:"confidence"`
+	// Fields holds the text of the template's extra fields, and FieldErrors
+	// why an extra field could not be read. Neither fails the row.
+	Fields      map[string]string `json:"fields,omitempty"`
+	FieldErrors map[string]string `json:"fieldErrors,omitempty"`
+	// Warnings are doubts about a row that was still counted, such as a
+	// tens column read as 0 that was not blank; see unreadTens.
+	Warnings []string `json:"warnings,omitempty"`
+	// Scores holds the reading of every bubbles field with weights, keyed
+	// by field name; see FieldSpec.Weights.
+	Scores map[string]FieldScore `json:"scores,omitempty"`
+	// Agreement is set on rows fused from several frames of one capture;
+	// see fuseFrames.
+	Agreement *FrameAgreement `json:"agreement,omitempty"`
+	// Crops are the saved PNG crops of a failed row's regions, relative to
+	// the -crop-dir directory.
+	Crops []string `json:"crops,omitempty"`
+	// Regions are the pixel rects read for the row, keyed by field name, in
+	// the coordinates of the annotated image.
+	Regions map[string]image.Rectangle `json:"regions,omitempty"`
+
+	// TensFill and OnesFill are the fill fraction of each section of the
+	// digit columns, for reviewing close calls.
+	TensFill []float64 `json:"tensFill,omitempty"`
+	OnesFill []float64 `json:"onesFill,omitempty"`
+}
+
+// Sheet is one decoded scantron: its identifier, the location whose inventory
+// it counts, and the per-row results.
+type Sheet struct {
+	ID          string           `json:"id"`
+	IDGenerated bool             `json:"idGenerated,omitempty"` // no sheet-ID QR code read; ID was made up by newSheetID
+	Location    string           `json:"location"`
+	Mode        CountMode        `json:"mode"`        // whether the counts add to the stock or replace it
+	Orientation int              `json:"orientation"` // clockwise rotation in degrees applied before decoding
+	Results     []ScanResult     `json:"results"`
+	MissingRows []int            `json:"missingRows,omitempty"` // rows whose row marker was not seen
+	Scale       float64          `json:"scale,omitempty"`       // template scale from the reference marker; 0 when not measured
+	Duplicates  map[string][]int `json:"duplicates,omitempty"`  // keys read on more than one row, with their rows
+	Violations  []RuleViolation  `json:"violations,omitempty"`  // -rules the sheet broke; see checkRules
+	UploadID    string           `json:"uploadId,omitempty"`    // retained upload it was decoded from; empty for session totals
+}
+
+// validRows counts the rows that decoded without error.
+func (s Sheet) validRows() int {
+	n := 0
+	for _, r := range s.Results {
+		if r.Error == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// decodeConfig holds decoder behavior that is not part of a template.
+type decodeConfig struct {
+	// Limits bounds the pixel size of the images accepted.
+	Limits dimensionLimits
+	// QuarterTurns also retries sheets at 90° and 270° when nothing decodes
+	// upright; 180° is always tried. Sheets whose sheet-ID QR code reads
+	// after a quarter turn are rotated regardless.
+	QuarterTurns bool
+	// Duplicates decides how rows of one sheet with the same key count.
+	Duplicates DuplicatePolicy
+	// NoAnnotate skips drawing on uploaded sheets and writing example.png,
+	// for unattended scanning where nobody looks at them. Pages that show
+	// an annotated sheet still draw it.
+	NoAnnotate bool
+	// BlankTensFill is how much of a tens bubble may be dark, as a fill
+	// fraction, for a tens column without a marked bubble to still count
+	// as left blank; see unreadTens. 0 takes every such column as blank.
+	BlankTensFill float64
+	// RequireSheetID fails sheets whose sheet-ID QR code does not read
+	// with ErrNoSheetID instead of giving them a generated ID.
+	RequireSheetID bool
+	// Review and Crops set where failed and doubtful rows are kept for a
+	// closer look.
+	Review reviewConfig
+	Crops  cropConfig
+}
+
+// tensConfidence is the confidence of a tens reading. A column left blank on
+// purpose, as it is for every count below ten, is as sure a 0 as a marked
+// one, rather than rated by the noise in its empty bubbles.
+func tensConfidence(r utils.SectionReading, blankFill float64) float64 {
+	if !r.Marked && !unreadTens(r, blankFill) {
+		return 1
+	}
+	return r.Confidence()
+}
+
+// unreadTens reports whether a tens column where no bubble stood out still
+// holds ink: a section filled beyond blankFill, the -blank-tens-fill. Its
+// count is below ten either way, but such a column may have been marked in a
+// way the decoder could not read rather than left blank on purpose.
+func unreadTens(r utils.SectionReading, blankFill float64) bool {
+	if r.Marked || blankFill <= 0 {
+		return false
+	}
+	for i, f := range r.Fill {
+		if f > blankFill && !slices.Contains(r.Ignored, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// qrCacheSize bounds the QR readings kept for re-decoding the latest upload,
+// enough for several orientations and template offsets of a full sheet.
+const qrCacheSize = 1024
+
+// qrCache keeps the QR codes read from the latest upload, so recalibrating or
+// redecoding it only recomputes the bubbles. A new upload clears it.
+var qrCache = utils.NewQRCache(qrCacheSize)
+
+// ErrBlankSheet is returned by DecodeDocument when no row of the sheet could be
+// read, which usually means a blank or unrecognized sheet was uploaded.
+var ErrBlankSheet = errors.New("sheet appears blank or unrecognized")
+
+// ErrNoSheetID is returned by DecodeDocument with -require-sheet-id when the
+// sheet's sheet-ID QR code could not be read.
+var ErrNoSheetID = errors.New("sheet rejected: its sheet-ID QR code did not read")
+
+// writeTempImage stores uploaded image bytes in a temporary file for
+// DecodeDocument and returns its path. format, as returned by
+// utils.DetectImageFormat, picks the file extension; empty uses ".img".
+// The caller removes the file.
+func writeTempImage(data []byte, format string) (string, error) {
+	if format == "" {
+		format = "img"
+	}
+	f, err := os.CreateTemp("", "upload-*."+format)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// decodeErrorKey maps a Scanner error to the message shown to the operator.
+func decodeErrorKey(err error) string {
+	switch {
+	case errors.Is(err, ErrBlankSheet):
+		return "error.blankSheet"
+	case errors.Is(err, ErrNoSheetID):
+		return "error.noSheetID"
+	case errors.Is(err, ErrImageTooLarge):
+		return "error.imageTooLarge"
+	case errors.Is(err, utils.ErrUnsupportedColor):
+		return "error.colorSpace"
+	case errors.Is(err, ErrScanningDisabled):
+		return "error.noScanner"
+	case errors.Is(err, errEncodeImage):
+		return "error.encodeImage"
+	}
+	return "error.decodeImage"
+}
+
+// decodeErrorStatus maps a Scanner error to the HTTP status of the reply.
+func decodeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrScanningDisabled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errEncodeImage):
+		return http.StatusInternalServerError
+	case errors.Is(err, utils.ErrUnsupportedColor):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// newSheetID returns an identifier for a sheet that carries none.
+func newSheetID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+// finishSheet prepares a decoded sheet for the result handlers: it defaults
+// the location to loc when the sheet names none (a location QR wins over the
+// location picked on upload), records the count mode, resolves aliased codes
+// to their product keys, converts every count into units using the pack
+// sizes configured at that location and checks the sheet against the -rules.
+// uploadID ties the sheet to its retained upload.
+func finishSheet(sheet Sheet, uploadID, loc string, mode CountMode) Sheet {
+	sheet.UploadID = uploadID
+	if sheet.Location == "" {
+		sheet.Location = loc
+	}
+	sheet.Mode = mode
+	stock := db.snapshotLocation(normalizeLocation(sheet.Location))
+	for i, r := range sheet.Results {
+		if key := db.canonicalKey(r.Key); key != r.Key {
+			sheet.Results[i].Key, sheet.Results[i].Code = key, r.Key
+		}
+		sheet.Results[i].Units = stock[sheet.Results[i].Key].Units(r.Count)
+	}
+	sheet.Violations = checkRules(sheet)
+	return sheet
+}
+
+// applyResults adds every successfully decoded row of the sheets to the
+// inventory of their locations, or sets the products to them for full counts
+// (CountSet). The sheets are applied in order under one acquisition of db.mu,
+// so the sheets of a session land together.
+func applyResults(sheets ...Sheet) {
+	for _, sheet := range sheets {
+		if len(sheet.MissingRows) > 0 {
+			alertf("Sheet %s: row markers missing for rows %v; the sheet may have been fed crooked", sheet.ID, sheet.MissingRows)
+		}
+		if len(sheet.Duplicates) > 0 {
+			alertf("Sheet %s: keys read on more than one row %v, counted per -duplicate-keys", sheet.ID, sheet.Duplicates)
+		}
+		for _, v := range sheet.Violations {
+			alertf("Sheet %s: rows %v break rule %s", sheet.ID, v.Rows, v.Message)
+		}
+	}
+	quarantined := db.applySheets(sheets)
+	for i, sheet := range sheets {
+		if keys := quarantined[i]; len(keys) > 0 {
+			alertf("Sheet %s: product limit of %d reached; new keys %q at %s quarantined for review", sheet.ID, db.maxProducts, keys, normalizeLocation(sheet.Location))
+		}
+	}
+}
+
+// applySheets applies the rows of sheets for applyResults and audits them
+// while still holding db.mu. It returns the new keys the product limit
+// quarantined, by sheet index.
+func (db *DB_Type) applySheets(sheets []Sheet) map[int][]string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.notify()
+	var entries []AuditEntry
+	quarantined := map[int][]string{}
+	for i, sheet := range sheets {
+		loc := normalizeLocation(sheet.Location)
+		for _, r := range sheet.Results {
+			if sheet.Mode == CountSet && r.Error == "" && r.Key != "" {
+				// A full count of zero is a real reading, not an empty row.
+				// Rows of a lot count that lot only.
+				prev := db.items[loc][r.Key].Value
+				var prod Product
+				var err error
+				switch {
+				case !db.knownLocked(r.Key):
+					// Keys new to every location go through the checked
+					// path, so the product limit and new-product notices
+					// apply as for added counts. From nothing, setting and
+					// adding agree.
+					prod, err = db.incLotLocked(loc, r.Key, r.Lot, r.Expiry, r.Units)
+				case r.Lot != "":
+					prod = db.setLotLocked(loc, r.Key, r.Lot, r.Expiry, r.Units)
+				default:
+					prod = db.setLocked(loc, r.Key, "", r.Units)
+				}
+				if errors.Is(err, ErrProductLimit) {
+					quarantined[i] = append(quarantined[i], r.Key)
+					continue
+				}
+				entries = append(entries, AuditEntry{Action: "set", Location: loc, Key: r.Key, Delta: prod.Value - prev, Value: prod.Value, Ref: sheet.ID})
+				fmt.Printf("Set inventory at %s from count sheet %s: key: %s, name: %s, count: %d (was %d)\n", loc, sheet.ID, r.Key, prod.Name, prod.Value, prev)
+				continue
+			}
+			if r.Error != "" || r.Count == 0 {
+				continue
+			}
+			prod, err := db.incLotLocked(loc, r.Key, r.Lot, r.Expiry, r.Units)
+			if errors.Is(err, ErrProductLimit) {
+				quarantined[i] = append(quarantined[i], r.Key)
+				continue
+			}
+			entries = append(entries, AuditEntry{Action: "scan", Location: loc, Key: r.Key, Delta: r.Units, Value: prod.Value, Ref: sheet.ID})
+			fmt.Printf("Updated inventory at %s from sheet %s: key: %s, name: %s, new count: %d (added %d from %d)\n", loc, sheet.ID, r.Key, prod.Name, prod.Value, r.Units, r.Count)
+		}
+	}
+	audit.record(entries...)
+	return quarantined
+}
@@ -0,0 +1,706 @@
+//go:build !nocv
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"scantron_inventory/utils"
+
+	"gocv.io/x/gocv"
+)
+
+// cvScanner is the Scanner backed by OpenCV (gocv) and gozxing.
+type cvScanner struct{}
+
+// newScanner returns the OpenCV scanner, or a disabled one if OpenCV cannot
+// be initialized.
+func newScanner() Scanner {
+	if err := probeCV(); err != nil {
+		return disabledScanner{err}
+	}
+	return cvScanner{}
+}
+
+// probeCV exercises gocv once so a broken OpenCV installation is detected at
+// startup rather than by a panic in the middle of a scan.
+func probeCV() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("OpenCV failed to initialize: %v", r)
+		}
+	}()
+	m := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), 8, 8, gocv.MatTypeCV8UC3)
+	defer m.Close()
+	buf, err := gocv.IMEncode(gocv.PNGFileExt, m)
+	if err != nil {
+		return fmt.Errorf("OpenCV failed to initialize: %w", err)
+	}
+	buf.Close()
+	return nil
+}
+
+func (cvScanner) Decode(path string, tmpl ScanTemplate) (Sheet, error) {
+	sheet, err := DecodeDocument(path, tmpl)
+	if err == nil {
+		scans.add()
+	}
+	return sheet, err
+}
+
+func (cvScanner) DecodeData(data []byte, tmpl ScanTemplate) (Sheet, error) {
+	img, err := loadImageData(data, tmpl)
+	if err != nil {
+		return Sheet{}, err
+	}
+	defer img.Close()
+	tmpl.QR.NoAnnotate, tmpl.Sections.NoAnnotate = true, true
+	sheet := decodeImage(&img, tmpl)
+	return sheet, sheetError(sheet, tmpl)
+}
+
+func (cvScanner) Annotate(data []byte, tmpl ScanTemplate) (Sheet, []byte, error) {
+	img, err := loadImageData(data, tmpl)
+	if err != nil {
+		return Sheet{}, nil, err
+	}
+	defer img.Close()
+
+	sheet := decodeImage(&img, tmpl)
+
+	buf, err := gocv.IMEncode(gocv.PNGFileExt, img)
+	if err != nil {
+		return sheet, nil, fmt.Errorf("%w: %v", errEncodeImage, err)
+	}
+	defer buf.Close()
+	return sheet, append([]byte(nil), buf.GetBytes()...), nil
+}
+
+func (cvScanner) Thumbnail(data []byte, maxSide int, limits dimensionLimits) ([]byte, error) {
+	if err := checkImageData(data, limits); err != nil {
+		return nil, err
+	}
+	img, err := gocv.IMDecode(data, gocv.IMReadColor|gocv.IMReadIgnoreOrientation)
+	if err != nil || img.Empty() {
+		return nil, fmt.Errorf("error decoding image: %v", err)
+	}
+	defer img.Close()
+	if err := normalizeColor(&img); err != nil {
+		return nil, err
+	}
+	applyExifOrientation(&img, utils.ExifOrientation(bytes.NewReader(data)))
+
+	if longest := max(img.Cols(), img.Rows()); longest > maxSide {
+		f := float64(maxSide) / float64(longest)
+		small := gocv.NewMat()
+		defer small.Close()
+		gocv.Resize(img, &small, image.Pt(int(float64(img.Cols())*f), int(float64(img.Rows())*f)), 0, 0, gocv.InterpolationArea)
+		small.CopyTo(&img)
+	}
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, img)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errEncodeImage, err)
+	}
+	defer buf.Close()
+	return append([]byte(nil), buf.GetBytes()...), nil
+}
+
+func (cvScanner) ReadQR(data []byte, limits dimensionLimits) (string, error) {
+	if err := checkImageData(data, limits); err != nil {
+		return "", err
+	}
+	img, err := gocv.IMDecode(data, gocv.IMReadColor|gocv.IMReadIgnoreOrientation)
+	if err != nil || img.Empty() {
+		return "", fmt.Errorf("error decoding image: %v", err)
+	}
+	defer img.Close()
+	if err := normalizeColor(&img); err != nil {
+		return "", err
+	}
+	applyExifOrientation(&img, utils.ExifOrientation(bytes.NewReader(data)))
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	text, err := utils.DecodeQRCodeZXing(gray)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNoQR, err)
+	}
+	return text, nil
+}
+
+func (cvScanner) SelfTest(tmpl ScanTemplate) []diagCheck {
+	return runSelfTest(tmpl)
+}
+
+func (cvScanner) WriteSample(path string, tmpl ScanTemplate) error {
+	return writeSyntheticSheet(path, tmpl)
+}
+
+// orientations maps the rotations tried by decodeImage to their gocv codes.
+var orientations = []orientation{
+	{180, gocv.Rotate180Clockwise, false},
+	{90, gocv.Rotate90Clockwise, true},
+	{270, gocv.Rotate90CounterClockwise, true},
+}
+
+type orientation struct {
+	degrees int
+	code    gocv.RotateFlag
+	quarter bool
+}
+
+// fits reports whether img turned by o still holds every region of tmpl.
+// A quarter turn swaps the sides, so a sheet that only fits upright is not
+// read sideways with regions falling off the image.
+func (o orientation) fits(img gocv.Mat, tmpl ScanTemplate) bool {
+	w, h := img.Cols(), img.Rows()
+	if o.quarter {
+		w, h = h, w
+	}
+	if tmpl.hasReference() {
+		// The template is scaled to the scan later, so only the shapes compare.
+		return (w > h) == (tmpl.Width > tmpl.Height)
+	}
+	return tmpl.Bounds().In(image.Rect(0, 0, w, h))
+}
+
+// normalizeColor converts img to the 8-bit, 3-channel BGR every reader
+// expects. IMReadColor normally delivers that already, but some codecs
+// hand back 16-bit or float samples, or keep gray and alpha channels,
+// which CvtColor(ColorBGRToGray) would turn into garbage without an error.
+// Depths that can't be scaled sensibly are rejected with
+// utils.ErrUnsupportedColor.
+func normalizeColor(img *gocv.Mat) error {
+	channels := img.Channels()
+	switch depth := img.Type() & 7; depth {
+	case gocv.MatTypeCV8U:
+	case gocv.MatTypeCV16U:
+		img.ConvertToWithParams(img, gocv.MatTypeCV8U+gocv.MatType((channels-1)*8), 1.0/256, 0)
+	case gocv.MatTypeCV32F:
+		// Float samples run from 0 to 1.
+		img.ConvertToWithParams(img, gocv.MatTypeCV8U+gocv.MatType((channels-1)*8), 255, 0)
+	default:
+		return fmt.Errorf("%w: %d-channel image with OpenCV depth %d", utils.ErrUnsupportedColor, channels, depth)
+	}
+	switch channels {
+	case 3:
+	case 1:
+		gocv.CvtColor(*img, img, gocv.ColorGrayToBGR)
+	case 4:
+		gocv.CvtColor(*img, img, gocv.ColorBGRAToBGR)
+	default:
+		return fmt.Errorf("%w: %d-channel image", utils.ErrUnsupportedColor, channels)
+	}
+	return nil
+}
+
+// applyExifOrientation turns img upright for the EXIF orientation tag value.
+// Only the rotations phones produce (3, 6 and 8) are handled; mirrored
+// orientations are left as they are.
+func applyExifOrientation(img *gocv.Mat, orientation int) {
+	var code gocv.RotateFlag
+	switch orientation {
+	case 3:
+		code = gocv.Rotate180Clockwise
+	case 6:
+		code = gocv.Rotate90Clockwise
+	case 8:
+		code = gocv.Rotate90CounterClockwise
+	default:
+		return
+	}
+	rotated := gocv.NewMat()
+	gocv.Rotate(*img, &rotated, code)
+	img.Close()
+	*img = rotated
+}
+
+// loadImageData decodes image bytes in color, turned upright by their EXIF
+// orientation and prepared for tmpl (see prepareImage). The caller must
+// close the returned image.
+func loadImageData(data []byte, tmpl ScanTemplate) (gocv.Mat, error) {
+	if err := checkImageData(data, tmpl.Decode.Limits); err != nil {
+		return gocv.Mat{}, err
+	}
+	img, err := gocv.IMDecode(data, gocv.IMReadColor|gocv.IMReadIgnoreOrientation)
+	if err != nil || img.Empty() {
+		img.Close()
+		return gocv.Mat{}, fmt.Errorf("error decoding image: %v", err)
+	}
+	if err := normalizeColor(&img); err != nil {
+		img.Close()
+		return gocv.Mat{}, err
+	}
+	applyExifOrientation(&img, utils.ExifOrientation(bytes.NewReader(data)))
+	if err := prepareImage(&img, tmpl); err != nil {
+		img.Close()
+		return gocv.Mat{}, err
+	}
+	return img, nil
+}
+
+// DecodeDocument processes the image file and decodes the QR code and bubble regions
+// described by tmpl. In the loop, the QR code denotes the product key,
+// the first bubble section gives the tens digit and the second bubble section gives the ones digit.
+// It does not touch the inventory; see applyResults. A sheet with no readable
+// rows yields ErrBlankSheet, distinct from a readable sheet whose counts are zero,
+// and with tmpl.Decode.RequireSheetID one whose sheet ID does not read
+// yields ErrNoSheetID.
+func DecodeDocument(inputImage string, tmpl ScanTemplate) (Sheet, error) {
+	if err := checkImageFile(inputImage, tmpl.Decode.Limits); err != nil {
+		return Sheet{}, err
+	}
+
+	// Read the original image in color, applying the EXIF orientation
+	// ourselves so phone photos come out the way they were taken.
+	img := gocv.IMRead(inputImage, gocv.IMReadColor|gocv.IMReadIgnoreOrientation)
+	if img.Empty() {
+		return Sheet{}, fmt.Errorf("error reading image: %s", inputImage)
+	}
+	defer img.Close()
+	if err := normalizeColor(&img); err != nil {
+		return Sheet{}, err
+	}
+	if f, err := os.Open(inputImage); err == nil {
+		applyExifOrientation(&img, utils.ExifOrientation(f))
+		f.Close()
+	}
+	if err := prepareImage(&img, tmpl); err != nil {
+		return Sheet{}, err
+	}
+	if tmpl.Decode.NoAnnotate {
+		tmpl.QR.NoAnnotate, tmpl.Sections.NoAnnotate = true, true
+	}
+
+	var clean gocv.Mat
+	if tmpl.Decode.Crops.Dir != "" {
+		clean = img.Clone()
+		defer clean.Close()
+	}
+	sheet := decodeImage(&img, tmpl)
+	if sheet.Scale != 0 {
+		tmpl = tmpl.Scale(sheet.Scale)
+	}
+	if tmpl.Decode.Crops.Dir != "" {
+		saveFailedCrops(clean, &sheet, tmpl)
+	}
+	queueForReview(sheet, tmpl)
+
+	// Optionally write out the image for debugging; not served to the client.
+	if !tmpl.Decode.NoAnnotate {
+		gocv.IMWrite("example.png", img)
+	}
+	return sheet, sheetError(sheet, tmpl)
+}
+
+// sheetError reports why a decoded sheet is unusable: ErrBlankSheet when no
+// row read, ErrNoSheetID when tmpl.Decode.RequireSheetID and its ID did not.
+func sheetError(sheet Sheet, tmpl ScanTemplate) error {
+	if len(sheet.Results) == 0 {
+		return ErrBlankSheet
+	}
+	if tmpl.Decode.RequireSheetID && sheet.IDGenerated {
+		if tmpl.SheetIDRect.Empty() {
+			return fmt.Errorf("%w: template %q has no sheet-ID region", ErrNoSheetID, tmpl.Name)
+		}
+		return ErrNoSheetID
+	}
+	return nil
+}
+
+// decodeImage decodes an already loaded image, annotating img in place. When
+// the template has a sheet-ID QR code, the image is first turned to the
+// orientation that reads it; see sheetIDOrientation. If no row decodes, the
+// sheet may have been scanned upside down (or sideways, with
+// tmpl.Decode.QuarterTurns), so the rotated image is decoded too and the
+// orientation with the most valid rows wins; img is replaced by it. Rows
+// sharing a key are then resolved per tmpl.Decode.Duplicates.
+func decodeImage(img *gocv.Mat, tmpl ScanTemplate) Sheet {
+	original := img.Clone()
+	defer original.Close()
+
+	detected, _ := sheetIDOrientation(original, tmpl)
+	for _, o := range orientations {
+		if o.degrees == detected {
+			fmt.Printf("Sheet-ID QR code reads after a %d° rotation; rotating the sheet\n", o.degrees)
+			gocv.Rotate(original, img, o.code)
+		}
+	}
+	best := decodeRows(img, tmpl)
+	best.Orientation = detected
+	for _, o := range orientations {
+		if best.validRows() > 0 {
+			break
+		}
+		if o.degrees == detected || o.quarter && (!tmpl.Decode.QuarterTurns || !o.fits(original, tmpl)) {
+			continue
+		}
+		rotated := gocv.NewMat()
+		gocv.Rotate(original, &rotated, o.code)
+		sheet := decodeRows(&rotated, tmpl)
+		if sheet.validRows() > best.validRows() {
+			sheet.Orientation = o.degrees
+			best = sheet
+			rotated.CopyTo(img)
+		}
+		rotated.Close()
+	}
+	best.resolveDuplicates(tmpl.Decode.Duplicates)
+	return best
+}
+
+// sheetIDOrientation returns the clockwise rotation, 0 or one of
+// orientations, after which the sheet-ID QR code of tmpl reads where the
+// template expects it. It is a cheap check ahead of the row loop: one QR
+// region per orientation rather than every row. It reports false when the
+// template has no sheet-ID region or the code reads in no orientation.
+func sheetIDOrientation(img gocv.Mat, tmpl ScanTemplate) (int, bool) {
+	if tmpl.SheetIDRect.Empty() {
+		return 0, false
+	}
+	// Reading annotates the image, so each attempt works on a copy.
+	reads := func(m gocv.Mat) bool {
+		defer m.Close()
+		t := tmpl
+		if t.hasReference() {
+			t, _ = scaleToReference(&m, t)
+		}
+		id, _ := utils.ProcessQRRegionWithConfig(&m, t.SheetIDRect, t.QR)
+		return id != ""
+	}
+	if reads(img.Clone()) {
+		return 0, true
+	}
+	for _, o := range orientations {
+		if o.quarter && !o.fits(img, tmpl) {
+			continue
+		}
+		rotated := gocv.NewMat()
+		gocv.Rotate(img, &rotated, o.code)
+		if reads(rotated) {
+			return o.degrees, true
+		}
+	}
+	return 0, false
+}
+
+// saveFailedCrops writes the key and bubble regions of every failed row of
+// sheet, cut from the unannotated image, to the sheet's crop directory and
+// records the file names in the results. Old sheet directories are pruned.
+func saveFailedCrops(clean gocv.Mat, sheet *Sheet, tmpl ScanTemplate) {
+	if !slices.ContainsFunc(sheet.Results, func(r ScanResult) bool { return r.Error != "" }) {
+		return
+	}
+	img := clean
+	for _, o := range orientations {
+		if o.degrees == sheet.Orientation {
+			img = gocv.NewMat()
+			defer img.Close()
+			gocv.Rotate(clean, &img, o.code)
+		}
+	}
+	bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+
+	dir := tmpl.Decode.Crops.dir(sheet.ID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		alertf("Saving crops for sheet %s failed: %v", sheet.ID, err)
+		return
+	}
+	for i, r := range sheet.Results {
+		if r.Error == "" {
+			continue
+		}
+		offset := tmpl.rowOffset(r.Row)
+		for _, field := range tmpl.fields() {
+			rect := field.Rect.Add(offset).Intersect(bounds)
+			if rect.Empty() {
+				continue
+			}
+			name := fmt.Sprintf("row%02d-%s.png", r.Row, field.Name)
+			region := img.Region(rect)
+			ok := gocv.IMWrite(filepath.Join(dir, name), region)
+			region.Close()
+			if ok {
+				sheet.Results[i].Crops = append(sheet.Results[i].Crops, filepath.Join(filepath.Base(dir), name))
+			}
+		}
+	}
+	if err := pruneSubdirs(tmpl.Decode.Crops.Dir, tmpl.Decode.Crops.Keep); err != nil {
+		log.Printf("Pruning crops: %v", err)
+	}
+}
+
+// fieldValue is what a field decoder read from one field of a row.
+type fieldValue struct {
+	Text    string                // qr and number-ocr fields
+	QR      *utils.QRReading      // qr fields
+	Reading *utils.SectionReading // bubbles fields
+}
+
+// fieldDecoder reads one field of a row from rect.
+type fieldDecoder func(img *gocv.Mat, rect image.Rectangle, tmpl ScanTemplate) (fieldValue, error)
+
+// fieldDecoders maps each FieldType to its decoder.
+var fieldDecoders = map[FieldType]fieldDecoder{
+	FieldQR: func(img *gocv.Mat, rect image.Rectangle, tmpl ScanTemplate) (fieldValue, error) {
+		reading, err := utils.ReadQRRegion(img, rect, tmpl.QR)
+		return fieldValue{Text: reading.Text, QR: &reading}, err
+	},
+	FieldBubbles: func(img *gocv.Mat, rect image.Rectangle, tmpl ScanTemplate) (fieldValue, error) {
+		reading, err := utils.ReadHorizontalSections(img, rect, tmpl.Sections)
+		if err != nil {
+			return fieldValue{}, err
+		}
+		if reading.Smudged {
+			return fieldValue{Reading: &reading}, fmt.Errorf("%w next to %d", utils.ErrSmudged, tmpl.digit(reading))
+		}
+		return fieldValue{Text: strconv.Itoa(tmpl.digit(reading)), Reading: &reading}, nil
+	},
+	FieldNumberOCR: func(img *gocv.Mat, rect image.Rectangle, tmpl ScanTemplate) (fieldValue, error) {
+		return fieldValue{}, errUnsupportedField
+	},
+}
+
+// decodeField dispatches field, shifted by offset, to the decoder for its type.
+func decodeField(img *gocv.Mat, tmpl ScanTemplate, field FieldSpec, offset image.Point) (fieldValue, error) {
+	decode, ok := fieldDecoders[field.Type]
+	if !ok {
+		return fieldValue{}, fmt.Errorf("field %q: unknown type %q", field.Name, field.Type)
+	}
+	return decode(img, field.Rect.Add(offset), tmpl)
+}
+
+// readBubbleKey reads the number marked across the key bubbles fields, most
+// significant first, and returns the entry of tmpl.Keys it picks along with
+// the lowest confidence among the fields. The key is empty when no field is
+// marked, which makes the row empty.
+func readBubbleKey(img *gocv.Mat, tmpl ScanTemplate, fields []FieldSpec, offset image.Point) (string, float64, error) {
+	n, marked, confidence := 0, false, 1.0
+	for _, f := range fields {
+		v, err := decodeField(img, tmpl, f, offset)
+		if err != nil {
+			return "", 0, err
+		}
+		n = n*10 + tmpl.digit(*v.Reading)
+		marked = marked || v.Reading.Marked
+		confidence = min(confidence, v.Reading.Confidence())
+	}
+	switch {
+	case !marked:
+		return "", 0, nil
+	case n >= len(tmpl.Keys):
+		return "", 0, fmt.Errorf("key bubbles mark product %d, but the template lists %d", n, len(tmpl.Keys))
+	}
+	return tmpl.Keys[n], confidence, nil
+}
+
+// rowMarkerFill is the share of a row marker's pixels that must be dark.
+const rowMarkerFill = 0.5
+
+// decodeRows runs the row loop of DecodeDocument on an upright image,
+// annotating img in place. Sheets without a readable sheet-ID QR get a
+// generated ID.
+func decodeRows(img *gocv.Mat, tmpl ScanTemplate) Sheet {
+	var results []ScanResult
+
+	var scale float64
+	if tmpl.hasReference() {
+		tmpl, scale = scaleToReference(img, tmpl)
+	}
+
+	tmpl.QR.Cache = qrCache.ForImage(img)
+	var sheetID string
+	if !tmpl.SheetIDRect.Empty() {
+		sheetID, _ = utils.ProcessQRRegionWithConfig(img, tmpl.SheetIDRect, tmpl.QR)
+	}
+	idGenerated := sheetID == ""
+	if idGenerated {
+		sheetID = newSheetID()
+	}
+	var location string
+	if !tmpl.LocationRect.Empty() {
+		location, _ = utils.ProcessQRRegionWithConfig(img, tmpl.LocationRect, tmpl.QR)
+	}
+
+	layout := tmpl.layout()
+
+	// Loop to process multiple products in the image.
+	bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+	var missing []int
+	lastMarker := -1
+	start, end := tmpl.rowSpan()
+	for i := start; i < end; i++ {
+		offset := tmpl.rowOffset(i)
+
+		// A row without its printed marker was not captured at all, as
+		// opposed to a blank row, which still shows the marker.
+		if !tmpl.RowMarkerRect.Empty() {
+			if utils.MarkerPresent(img, tmpl.RowMarkerRect.Add(offset), tmpl.Sections.DarkThreshold, rowMarkerFill, !tmpl.Sections.NoAnnotate) {
+				lastMarker = i
+			} else {
+				missing = append(missing, i)
+			}
+		}
+
+		// The key is read first: rows without one are empty and the other
+		// fields are not looked at.
+		result := ScanResult{Row: i, Regions: tmpl.rowRegions(i, 0, bounds)}
+		fieldOffset := offset
+		confidence := 1.0
+		if layout.keyFromBubbles() {
+			key, keyConfidence, err := readBubbleKey(img, tmpl, layout.key, offset)
+			if err != nil {
+				fmt.Printf("Error reading key bubbles at offset %d: %v\n", offset.Y, err)
+				result.Error = err.Error()
+				results = append(results, result)
+				continue
+			}
+			if key == "" {
+				continue
+			}
+			result.Key, confidence = key, keyConfidence
+		} else {
+			keyField := layout.key[0]
+			key, err := decodeField(img, tmpl, keyField, offset)
+			if errors.Is(err, utils.ErrQRTooSmall) {
+				// Report it on the row; otherwise it would look like an empty row.
+				result.Error = err.Error()
+				results = append(results, result)
+				continue
+			}
+			if err != nil {
+				fmt.Printf("QR code not detected for key at offset %d: %v\n", offset.Y, err)
+				continue
+			}
+			if key.Text == "" {
+				continue
+			}
+			result.Key = key.Text
+			if tmpl.QR.JSONPayload {
+				p := utils.ParseQRPayload(key.Text)
+				result.Key, result.Lot, result.Expiry = p.Key, p.Lot, p.Expiry
+			}
+			if dy, ok := tmpl.reanchor(keyField.Rect.Add(offset), key.QR); ok {
+				fieldOffset.Y += dy
+				result.Reanchored = dy
+				result.Regions = tmpl.rowRegions(i, dy, bounds)
+			}
+		}
+
+		var tens, ones utils.SectionReading
+		for _, f := range tmpl.fields() {
+			role := f.role()
+			if role == RoleKey {
+				continue
+			}
+			v, err := decodeField(img, tmpl, f, fieldOffset)
+			if err == nil && v.Reading != nil && len(f.Weights) > 0 {
+				if result.Scores == nil {
+					result.Scores = make(map[string]FieldScore)
+				}
+				result.Scores[f.Name] = f.score(*v.Reading)
+			}
+			switch {
+			case err != nil && role != "":
+				fmt.Printf("Error reading %s field %s at offset %d: %v\n", f.Type, f.Name, offset.Y, err)
+				result.Error = err.Error()
+			case err != nil:
+				if result.FieldErrors == nil {
+					result.FieldErrors = make(map[string]string)
+				}
+				result.FieldErrors[f.Name] = err.Error()
+			case role == RoleTens:
+				tens = *v.Reading
+			case role == RoleOnes:
+				ones = *v.Reading
+			case role == RoleCount:
+				n, err := strconv.Atoi(strings.TrimSpace(v.Text))
+				switch {
+				case v.Text == "":
+					result.Error = "count code not found"
+				case err != nil || n < 0:
+					result.Error = fmt.Sprintf("count code %q is not a whole number", v.Text)
+				default:
+					result.Count = n
+				}
+			default:
+				if result.Fields == nil {
+					result.Fields = make(map[string]string)
+				}
+				result.Fields[f.Name] = v.Text
+			}
+			if result.Error != "" {
+				break
+			}
+		}
+		if result.Error != "" {
+			results = append(results, result)
+			continue
+		}
+
+		// Calculate the decoded count, unless a count field gave it whole.
+		if layout.count == nil {
+			result.Tens, result.Ones = tmpl.digit(tens), tmpl.digit(ones)
+			result.TensIndex, result.OnesIndex = markedIndex(tens), markedIndex(ones)
+			result.TensFill, result.OnesFill = tens.Fill, ones.Fill
+			if unreadTens(tens, tmpl.Decode.BlankTensFill) {
+				result.Warnings = append(result.Warnings, "tens column has ink but no bubble stood out; counted as 0")
+			}
+			confidence = min(confidence, tensConfidence(tens, tmpl.Decode.BlankTensFill), ones.Confidence())
+			result.Count = result.Tens*10 + result.Ones
+		} else {
+			result.TensIndex, result.OnesIndex = -1, -1
+		}
+		result.Confidence = confidence
+		results = append(results, result)
+	}
+	// Sheets list fewer products than the template has rows and only print
+	// markers for those, so trailing rows without a marker are not gaps.
+	missing = slices.DeleteFunc(missing, func(row int) bool { return row > lastMarker })
+	return Sheet{ID: sheetID, IDGenerated: idGenerated, Location: location, Results: results, MissingRows: missing, Scale: scale}
+}
+
+// scaleToReference measures the template's reference marker on img and
+// returns the template scaled to the scan's resolution with the scale used.
+// If the marker is missing or implausible the template is returned as is
+// with a scale of 0.
+func scaleToReference(img *gocv.Mat, tmpl ScanTemplate) (ScanTemplate, float64) {
+	marker, ok := utils.LocateMarker(img, tmpl.ReferenceRect, tmpl.Sections.DarkThreshold, !tmpl.Sections.NoAnnotate)
+	if !ok {
+		fmt.Println("Reference marker not found; decoding at the template's resolution")
+		return tmpl, 0
+	}
+	dpi := float64(max(marker.Dx(), marker.Dy())) / tmpl.ReferenceSize
+	scale := dpi / tmpl.DPI
+	if scale < 0.25 || scale > 4 {
+		fmt.Printf("Reference marker gives %.0f DPI, ignoring it\n", dpi)
+		return tmpl, 0
+	}
+	return tmpl.Scale(scale), scale
+}
+
+// prepareImage rejects images beyond tmpl.Decode.Limits and downscales images larger
+// than the template so the template coordinates line up. Short sides are
+// compared so a sideways scan is scaled the same as an upright one.
+// It must run before any Region call on img.
+func prepareImage(img *gocv.Mat, tmpl ScanTemplate) error {
+	w, h := img.Cols(), img.Rows()
+	if err := tmpl.Decode.Limits.check(w, h); err != nil {
+		return err
+	}
+	short, tmplShort := min(w, h), min(tmpl.Width, tmpl.Height)
+	if tmplShort > 0 && short > tmplShort {
+		scale := float64(tmplShort) / float64(short)
+		gocv.Resize(*img, img, image.Pt(int(float64(w)*scale), int(float64(h)*scale)), 0, 0, gocv.InterpolationArea)
+	}
+	return nil
+}
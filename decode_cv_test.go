@@ -0,0 +1,35 @@
+//go:build !nocv
+
+package main
+
+import "testing"
+
+// BenchmarkDecodeImage compares decoding a full synthetic sheet with and
+// without drawing the annotations, as -no-annotate does.
+func BenchmarkDecodeImage(b *testing.B) {
+	sheet, err := generateSheet(defaultTemplate, sampleRows(defaultTemplate, defaultTemplate.Rows))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sheet.Close()
+
+	for _, bc := range []struct {
+		name       string
+		noAnnotate bool
+	}{
+		{"annotated", false},
+		{"decode-only", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			tmpl := defaultTemplate
+			tmpl.QR.NoAnnotate, tmpl.Sections.NoAnnotate = bc.noAnnotate, bc.noAnnotate
+			for range b.N {
+				b.StopTimer()
+				img := sheet.Clone()
+				b.StartTimer()
+				decodeImage(&img, tmpl)
+				img.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register decoders for image.DecodeConfig
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+
+	"scantron_inventory/utils"
+)
+
+// ErrImageTooLarge is returned for images whose pixel dimensions exceed the
+// -max-width and -max-height limits.
+var ErrImageTooLarge = errors.New("image dimensions exceed the configured limit")
+
+// dimensionLimits bounds the pixel size of images the decoder accepts.
+type dimensionLimits struct {
+	MaxWidth  int
+	MaxHeight int
+}
+
+// check returns ErrImageTooLarge when w x h exceeds the limits.
+func (l dimensionLimits) check(w, h int) error {
+	if (l.MaxWidth > 0 && w > l.MaxWidth) || (l.MaxHeight > 0 && h > l.MaxHeight) {
+		return fmt.Errorf("%w: %dx%d, maximum is %dx%d", ErrImageTooLarge, w, h, l.MaxWidth, l.MaxHeight)
+	}
+	return nil
+}
+
+// checkImageFile rejects oversized images from their header alone, before
+// OpenCV decodes and allocates the full bitmap. Formats Go cannot parse are
+// left to the check in prepareImage.
+func checkImageFile(path string, limits dimensionLimits) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkImage(f, limits)
+}
+
+// checkImageData is checkImageFile for an image already in memory, run
+// before every gocv.IMDecode of uploaded bytes.
+func checkImageData(data []byte, limits dimensionLimits) error {
+	return checkImage(bytes.NewReader(data), limits)
+}
+
+func checkImage(r io.ReaderAt, limits dimensionLimits) error {
+	if err := utils.CheckColorSpace(r); err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return nil
+	}
+	return limits.check(cfg.Width, cfg.Height)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// DuplicatePolicy decides how rows of one sheet that decode to the same key
+// are counted.
+type DuplicatePolicy string
+
+const (
+	DuplicatesSum   DuplicatePolicy = "sum"   // count every row (the default)
+	DuplicatesMax   DuplicatePolicy = "max"   // count only the row with the highest count
+	DuplicatesError DuplicatePolicy = "error" // count none of them
+)
+
+// parseDuplicatePolicy validates a -duplicate-keys value.
+func parseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(s); p {
+	case DuplicatesSum, DuplicatesMax, DuplicatesError:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown duplicate key policy %q (want sum, max or error)", s)
+}
+
+func (p *DuplicatePolicy) String() string { return string(*p) }
+
+func (p *DuplicatePolicy) Set(s string) error {
+	v, err := parseDuplicatePolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// resolveDuplicates records the keys read on more than one valid row of the
+// sheet in s.Duplicates, whatever the policy, and fails the rows the policy
+// leaves out so they are not counted.
+func (s *Sheet) resolveDuplicates(policy DuplicatePolicy) {
+	byKey := make(map[string][]int) // key -> indexes into s.Results
+	for i, r := range s.Results {
+		if r.Error == "" && r.Key != "" {
+			byKey[r.Key] = append(byKey[r.Key], i)
+		}
+	}
+	for key, idx := range byKey {
+		if len(idx) < 2 {
+			continue
+		}
+		rows := make([]int, len(idx))
+		for j, i := range idx {
+			rows[j] = s.Results[i].Row
+		}
+		if s.Duplicates == nil {
+			s.Duplicates = make(map[string][]int)
+		}
+		s.Duplicates[key] = rows
+
+		switch policy {
+		case DuplicatesMax:
+			keep := slices.MaxFunc(idx, func(a, b int) int {
+				return cmp.Compare(s.Results[a].Count, s.Results[b].Count)
+			})
+			for _, i := range idx {
+				if i != keep {
+					s.Results[i].Error = fmt.Sprintf("duplicate of row %d, which has the higher count", s.Results[keep].Row)
+				}
+			}
+		case DuplicatesError:
+			for _, i := range idx {
+				s.Results[i].Error = fmt.Sprintf("key %s appears on rows %v", key, rows)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Exporter mirrors an inventory snapshot to an outside destination, such as
+// a spreadsheet the purchasing team works from.
+type Exporter interface {
+	Name() string
+	Export(inv Inventory) error
+}
+
+// exporter is configured from the -export* settings; nil disables exports.
+var exporter Exporter
+
+// newExporter returns the exporter for an -export value; empty returns nil.
+func newExporter(kind, sheetID, sheetRange, webhook string) (Exporter, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "sheets":
+		if sheetID == "" {
+			return nil, errors.New("-export sheets needs -export-sheet-id")
+		}
+		return googleSheetExporter{SpreadsheetID: sheetID, Range: sheetRange}, nil
+	case "webhook":
+		if webhook == "" {
+			return nil, errors.New("-export webhook needs -export-webhook")
+		}
+		return webhookExporter{URL: webhook}, nil
+	}
+	return nil, fmt.Errorf("unknown exporter %q (want sheets or webhook)", kind)
+}
+
+// exportHeader names the columns of exportRows.
+var exportHeader = []string{"Location", "Key", "Name", "Category", "Count", "Reorder At", "Pack Size", "Updated"}
+
+// exportRows flattens inv into a header row and one row per product, sorted
+// by location then key.
+func exportRows(inv Inventory) [][]string {
+	rows := [][]string{exportHeader}
+	for _, loc := range slices.Sorted(maps.Keys(inv)) {
+		stock := inv[loc]
+		for _, key := range slices.Sorted(maps.Keys(stock)) {
+			p := stock[key]
+			rows = append(rows, []string{
+				loc, key, p.Name, p.Category,
+				strconv.Itoa(p.Value), strconv.Itoa(p.Threshold), strconv.Itoa(max(p.PackSize, 1)),
+				formatTime(p.LastUpdated),
+			})
+		}
+	}
+	return rows
+}
+
+// runExports exports the inventory every interval until done is closed.
+func runExports(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := exporter.Export(db.snapshot()); err != nil {
+				alertf("Export to %s failed: %v", exporter.Name(), err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// HandleExportSheet exports the current inventory on demand.
+func HandleExportSheet(w http.ResponseWriter, req *http.Request) {
+	e := exporter
+	if e == nil {
+		httpError(w, req, "error.noExporter", http.StatusNotFound)
+		return
+	}
+	if err := e.Export(db.snapshot()); err != nil {
+		alertf("Export to %s failed: %v", e.Name(), err)
+		httpError(w, req, "error.export", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(locationFor(req)), http.StatusSeeOther)
+}
+
+// googleSheetsAPI is the base URL of the Google Sheets API.
+const googleSheetsAPI = "https://sheets.googleapis.com/v4/spreadsheets/"
+
+// googleSheetExporter replaces the cells of Range in a Google Sheet with the
+// inventory rows. The OAuth access token is read from GOOGLE_SHEETS_TOKEN on
+// every export, so it can be refreshed without a restart.
+type googleSheetExporter struct {
+	SpreadsheetID string
+	Range         string // A1 notation, e.g. "Inventory!A1:H"
+}
+
+func (g googleSheetExporter) Name() string { return "Google Sheets" }
+
+func (g googleSheetExporter) Export(inv Inventory) error {
+	token := os.Getenv("GOOGLE_SHEETS_TOKEN")
+	if token == "" {
+		return errors.New("GOOGLE_SHEETS_TOKEN is not set")
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	base := googleSheetsAPI + url.PathEscape(g.SpreadsheetID) + "/values/" + url.PathEscape(g.Range)
+	// Clear first so products removed since the last export disappear.
+	if err := sendJSON(http.MethodPost, base+":clear", header, struct{}{}); err != nil {
+		return err
+	}
+	body := struct {
+		Range          string     `json:"range"`
+		MajorDimension string     `json:"majorDimension"`
+		Values         [][]string `json:"values"`
+	}{g.Range, "ROWS", exportRows(inv)}
+	return sendJSON(http.MethodPut, base+"?valueInputOption=RAW", header, body)
+}
+
+// webhookExporter POSTs the inventory rows as JSON to URL, for destinations
+// without a built-in exporter.
+type webhookExporter struct {
+	URL string
+}
+
+func (e webhookExporter) Name() string { return "webhook" }
+
+func (e webhookExporter) Export(inv Inventory) error {
+	return sendJSON(http.MethodPost, e.URL, nil, struct {
+		Time time.Time  `json:"time"`
+		Rows [][]string `json:"rows"`
+	}{time.Now(), exportRows(inv)})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"scantron_inventory/utils"
+)
+
+// maxFrames bounds how many frames one /api/scan/frames request may carry.
+const maxFrames = 8
+
+// maxFramesBytes bounds the decoded size of all frames of one request
+// together; a burst of phone frames is much smaller than a flatbed scan.
+const maxFramesBytes = 2 * maxScanImageBytes
+
+// framesRequest is the JSON body accepted by HandleAPIScanFrames.
+type framesRequest struct {
+	Images   []string `json:"images"`   // data:image/...;base64,... URLs, one per frame
+	Template string   `json:"template"` // template name; empty for the default
+	Apply    bool     `json:"apply"`    // apply the fused results to the inventory
+	Location string   `json:"location"` // inventory to apply to, unless the sheet names one
+	Mode     string   `json:"mode"`     // "add" or "set"; empty for the template's
+}
+
+// framesResponse is the JSON body returned by HandleAPIScanFrames. UploadID
+// is the frame kept as the upload: the one with the most valid rows.
+type framesResponse struct {
+	scanResponse
+	Frames      int            `json:"frames"`
+	FrameErrors map[int]string `json:"frameErrors,omitempty"` // frame index to why it did not decode
+}
+
+// FrameAgreement reports how the frames of a multi-frame capture agreed on
+// one fused row.
+type FrameAgreement struct {
+	Frames int `json:"frames"` // frames that decoded
+	Read   int `json:"read"`   // of those, frames that read the row without error
+	Agree  int `json:"agree"`  // of those, frames that read the fused key and count
+}
+
+// HandleAPIScanFrames decodes a burst of frames of the same sheet, such as a
+// phone app sends from a handheld capture, and fuses them row by row (see
+// fuseFrames) into one sheet, which is reported and applied like a single
+// scan's. Each row reports in Agreement how many frames agreed with it.
+func HandleAPIScanFrames(w http.ResponseWriter, req *http.Request) {
+	// Base64 inflates the payload by 4/3; leave room for the other fields.
+	req.Body = http.MaxBytesReader(w, req.Body, maxFramesBytes*4/3+4096)
+	var body framesRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, req, "error.imageTooLarge", http.StatusRequestEntityTooLarge)
+			return
+		}
+		httpError(w, req, "error.invalidJSON", http.StatusBadRequest)
+		return
+	}
+	if len(body.Images) == 0 || len(body.Images) > maxFrames {
+		httpError(w, req, "error.frameCount", http.StatusBadRequest)
+		return
+	}
+	cfg := configFor(req)
+	tmpl, ok := cfg.template(body.Template)
+	if !ok {
+		httpError(w, req, "error.unknownTemplate", http.StatusBadRequest)
+		return
+	}
+	mode, err := countModeFor(body.Mode, tmpl)
+	if err != nil {
+		httpError(w, req, "error.invalidMode", http.StatusBadRequest)
+		return
+	}
+	frames := make([][]byte, len(body.Images))
+	for i, image := range body.Images {
+		if frames[i], err = decodeDataURL(image); err != nil {
+			httpError(w, req, "error.invalidImage", http.StatusBadRequest)
+			return
+		}
+		if _, err := utils.DetectImageFormat(bytes.NewReader(frames[i])); err != nil {
+			httpError(w, req, "error.notImage", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	resp := framesResponse{Frames: len(frames)}
+	var decoded []Sheet
+	var firstErr error
+	best, bestSheet := -1, Sheet{}
+	for i, data := range frames {
+		sheet, err := decodeFrame(data, tmpl)
+		if err != nil {
+			if errors.Is(err, ErrScanningDisabled) {
+				httpError(w, req, "error.noScanner", http.StatusServiceUnavailable)
+				return
+			}
+			if resp.FrameErrors == nil {
+				resp.FrameErrors = make(map[int]string)
+			}
+			resp.FrameErrors[i] = err.Error()
+			firstErr = cmp.Or(firstErr, err)
+			continue
+		}
+		if best < 0 || sheet.validRows() > bestSheet.validRows() {
+			best, bestSheet = i, sheet
+		}
+		decoded = append(decoded, sheet)
+	}
+	if abandoned(req) {
+		return
+	}
+
+	// Only the best frame is kept, so reprocessing counts the burst once.
+	if best < 0 {
+		uploadID := uploads.add(cfg, frames[0], normalizeLocation(body.Location))
+		uploads.recordDecode(cfg, uploadID, tmpl, Sheet{}, firstErr)
+		watchdog.observe(cfg.Watchdog, Sheet{}, firstErr)
+		httpError(w, req, decodeErrorKey(firstErr), decodeErrorStatus(firstErr))
+		return
+	}
+	uploadID := uploads.add(cfg, frames[best], normalizeLocation(body.Location))
+	uploads.recordDecode(cfg, uploadID, tmpl, bestSheet, nil)
+
+	// The frames were decoded without side effects; the fused sheet is
+	// counted and queued for review once, as a single scan is.
+	sheet := fuseFrames(decoded, bestSheet, tmpl.layout().count != nil, tmpl.Decode.Duplicates)
+	scans.add()
+	if sheet.Scale != 0 {
+		queueForReview(sheet, tmpl.Scale(sheet.Scale))
+	} else {
+		queueForReview(sheet, tmpl)
+	}
+	watchdog.observe(cfg.Watchdog, sheet, nil)
+	sheet = finishSheet(sheet, uploadID, normalizeLocation(body.Location), mode)
+	sheetDecoded(uploadID, sheet)
+	var status int
+	resp.scanResponse, status = scanReply(cfg.Commit, uploadID, sheet, body.Apply)
+	writeJSON(w, status, resp)
+}
+
+// decodeFrame decodes one frame of a burst. It leaves no trace of the frame:
+// see Scanner.DecodeData.
+func decodeFrame(data []byte, tmpl ScanTemplate) (Sheet, error) {
+	if len(data) > maxScanImageBytes {
+		return Sheet{}, fmt.Errorf("%w: %d bytes, maximum is %d", ErrImageTooLarge, len(data), maxScanImageBytes)
+	}
+	return scanner.DecodeData(data, tmpl)
+}
+
+// fuseFrames reconciles the sheets decoded from frames of one capture row by
+// row. A row's key is the first one read without error, in frame order. Its
+// count is voted on among the frames that read that key: digit by digit, or
+// as a whole when wholeCount says the template reads the count from a QR
+// code. Ties go to the frame with the higher confidence. Frames agreeing on
+// the key and count add up to a higher confidence than any of them alone,
+// taking their misreads as independent; it is scaled down by the share of
+// frames that read the row differently. Rows no
+// frame could read keep the first frame's error. The sheet-level fields come
+// from best, the frame with the most valid rows. Fused rows sharing a key
+// are resolved per policy.
+func fuseFrames(frames []Sheet, best Sheet, wholeCount bool, policy DuplicatePolicy) Sheet {
+	byRow := make(map[int][]ScanResult)
+	for _, f := range frames {
+		for _, r := range f.Results {
+			byRow[r.Row] = append(byRow[r.Row], r)
+		}
+	}
+	fused := best
+	fused.Results = nil
+	fused.Duplicates = nil
+	for _, row := range slices.Sorted(maps.Keys(byRow)) {
+		fused.Results = append(fused.Results, fuseRow(byRow[row], len(frames), wholeCount))
+	}
+	fused.resolveDuplicates(policy)
+	return fused
+}
+
+// fuseRow reconciles the readings of one row from several frames; see fuseFrames.
+func fuseRow(readings []ScanResult, frames int, wholeCount bool) ScanResult {
+	agreement := FrameAgreement{Frames: frames}
+	var ok []ScanResult
+	for _, r := range readings {
+		if r.Error == "" {
+			ok = append(ok, r)
+		}
+	}
+	agreement.Read = len(ok)
+	if len(ok) == 0 {
+		r := readings[0]
+		r.Agreement = &agreement
+		return r
+	}
+	key := ok[0].Key
+	ok = slices.DeleteFunc(ok, func(r ScanResult) bool { return r.Key != key })
+
+	var fused ScanResult
+	if wholeCount {
+		fused = vote(ok, func(r ScanResult) int { return r.Count })
+	} else {
+		fused = vote(ok, func(r ScanResult) int { return r.Tens })
+		ones := vote(ok, func(r ScanResult) int { return r.Ones })
+		fused.Ones, fused.OnesIndex, fused.OnesFill = ones.Ones, ones.OnesIndex, ones.OnesFill
+		fused.Count = fused.Tens*10 + fused.Ones
+	}
+
+	doubt := 1.0 // chance that every agreeing frame misread the row
+	for _, r := range ok {
+		if r.Count == fused.Count {
+			agreement.Agree++
+			doubt *= 1 - r.Confidence
+		}
+	}
+	fused.Confidence = (1 - doubt) * float64(agreement.Agree) / float64(agreement.Read)
+	fused.Agreement = &agreement
+	return fused
+}
+
+// vote returns the reading whose value by field is the most common among
+// readings, preferring the more confident reading on a tie.
+func vote(readings []ScanResult, field func(ScanResult) int) ScanResult {
+	counts := make(map[int]int)
+	for _, r := range readings {
+		counts[field(r)]++
+	}
+	return slices.MaxFunc(readings, func(a, b ScanResult) int {
+		return cmp.Or(cmp.Compare(counts[field(a)], counts[field(b)]), cmp.Compare(a.Confidence, b.Confidence))
+	})
+}
@@ -1,4 +1,4 @@
-module main
+module scantron_inventory
 
 go 1.23.0
 
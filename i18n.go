@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLocale is used when neither the cookie nor Accept-Language match a catalog.
+const defaultLocale = "en"
+
+// langCookie stores the operator's explicit language choice.
+const langCookie = "lang"
+
+// messages is the translation catalog, keyed by locale and then by message key.
+var messages = map[string]map[string]string{
+	"en": {
+		"dashboard.title":       "Inventory Dashboard",
+		"dashboard.key":         "Product Key",
+		"dashboard.name":        "Product Name",
+		"dashboard.count":       "Count",
+		"dashboard.actions":     "Actions",
+		"dashboard.update":      "Update",
+		"dashboard.increase":    "Increase",
+		"dashboard.decrease":    "Decrease",
+		"dashboard.upload":      "Upload New File",
+		"dashboard.export":      "Export to %s",
+		"dashboard.lot":         "lot %s, exp. %s: %d",
+		"dashboard.threshold":   "Reorder At",
+		"dashboard.packSize":    "Units per Mark",
+		"dashboard.notes":       "Notes",
+		"dashboard.updated":     "Updated",
+		"dashboard.location":    "Location",
+		"dashboard.lowStock":    "Show only items to reorder",
+		"dashboard.showAll":     "Show all items",
+		"dashboard.scans":       "Sheets processed: %d since start, %d in total",
+		"help.upload":           "Scan the whole sheet at 300 DPI or photograph it flat and square, with all four corners visible.",
+		"help.location":         "Counts are added to this location. Leave it empty for the default location.",
+		"help.template":         "Pick the layout printed on the sheet; the wrong template reads the wrong boxes.",
+		"help.lots":             "Lots read from product codes. Red lots have expired or expire soon; use them first.",
+		"help.mode":             "Add to stock for deliveries and withdrawals. Full count sets each listed product to the count on the sheet; pick it only for physical stock counts.",
+		"help.session":          "Group the sheets of one delivery: they are applied together once you commit the session on the dashboard.",
+		"help.showResult":       "Show what was read on each row, over the scanned image, before returning to the dashboard.",
+		"help.rescan":           "If a row could not be read, fix the marks and upload the sheet again; rows read earlier are counted again.",
+		"help.increase":         "Add one to the count, e.g. for an item received without a sheet.",
+		"help.decrease":         "Remove one from the count, e.g. for an item used without a sheet.",
+		"help.threshold":        "The product is flagged for reordering when its count drops to this value. Leave empty to never flag it.",
+		"help.packSize":         "How many units one mark on a sheet stands for. Leave empty for one.",
+		"help.notes":            "Free-form notes for other operators, such as where the product is shelved.",
+		"help.lowStock":         "List only products at or below their reorder point.",
+		"help.set":              "Set a product's count to an exact value after a manual count. New keys create the product.",
+		"help.transfer":         "Move units to another location; both counts change together.",
+		"help.reorder":          "Based on how fast each product was used recently.",
+		"name.conflict":         "The name %q is already used by product %s.",
+		"name.confirm":          "Use it anyway",
+		"name.cancel":           "Cancel",
+		"set.title":             "Add / Adjust Product",
+		"set.key":               "Product key",
+		"set.name":              "Product name (optional)",
+		"set.value":             "Count",
+		"set.category":          "Category (optional)",
+		"set.save":              "Save",
+		"reorder.title":         "Reorder Suggestions",
+		"reorder.perDay":        "Used per Day",
+		"reorder.by":            "Reorder By",
+		"reorder.quantity":      "Suggested Order",
+		"alias.also":            "also %s",
+		"alias.add":             "Add code",
+		"alias.remove":          "Remove this code",
+		"help.aliases":          "Another code that counts as this product, such as a replacement label. Press Enter to add it.",
+		"error.aliasTaken":      "That code already names another product",
+		"error.unknownAlias":    "That code is not an alias of this product",
+		"paste.title":           "Paste Counts",
+		"paste.submit":          "Apply",
+		"paste.applied":         "Applied %d pasted lines.",
+		"paste.failed":          "Nothing was applied; fix these lines and submit again:",
+		"paste.empty":           "no key,value lines were pasted",
+		"help.paste":            "Paste key,value lines, for example copied from a spreadsheet. A bare number sets the count; +3 or -2 adjusts it.",
+		"transfer.title":        "Transfer to Another Location",
+		"transfer.key":          "Product key",
+		"transfer.amount":       "Amount",
+		"transfer.to":           "Destination",
+		"transfer.submit":       "Transfer",
+		"staged.pending":        "Sheet %s for %s is waiting for confirmation:",
+		"staged.confirm":        "Apply",
+		"staged.discard":        "Discard",
+		"session.start":         "Start Session",
+		"session.pending":       "Session %s for %s holds %d sheets:",
+		"session.upload":        "Add Sheets",
+		"session.commit":        "Commit All",
+		"session.sheets":        "(%d sheets)",
+		"session.uploading":     "Sheets you upload go into session %s (%d so far) and are applied when it is committed on the dashboard.",
+		"error.noSession":       "Unknown or closed session",
+		"error.noExporter":      "No exporter is configured",
+		"error.invalidMode":     "Unknown count mode (want add or set)",
+		"error.timeout":         "The request took too long and was stopped; nothing was applied",
+		"error.export":          "The export failed; see the alerts on the dashboard",
+		"error.unknownSheet":    "No applied rows of that sheet are on record",
+		"error.countSheet":      "That sheet was a full count; post a new count instead of correcting it",
+		"error.unauthorized":    "This page needs the admin password",
+		"error.noAdminPassword": "Admin pages are disabled; start the server with -admin-password to use them",
+		"settings.title":        "Settings",
+		"settings.submit":       "Save",
+		"settings.saved":        "Settings saved. They apply from the next upload.",
+		"settings.persisted":    "Changes apply right away and are saved to %s.",
+		"settings.notPersisted": "Changes apply right away but are lost on restart; start the server with -config to keep them.",
+		"settings.notSaved":     "The settings were applied but could not be saved: %v",
+		"settings.pinned":       "Set on the command line or in the environment, which override the config file: a change lasts until restart.",
+		"quarantine.pending":    "New key %s was quarantined because the product limit was reached (%d units from %d scans).",
+		"quarantine.admit":      "Add Product",
+		"time.never":            "never",
+		"time.justNow":          "just now",
+		"time.ago":              "%s ago",
+		"upload.title":          "Upload PNG File",
+		"upload.select":         "Select PNG file:",
+		"upload.template":       "Scan template:",
+		"upload.location":       "Location:",
+		"upload.submit":         "Upload",
+		"upload.dashboard":      "Go to Dashboard",
+		"upload.showResult":     "Show the decoded sheet before going to the dashboard",
+		"upload.mode":           "Counts on this sheet",
+		"upload.modeDefault":    "As the template says",
+		"mode.add":              "Add to stock",
+		"mode.set":              "Full count (replaces stock)",
+		"result.title":          "Scan Result",
+		"result.uploaded":       "The image you uploaded",
+		"result.row":            "Row",
+		"result.confidence":     "Confidence",
+		"result.staged":         "Some or all rows are waiting for confirmation on the dashboard.",
+		"result.rotated":        "rotated %d° to decode",
+		"result.rejected":       "Nothing was applied: every row must decode before a sheet counts. Fix the marked rows and scan the sheet again.",
+		"result.missingRows":    "Row markers missing for rows %v; the sheet may have been fed crooked.",
+		"result.duplicate":      "Key %s was read on rows %v.",
+		"result.ruleRejected":   "Nothing was applied: the sheet breaks a validation rule. Check the rows below and scan the sheet again.",
+		"result.violation":      "Rule %s (rows %v).",
+		"result.another":        "Upload Another Sheet",
+		"upload.disabled":       "Scanning is unavailable on this server. The dashboard and manual entry still work.",
+		"error.method":          "Method not allowed",
+		"error.notFound":        "Page not found",
+		"error.parseForm":       "Error parsing form",
+		"error.retrieveFile":    "Error retrieving the file",
+		"error.tempFile":        "Cannot create temporary file",
+		"error.saveFile":        "Error saving file",
+		"error.readFile":        "Error reading file",
+		"error.renderTemplate":  "Error rendering template",
+		"error.renderDashboard": "Error rendering dashboard",
+		"error.keyRequired":     "Product key is required",
+		"error.invalidValue":    "Invalid value",
+		"error.unknownProduct":  "Unknown product",
+		"error.unknownTemplate": "Unknown scan template",
+		"error.noTemplateDir":   "Templates can't be saved without a -templates directory",
+		"error.invalidImage":    "The image must be a base64 image data URL",
+		"error.noQR":            "No QR code could be read in the image",
+		"error.notImage":        "The uploaded file is not a PNG, JPEG, GIF, BMP, WebP or TIFF image",
+		"error.noUpload":        "No sheet has been uploaded yet",
+		"error.unknownJob":      "Unknown or expired job",
+		"error.unknownStaged":   "Unknown or already handled sheet",
+		"error.unknownBackup":   "Unknown backup",
+		"error.backup":          "Backups are unavailable",
+		"error.readAudit":       "Error reading the audit log",
+		"error.noAuditLog":      "There is no audit log file to rebuild the inventory from",
+		"error.productLimit":    "The product limit has been reached",
+		"error.noQuarantine":    "Quarantined key not found",
+		"error.confirmApply":    "Applying rewrites inventory counts; post confirm=reprocess to proceed",
+		"error.sessionRejected": "A sheet in this session is now rejected by -all-or-nothing or the validation rules; nothing was applied",
+		"error.alreadyApplied":  "This upload was already applied to the inventory or is waiting for confirmation; use /reprocess to correct applied uploads",
+		"error.decodeImage":     "The uploaded image could not be read",
+		"error.encodeImage":     "Error encoding the annotated image",
+		"error.corsOrigin":      "Origin not allowed",
+		"error.invalidJSON":     "Invalid JSON body",
+		"error.frameCount":      "Send between 1 and 8 frames",
+		"error.blankSheet":      "This sheet appears blank or unrecognized. Nothing was updated.",
+		"error.noSheetID":       "The sheet ID code could not be read, and every sheet must carry one. Nothing was updated; check the code is printed and not covered, then scan the sheet again.",
+		"error.colorSpace":      "The image uses a color space that can't be read (such as a CMYK TIFF); scan in RGB or grayscale",
+		"error.imageTooLarge":   "The image is too large. Scan the sheet at a lower resolution and try again.",
+		"error.noScanner":       "Scanning is unavailable on this server",
+		"error.badTransfer":     "A transfer needs a positive amount and two different locations",
+		"error.notEnough":       "Not enough stock at this location for that transfer",
+	},
+	"es": {
+		"dashboard.title":       "Panel de Inventario",
+		"dashboard.key":         "Clave del Producto",
+		"dashboard.name":        "Nombre del Producto",
+		"dashboard.count":       "Cantidad",
+		"dashboard.actions":     "Acciones",
+		"dashboard.update":      "Actualizar",
+		"dashboard.increase":    "Aumentar",
+		"dashboard.decrease":    "Disminuir",
+		"dashboard.upload":      "Subir Nuevo Archivo",
+		"dashboard.export":      "Exportar a %s",
+		"dashboard.lot":         "lote %s, cad. %s: %d",
+		"dashboard.threshold":   "Reordenar En",
+		"dashboard.packSize":    "Unidades por Marca",
+		"dashboard.notes":       "Notas",
+		"dashboard.updated":     "Actualizado",
+		"dashboard.location":    "Ubicación",
+		"dashboard.lowStock":    "Mostrar solo productos por reordenar",
+		"dashboard.showAll":     "Mostrar todos los productos",
+		"dashboard.scans":       "Hojas procesadas: %d desde el inicio, %d en total",
+		"help.upload":           "Escanee la hoja completa a 300 DPI o fotografíela plana y derecha, con las cuatro esquinas visibles.",
+		"help.location":         "Las cantidades se suman a esta ubicación. Déjela vacía para la ubicación predeterminada.",
+		"help.template":         "Elija el diseño impreso en la hoja; una plantilla equivocada lee las casillas equivocadas.",
+		"help.lots":             "Lotes leídos de los códigos de producto. Los rojos ya caducaron o caducan pronto; úselos primero.",
+		"help.mode":             "Sumar al inventario para entregas y retiros. Conteo completo fija cada producto listado al conteo de la hoja; elíjalo solo para conteos físicos.",
+		"help.session":          "Agrupe las hojas de una entrega: se aplican juntas cuando confirma la sesión en el panel.",
+		"help.showResult":       "Muestra lo leído en cada fila, sobre la imagen escaneada, antes de volver al panel.",
+		"help.rescan":           "Si una fila no se pudo leer, corrija las marcas y suba la hoja de nuevo; las filas ya leídas se cuentan otra vez.",
+		"help.increase":         "Suma uno a la cantidad, por ejemplo para un artículo recibido sin hoja.",
+		"help.decrease":         "Resta uno a la cantidad, por ejemplo para un artículo usado sin hoja.",
+		"help.threshold":        "El producto se marca para reordenar cuando su cantidad baja a este valor. Déjelo vacío para no marcarlo nunca.",
+		"help.packSize":         "Cuántas unidades representa una marca en la hoja. Déjelo vacío para una.",
+		"help.notes":            "Notas libres para otros operadores, como dónde está guardado el producto.",
+		"help.lowStock":         "Muestra solo los productos en o por debajo de su punto de reorden.",
+		"help.set":              "Fija la cantidad exacta de un producto tras un conteo manual. Las claves nuevas crean el producto.",
+		"help.transfer":         "Mueve unidades a otra ubicación; ambas cantidades cambian juntas.",
+		"help.reorder":          "Según lo rápido que se usó cada producto recientemente.",
+		"name.conflict":         "El nombre %q ya lo usa el producto %s.",
+		"name.confirm":          "Usarlo de todos modos",
+		"name.cancel":           "Cancelar",
+		"set.title":             "Agregar / Ajustar Producto",
+		"set.key":               "Clave del producto",
+		"set.name":              "Nombre del producto (opcional)",
+		"set.value":             "Cantidad",
+		"set.category":          "Categoría (opcional)",
+		"set.save":              "Guardar",
+		"reorder.title":         "Sugerencias de Reorden",
+		"reorder.perDay":        "Uso por Día",
+		"reorder.by":            "Reordenar Antes de",
+		"reorder.quantity":      "Pedido Sugerido",
+		"alias.also":            "también %s",
+		"alias.add":             "Añadir código",
+		"alias.remove":          "Quitar este código",
+		"help.aliases":          "Otro código que cuenta como este producto, como una etiqueta de reemplazo. Pulse Intro para añadirlo.",
+		"error.aliasTaken":      "Ese código ya nombra otro producto",
+		"error.unknownAlias":    "Ese código no es un alias de este producto",
+		"paste.title":           "Pegar Cantidades",
+		"paste.submit":          "Aplicar",
+		"paste.applied":         "Se aplicaron %d líneas pegadas.",
+		"paste.failed":          "No se aplicó nada; corrija estas líneas y envíe de nuevo:",
+		"paste.empty":           "no se pegaron líneas clave,valor",
+		"help.paste":            "Pegue líneas clave,valor, por ejemplo copiadas de una hoja de cálculo. Un número solo fija la cantidad; +3 o -2 la ajusta.",
+		"transfer.title":        "Transferir a Otra Ubicación",
+		"transfer.key":          "Clave del producto",
+		"transfer.amount":       "Cantidad",
+		"transfer.to":           "Destino",
+		"transfer.submit":       "Transferir",
+		"staged.pending":        "La hoja %s de %s espera confirmación:",
+		"staged.confirm":        "Aplicar",
+		"staged.discard":        "Descartar",
+		"session.start":         "Nueva Sesión de Escaneo",
+		"session.pending":       "La sesión %s de %s tiene %d hojas:",
+		"session.upload":        "Añadir Hojas",
+		"session.commit":        "Aplicar Todo",
+		"session.sheets":        "(%d hojas)",
+		"session.uploading":     "Las hojas que suba van a la sesión %s (%d hasta ahora) y se aplican al confirmarla en el panel.",
+		"error.noSession":       "Sesión desconocida o cerrada",
+		"error.noExporter":      "No hay ningún exportador configurado",
+		"error.invalidMode":     "Modo de conteo desconocido (use add o set)",
+		"error.timeout":         "La solicitud tardó demasiado y se detuvo; no se aplicó nada",
+		"error.unauthorized":    "Esta página requiere la contraseña de administrador",
+		"error.noAdminPassword": "Las páginas de administración están desactivadas; inicie el servidor con -admin-password para usarlas",
+		"settings.title":        "Configuración",
+		"settings.submit":       "Guardar",
+		"settings.saved":        "Configuración guardada. Se aplica desde la próxima carga.",
+		"settings.persisted":    "Los cambios se aplican de inmediato y se guardan en %s.",
+		"settings.notPersisted": "Los cambios se aplican de inmediato pero se pierden al reiniciar; inicie el servidor con -config para conservarlos.",
+		"settings.notSaved":     "La configuración se aplicó pero no se pudo guardar: %v",
+		"settings.pinned":       "Definido en la línea de comandos o en el entorno, que tienen prioridad sobre el archivo de configuración: el cambio dura hasta reiniciar.",
+		"error.export":          "La exportación falló; vea las alertas en el panel",
+		"error.unknownSheet":    "No hay filas aplicadas de esa hoja en el registro",
+		"error.countSheet":      "Esa hoja fue un conteo completo; envíe un conteo nuevo en lugar de corregirla",
+		"quarantine.pending":    "La clave nueva %s quedó en cuarentena porque se alcanzó el límite de productos (%d unidades de %d escaneos).",
+		"quarantine.admit":      "Agregar Producto",
+		"time.never":            "nunca",
+		"time.justNow":          "justo ahora",
+		"time.ago":              "hace %s",
+		"upload.title":          "Subir Archivo PNG",
+		"upload.select":         "Selecciona un archivo PNG:",
+		"upload.template":       "Plantilla de escaneo:",
+		"upload.location":       "Ubicación:",
+		"upload.submit":         "Subir",
+		"upload.dashboard":      "Ir al Panel",
+		"upload.showResult":     "Mostrar la hoja leída antes de ir al panel",
+		"upload.mode":           "Conteos de esta hoja",
+		"upload.modeDefault":    "Según la plantilla",
+		"mode.add":              "Sumar al inventario",
+		"mode.set":              "Conteo completo (reemplaza el inventario)",
+		"result.title":          "Resultado del Escaneo",
+		"result.uploaded":       "La imagen que subió",
+		"result.row":            "Fila",
+		"result.confidence":     "Confianza",
+		"result.staged":         "Algunas o todas las filas esperan confirmación en el panel.",
+		"result.rotated":        "girada %d° para leerla",
+		"result.rejected":       "No se aplicó nada: todas las filas deben leerse para que la hoja cuente. Corrija las filas marcadas y vuelva a escanear la hoja.",
+		"result.missingRows":    "Faltan las marcas de las filas %v; la hoja pudo entrar torcida.",
+		"result.duplicate":      "La clave %s se leyó en las filas %v.",
+		"result.ruleRejected":   "No se aplicó nada: la hoja incumple una regla de validación. Revise las filas indicadas y vuelva a escanear la hoja.",
+		"result.violation":      "Regla %s (filas %v).",
+		"result.another":        "Subir Otra Hoja",
+		"upload.disabled":       "El escaneo no está disponible en este servidor. El panel y la captura manual siguen funcionando.",
+		"error.method":          "Método no permitido",
+		"error.notFound":        "Página no encontrada",
+		"error.parseForm":       "Error al procesar el formulario",
+		"error.retrieveFile":    "Error al obtener el archivo",
+		"error.tempFile":        "No se pudo crear el archivo temporal",
+		"error.saveFile":        "Error al guardar el archivo",
+		"error.readFile":        "Error al leer el archivo",
+		"error.renderTemplate":  "Error al mostrar la plantilla",
+		"error.renderDashboard": "Error al mostrar el panel",
+		"error.keyRequired":     "La clave del producto es obligatoria",
+		"error.invalidValue":    "Valor inválido",
+		"error.unknownProduct":  "Producto desconocido",
+		"error.unknownTemplate": "Plantilla de escaneo desconocida",
+		"error.noTemplateDir":   "No se pueden guardar plantillas sin un directorio -templates",
+		"error.invalidImage":    "La imagen debe ser una URL de datos en base64",
+		"error.noQR":            "No se pudo leer ningún código QR en la imagen",
+		"error.notImage":        "El archivo subido no es una imagen PNG, JPEG, GIF, BMP, WebP o TIFF",
+		"error.noUpload":        "Aún no se ha subido ninguna hoja",
+		"error.unknownJob":      "Trabajo desconocido o expirado",
+		"error.unknownStaged":   "Hoja desconocida o ya procesada",
+		"error.unknownBackup":   "Respaldo desconocido",
+		"error.backup":          "Los respaldos no están disponibles",
+		"error.readAudit":       "Error al leer el registro de auditoría",
+		"error.noAuditLog":      "No hay un archivo de registro de auditoría del que reconstruir el inventario",
+		"error.productLimit":    "Se alcanzó el límite de productos",
+		"error.noQuarantine":    "Clave en cuarentena no encontrada",
+		"error.confirmApply":    "Aplicar reescribe las existencias; envía confirm=reprocess para continuar",
+		"error.sessionRejected": "Una hoja de esta sesión ahora es rechazada por -all-or-nothing o las reglas de validación; no se aplicó nada",
+		"error.alreadyApplied":  "Esta subida ya se aplicó a las existencias o espera confirmación; usa /reprocess para corregir las subidas aplicadas",
+		"error.decodeImage":     "No se pudo leer la imagen subida",
+		"error.encodeImage":     "Error al codificar la imagen anotada",
+		"error.corsOrigin":      "Origen no permitido",
+		"error.invalidJSON":     "Cuerpo JSON inválido",
+		"error.frameCount":      "Envía entre 1 y 8 fotogramas",
+		"error.blankSheet":      "Esta hoja parece estar en blanco o no se reconoce. No se actualizó nada.",
+		"error.noSheetID":       "No se pudo leer el código de identificación de la hoja, y toda hoja debe llevar uno. No se actualizó nada; compruebe que el código esté impreso y no esté tapado, y vuelva a escanear la hoja.",
+		"error.colorSpace":      "La imagen usa un espacio de color que no se puede leer (como un TIFF CMYK); escanea en RGB o escala de grises",
+		"error.imageTooLarge":   "La imagen es demasiado grande. Escanea la hoja a menor resolución e intenta de nuevo.",
+		"error.noScanner":       "El escaneo no está disponible en este servidor",
+		"error.badTransfer":     "Una transferencia necesita una cantidad positiva y dos ubicaciones distintas",
+		"error.notEnough":       "No hay suficiente existencia en esta ubicación para esa transferencia",
+	},
+}
+
+// translate looks up a message for the locale, falling back to the default
+// locale and finally to the key itself. Extra args are applied with Sprintf.
+func translate(locale, key string, args ...any) string {
+	msg, ok := messages[locale][key]
+	if !ok {
+		msg, ok = messages[defaultLocale][key]
+	}
+	if !ok {
+		msg = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// helpPrefix marks the catalog messages that are inline help for the UI.
+const helpPrefix = "help."
+
+// helpTexts returns the help messages for the locale keyed by topic (the
+// message key without helpPrefix), so templates can write .Help.upload.
+// Topics missing from the locale fall back to the default locale.
+func helpTexts(locale string) map[string]string {
+	help := map[string]string{}
+	for _, l := range []string{defaultLocale, locale} {
+		for key, msg := range messages[l] {
+			if topic, ok := strings.CutPrefix(key, helpPrefix); ok {
+				help[topic] = msg
+			}
+		}
+	}
+	return help
+}
+
+// localeFor picks the request's locale from the lang cookie, then from the
+// Accept-Language header, and otherwise returns the default locale.
+func localeFor(req *http.Request) string {
+	if c, err := req.Cookie(langCookie); err == nil {
+		if _, ok := messages[c.Value]; ok {
+			return c.Value
+		}
+	}
+	for _, tag := range parseAcceptLanguage(req.Header.Get("Accept-Language")) {
+		// Match on the primary subtag so "es-MX" selects "es".
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := messages[base]; ok {
+			return base
+		}
+	}
+	return defaultLocale
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header
+// ordered by descending quality.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue // q=0 means "not acceptable"
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
+
+// httpError replies with the localized message for key, followed by the
+// request ID so operators can match the reply to the server log.
+func httpError(w http.ResponseWriter, req *http.Request, key string, code int) {
+	msg := translate(localeFor(req), key)
+	if id := requestID(req); id != "" {
+		msg += " (request " + id + ")"
+	}
+	http.Error(w, msg, code)
+}
+
+// HandleLang stores the chosen locale in a cookie and sends the operator back.
+func HandleLang(w http.ResponseWriter, req *http.Request) {
+	locale := req.FormValue("l")
+	if _, ok := messages[locale]; ok {
+		http.SetCookie(w, &http.Cookie{Name: langCookie, Value: locale, Path: "/", MaxAge: 365 * 24 * 60 * 60})
+	}
+	// Only keep the path of the referer so this can't redirect off-site. A
+	// path starting with // or /\ would be taken as another host.
+	back := "/dashboard"
+	if ref, err := url.Parse(req.Referer()); err == nil && ref.Path != "" {
+		if uri := ref.RequestURI(); strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//") && !strings.HasPrefix(uri, "/\\") {
+			back = uri
+		}
+	}
+	http.Redirect(w, req, back, http.StatusSeeOther)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"scantron_inventory/utils"
+)
+
+// jobState is the lifecycle stage of an asynchronous decode job.
+type jobState string
+
+const (
+	jobPending jobState = "pending" // waiting for a free decode slot
+	jobRunning jobState = "running"
+	jobDone    jobState = "done"
+	jobFailed  jobState = "failed"
+)
+
+// jobRetention is how long finished jobs stay available for polling.
+const jobRetention = time.Hour
+
+// jobSlots bounds how many jobs decode at the same time.
+var jobSlots = make(chan struct{}, 2)
+
+// Job is an upload decoded in the background, polled via GET /jobs/{token}.
+type Job struct {
+	Token    string       `json:"token"`
+	State    jobState     `json:"state"`
+	Created  time.Time    `json:"created"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	UploadID string       `json:"uploadId"`
+	SheetID  string       `json:"sheetId,omitempty"`
+	Location string       `json:"location,omitempty"`
+	Results  []ScanResult `json:"results,omitempty"`
+	Staged   bool         `json:"staged,omitempty"` // rows wait for confirmation; see -commit-policy
+	Error    string       `json:"error,omitempty"`
+}
+
+// jobRegistry holds the jobs in memory, keyed by token.
+type jobRegistry struct {
+	mu    sync.Mutex
+	items map[string]*Job
+}
+
+var jobs = jobRegistry{items: map[string]*Job{}}
+
+// create registers a pending job, dropping finished jobs past jobRetention.
+func (r *jobRegistry) create(uploadID string) Job {
+	b := make([]byte, 16)
+	rand.Read(b)
+	job := &Job{Token: hex.EncodeToString(b), State: jobPending, Created: time.Now(), UploadID: uploadID}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for token, j := range r.items {
+		if j.Finished != nil && time.Since(*j.Finished) > jobRetention {
+			delete(r.items, token)
+		}
+	}
+	r.items[job.Token] = job
+	return *job
+}
+
+// get returns a copy of the job with the given token.
+func (r *jobRegistry) get(token string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.items[token]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// update applies fn to the job with the given token under the lock.
+func (r *jobRegistry) update(token string, fn func(*Job)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job, ok := r.items[token]; ok {
+		fn(job)
+	}
+}
+
+// HandleCreateJob accepts an upload like /upload (uploadFile, template,
+// location) but replies 202 with a job token right away and decodes in the
+// background. Like /upload, the results are committed per the commit policy.
+func HandleCreateJob(w http.ResponseWriter, req *http.Request) {
+	if scanningDisabled() != nil {
+		httpError(w, req, "error.noScanner", http.StatusServiceUnavailable)
+		return
+	}
+	data, ok := readUploadFile(w, req)
+	if !ok {
+		return
+	}
+	format, err := utils.DetectImageFormat(bytes.NewReader(data))
+	if err != nil {
+		httpError(w, req, "error.notImage", http.StatusUnsupportedMediaType)
+		return
+	}
+	cfg := configFor(req)
+	tmpl, ok := cfg.template(req.FormValue("template"))
+	if !ok {
+		httpError(w, req, "error.unknownTemplate", http.StatusBadRequest)
+		return
+	}
+	mode, err := countModeFor(req.FormValue("mode"), tmpl)
+	if err != nil {
+		httpError(w, req, "error.invalidMode", http.StatusBadRequest)
+		return
+	}
+	location := locationFor(req)
+	job := jobs.create(uploads.add(cfg, data, location))
+	go runJob(cfg, job.Token, job.UploadID, data, format, tmpl, location, mode)
+
+	w.Header().Set("Location", "/jobs/"+job.Token)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// runJob decodes one job's upload, an image of the given format, once a slot
+// is free and records the outcome. It keeps to cfg, the settings the job was
+// created with.
+func runJob(cfg *Config, token, uploadID string, data []byte, format string, tmpl ScanTemplate, location string, mode CountMode) {
+	jobSlots <- struct{}{}
+	defer func() { <-jobSlots }()
+	jobs.update(token, func(j *Job) { j.State = jobRunning })
+
+	fail := func(err error) {
+		log.Printf("Job %s failed: %v", token, err)
+		jobs.update(token, func(j *Job) {
+			now := time.Now()
+			j.State, j.Error, j.Finished = jobFailed, err.Error(), &now
+		})
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fail(fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	path, err := writeTempImage(data, format)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer os.Remove(path)
+
+	sheet, err := scanner.Decode(path, tmpl)
+	uploads.recordDecode(cfg, uploadID, tmpl, sheet, err)
+	watchdog.observe(cfg.Watchdog, sheet, err)
+	if err != nil {
+		fail(err)
+		return
+	}
+	sheet = finishSheet(sheet, uploadID, location, mode)
+	sheetDecoded(uploadID, sheet)
+	staged, err := commitSheet(sheet, cfg.Commit)
+	jobs.update(token, func(j *Job) {
+		now := time.Now()
+		j.State, j.Finished = jobDone, &now
+		j.SheetID, j.Location, j.Results, j.Staged = sheet.ID, sheet.Location, sheet.Results, staged
+		if err != nil {
+			// Keep the results so the client can see which rows failed.
+			j.State, j.Error = jobFailed, err.Error()
+		}
+	})
+}
+
+// HandleJobStatus returns the state of a job and, once done, its results.
+func HandleJobStatus(w http.ResponseWriter, req *http.Request) {
+	job, ok := jobs.get(req.PathValue("token"))
+	if !ok {
+		httpError(w, req, "error.unknownJob", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
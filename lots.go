@@ -0,0 +1,190 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Lot is the stock of one lot of a product, as read from JSON product codes
+// (see utils.ParseQRPayload). A product's lots never hold more than its
+// Value; the rest of the stock is untracked.
+type Lot struct {
+	Lot    string `json:"lot"`
+	Expiry string `json:"expiry,omitempty"` // as encoded: "2006-01" or "2006-01-02"
+	Count  int    `json:"count"`
+}
+
+// Expires returns the end of the lot's expiry: the end of the day for a
+// date, the end of the month for a month. It reports false when the lot has
+// no expiry or it cannot be parsed.
+func (l Lot) Expires() (time.Time, bool) {
+	if t, err := time.ParseInLocation("2006-01-02", l.Expiry, timeDisplay.Location); err == nil {
+		return t.AddDate(0, 0, 1), true
+	}
+	if t, err := time.ParseInLocation("2006-01", l.Expiry, timeDisplay.Location); err == nil {
+		return t.AddDate(0, 1, 0), true
+	}
+	return time.Time{}, false
+}
+
+// Soon reports whether the lot has expired or expires within warn, the
+// -expiry-warning.
+func (l Lot) Soon(warn time.Duration) bool {
+	t, ok := l.Expires()
+	return ok && time.Until(t) < warn
+}
+
+// ExpiringSoon reports whether any lot of the product is Soon.
+func (p Product) ExpiringSoon(warn time.Duration) bool {
+	return slices.ContainsFunc(p.Lots, func(l Lot) bool { return l.Soon(warn) })
+}
+
+// compareFEFO orders lots first-expired-first-out: earliest expiry first,
+// lots without a known expiry last.
+func compareFEFO(a, b Lot) int {
+	ta, okA := a.Expires()
+	tb, okB := b.Expires()
+	switch {
+	case okA && okB:
+		return cmp.Or(ta.Compare(tb), cmp.Compare(a.Lot, b.Lot))
+	case okA:
+		return -1
+	case okB:
+		return 1
+	}
+	return cmp.Compare(a.Lot, b.Lot)
+}
+
+// addLot adds n units to the named lot, creating it with expiry if needed.
+// A non-empty expiry replaces the one recorded.
+func (p *Product) addLot(lot, expiry string, n int) {
+	// Copy first: products are shallow-copied into snapshots.
+	p.Lots = slices.Clone(p.Lots)
+	i := slices.IndexFunc(p.Lots, func(l Lot) bool { return l.Lot == lot })
+	if i < 0 {
+		p.Lots = append(p.Lots, Lot{Lot: lot})
+		i = len(p.Lots) - 1
+	}
+	if expiry != "" {
+		p.Lots[i].Expiry = expiry
+	}
+	p.Lots[i].Count += n
+	p.dropEmptyLots()
+}
+
+// setLotCount sets the named lot to n units, creating it with expiry if
+// needed, and returns how much the lot changed.
+func (p *Product) setLotCount(lot, expiry string, n int) int {
+	prev := 0
+	if i := slices.IndexFunc(p.Lots, func(l Lot) bool { return l.Lot == lot }); i >= 0 {
+		prev = p.Lots[i].Count
+	}
+	p.addLot(lot, expiry, n-prev)
+	return n - prev
+}
+
+// takeFEFO removes n units from the lots, soonest to expire first.
+func (p *Product) takeFEFO(n int) {
+	p.Lots = slices.Clone(p.Lots)
+	slices.SortStableFunc(p.Lots, compareFEFO)
+	for i := range p.Lots {
+		if n <= 0 {
+			break
+		}
+		take := min(n, p.Lots[i].Count)
+		p.Lots[i].Count -= take
+		n -= take
+	}
+	p.dropEmptyLots()
+}
+
+// fitLots trims the lots, soonest to expire first, so they hold no more than
+// the product's Value.
+func (p *Product) fitLots() {
+	lotted := 0
+	for _, l := range p.Lots {
+		lotted += l.Count
+	}
+	if excess := lotted - max(p.Value, 0); excess > 0 {
+		p.takeFEFO(excess)
+	}
+}
+
+func (p *Product) dropEmptyLots() {
+	p.Lots = slices.DeleteFunc(p.Lots, func(l Lot) bool { return l.Count <= 0 })
+	if len(p.Lots) == 0 {
+		p.Lots = nil
+	}
+}
+
+// incLotLocked is incCheckedLocked for units of one lot: they are also added
+// to the product's lot, which is created with expiry if new. Removals are not
+// tied to a lot; they come out of the lots soonest to expire first (see
+// incLocked). The caller must hold db.mu.
+func (db *DB_Type) incLotLocked(loc, key, lot, expiry string, amount int) (Product, error) {
+	prod, err := db.incCheckedLocked(loc, key, amount)
+	if err != nil || lot == "" || amount <= 0 {
+		return prod, err
+	}
+	stock := db.stockLocked(loc)
+	prod = stock[key]
+	prod.addLot(lot, expiry, amount)
+	stock[key] = prod
+	return prod, nil
+}
+
+// setLotLocked sets one lot of the product at loc to count units, as a full
+// count of that lot, adjusting the product's Value by the change. It returns
+// the updated product. The caller must hold db.mu.
+func (db *DB_Type) setLotLocked(loc, key, lot, expiry string, count int) Product {
+	stock := db.stockLocked(loc)
+	prod, exists := stock[key]
+	if !exists {
+		prod = newProduct(key)
+	}
+	prod.Value += prod.setLotCount(lot, expiry, count)
+	prod.LastUpdated = time.Now()
+	stock[key] = prod
+	return prod
+}
+
+// FEFOEntry is one lot in the first-expired-first-out report.
+type FEFOEntry struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Lot      string `json:"lot"`
+	Expiry   string `json:"expiry,omitempty"`
+	Count    int    `json:"count"`
+	Expiring bool   `json:"expiring"` // expired or within -expiry-warning
+}
+
+// fefoReport lists every lot of stock in the order it should be used,
+// flagging those that are Soon by warn.
+func fefoReport(stock map[string]Product, warn time.Duration) []FEFOEntry {
+	type keyedLot struct {
+		key string
+		lot Lot
+	}
+	var lots []keyedLot
+	for key, p := range stock {
+		for _, l := range p.Lots {
+			lots = append(lots, keyedLot{key, l})
+		}
+	}
+	slices.SortFunc(lots, func(a, b keyedLot) int {
+		return cmp.Or(compareFEFO(a.lot, b.lot), cmp.Compare(a.key, b.key))
+	})
+	out := make([]FEFOEntry, len(lots))
+	for i, kl := range lots {
+		out[i] = FEFOEntry{Key: kl.key, Name: stock[kl.key].Name, Lot: kl.lot.Lot, Expiry: kl.lot.Expiry, Count: kl.lot.Count, Expiring: kl.lot.Soon(warn)}
+	}
+	return out
+}
+
+// HandleAPILots returns the lots at ?location= in first-expired-first-out
+// order.
+func HandleAPILots(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, fefoReport(db.snapshotLocation(locationFor(req)), configFor(req).ExpiryWarning))
+}
@@ -1,155 +1,966 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"html/template"
-	"image"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	"main/utils"
-
-	"gocv.io/x/gocv"
+	"scantron_inventory/utils"
 )
 
 // Product holds the product name and its count.
 type Product struct {
-	Name  string
-	Value int
+	Name      string `json:"name"`
+	Value     int    `json:"value"`
+	Threshold int    `json:"threshold,omitempty"` // reorder point; 0 means none
+	Notes     string `json:"notes,omitempty"`     // free-form operator context
+	PackSize  int    `json:"packSize,omitempty"`  // units per scanned mark; 0 means 1
+	Category  string `json:"category,omitempty"`  // groups products for reports
+	Lots      []Lot  `json:"lots,omitempty"`      // per-lot stock, soonest to expire used first
+
+	LastUpdated time.Time `json:"lastUpdated"` // last change to the count or name
+}
+
+// LowStock reports whether the product has a reorder threshold and is at or below it.
+func (p Product) LowStock() bool {
+	return p.Threshold > 0 && p.Value <= p.Threshold
+}
+
+// defaultLocation holds the inventory of requests that name no location, and
+// everything stored before locations existed.
+const defaultLocation = "default"
+
+// Inventory maps a location to the products stocked there, keyed by product key.
+type Inventory map[string]map[string]Product
+
+// normalizeLocation trims a location name, mapping "" to defaultLocation.
+func normalizeLocation(loc string) string {
+	if loc = strings.TrimSpace(loc); loc == "" {
+		return defaultLocation
+	}
+	return loc
 }
 
-// DB_Type holds the inventory of products.
+// Units converts a decoded count into units using the product's pack size.
+func (p Product) Units(count int) int {
+	if p.PackSize > 1 {
+		return count * p.PackSize
+	}
+	return count
+}
+
+// DB_Type holds the inventory of products at every location.
 type DB_Type struct {
-	mu    sync.Mutex
-	items map[string]Product
+	mu      sync.Mutex
+	items   Inventory
+	aliases Aliases       // extra codes for product keys, at every location
+	changed chan struct{} // signaled after every modification so it gets persisted
+
+	maxProducts int // distinct keys inc may create; 0 means no limit
+}
+
+// notify signals that the inventory changed without blocking; pending
+// signals are coalesced into one save.
+func (db *DB_Type) notify() {
+	select {
+	case db.changed <- struct{}{}:
+	default:
+	}
+}
+
+// stockLocked returns the products at loc, creating the location if needed.
+// The caller must hold db.mu.
+func (db *DB_Type) stockLocked(loc string) map[string]Product {
+	stock, ok := db.items[loc]
+	if !ok {
+		stock = map[string]Product{}
+		db.items[loc] = stock
+	}
+	return stock
 }
 
-// inc increments the product's value by a given amount.
-// If the product does not exist, it is created with a default name equal to its key.
-func (db *DB_Type) inc(key string, amount int) {
+// inc increments the product's value at loc by a given amount and returns the updated product.
+// If the product does not exist, it is created with a default name equal to its key,
+// unless that would exceed db.maxProducts: then the amount is quarantined for
+// review and ErrProductLimit is returned. Keys known at any location are unaffected.
+// Keys new to every location are announced through newProducts. The change is
+// audited as action, with ref, before the lock is released.
+func (db *DB_Type) inc(loc, key string, amount int, action, ref string) (Product, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if prod, exists := db.items[key]; exists {
-		prod.Value += amount
-		db.items[key] = prod
-	} else {
-		db.items[key] = Product{Name: key, Value: amount}
+	prod, err := db.incCheckedLocked(loc, key, amount)
+	if err == nil {
+		audit.record(AuditEntry{Action: action, Location: loc, Key: key, Delta: amount, Value: prod.Value, Ref: ref})
+	}
+	return prod, err
+}
+
+// incCheckedLocked is inc for callers that already hold db.mu. Unlike
+// incLocked it enforces db.maxProducts and announces new keys.
+func (db *DB_Type) incCheckedLocked(loc, key string, amount int) (Product, error) {
+	if db.maxProducts > 0 && !db.knownLocked(key) && len(db.keysLocked()) >= db.maxProducts {
+		if !quarantine.add(loc, key, amount) {
+			log.Printf("Quarantine full; dropped %d units of new key %q at %s", amount, key, loc)
+		}
+		return Product{Name: key}, ErrProductLimit
+	}
+	defer db.notify()
+	isNew := !db.knownLocked(key)
+	prod := db.incLocked(loc, key, amount)
+	if isNew {
+		newProducts.created(loc, key, prod.Value)
+	}
+	return prod, nil
+}
+
+// knownLocked reports whether key exists at any location. The caller must hold db.mu.
+func (db *DB_Type) knownLocked(key string) bool {
+	for _, stock := range db.items {
+		if _, ok := stock[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keysLocked returns the set of distinct keys across every location. The
+// caller must hold db.mu.
+func (db *DB_Type) keysLocked() map[string]bool {
+	keys := map[string]bool{}
+	for _, stock := range db.items {
+		for key := range stock {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// incLocked is inc for callers that already hold db.mu. Negative amounts
+// come out of the product's lots soonest to expire first.
+func (db *DB_Type) incLocked(loc, key string, amount int) Product {
+	stock := db.stockLocked(loc)
+	prod, exists := stock[key]
+	if !exists {
+		prod = newProduct(key)
+	}
+	prod.Value += amount
+	if amount < 0 {
+		prod.takeFEFO(-amount)
 	}
+	prod.fitLots()
+	prod.LastUpdated = time.Now()
+	stock[key] = prod
+	return prod
 }
 
-// updateName updates the product's name.
-func (db *DB_Type) updateName(key, newName string) {
+// set assigns an exact value to the product at loc, creating it if needed.
+// An empty name keeps the current name (or the key for new products). The
+// change is audited before the lock is released. It returns the updated
+// product.
+func (db *DB_Type) set(loc, key, name string, value int) Product {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if prod, exists := db.items[key]; exists {
-		prod.Name = newName
-		db.items[key] = prod
+	defer db.notify()
+	prev := db.items[loc][key].Value
+	prod := db.setLocked(loc, key, name, value)
+	audit.record(AuditEntry{Action: "set", Location: loc, Key: key, Delta: prod.Value - prev, Value: prod.Value})
+	return prod
+}
+
+// setLocked is set for callers that already hold db.mu.
+func (db *DB_Type) setLocked(loc, key, name string, value int) Product {
+	stock := db.stockLocked(loc)
+	prod, exists := stock[key]
+	if !exists {
+		prod = newProduct(key)
+	}
+	if name != "" {
+		prod.Name = name
+	}
+	prod.Value = value
+	prod.fitLots()
+	prod.LastUpdated = time.Now()
+	stock[key] = prod
+	return prod
+}
+
+// BatchItem is one adjustment in a batch: either a Delta to add or an exact Value.
+type BatchItem struct {
+	Key   string `json:"key"`
+	Delta *int   `json:"delta,omitempty"`
+	Value *int   `json:"value,omitempty"`
+}
+
+// BatchResult reports the outcome of one BatchItem.
+type BatchResult struct {
+	Key   string `json:"key"`
+	Value int    `json:"value"`
+	Error string `json:"error,omitempty"`
+}
+
+// validate checks that the item names a key and exactly one of Delta or Value.
+func (it BatchItem) validate() error {
+	switch {
+	case it.Key == "":
+		return errors.New("key is required")
+	case it.Delta == nil && it.Value == nil:
+		return errors.New("one of delta or value is required")
+	case it.Delta != nil && it.Value != nil:
+		return errors.New("delta and value are mutually exclusive")
+	}
+	return nil
+}
+
+// applyBatch applies all items at loc under a single lock acquisition. Invalid
+// items are reported and skipped; when transactional is set, any invalid item
+// aborts the whole batch. It reports whether the batch was applied.
+func (db *DB_Type) applyBatch(loc string, items []BatchItem, transactional bool) ([]BatchResult, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	results := make([]BatchResult, len(items))
+	failed := false
+	for i, it := range items {
+		results[i].Key = it.Key
+		if err := it.validate(); err != nil {
+			results[i].Error = err.Error()
+			failed = true
+		}
+	}
+	if failed && transactional {
+		for i, it := range items {
+			results[i].Value = db.items[loc][it.Key].Value
+		}
+		return results, false
+	}
+
+	defer db.notify()
+	var entries []AuditEntry
+	for i, it := range items {
+		if results[i].Error != "" {
+			continue
+		}
+		prev := db.items[loc][it.Key].Value
+		var prod Product
+		if it.Delta != nil {
+			prod = db.incLocked(loc, it.Key, *it.Delta)
+		} else {
+			prod = db.setLocked(loc, it.Key, "", *it.Value)
+		}
+		results[i].Value = prod.Value
+		entries = append(entries, AuditEntry{Action: "batch", Location: loc, Key: it.Key, Delta: prod.Value - prev, Value: prod.Value})
+	}
+	audit.record(entries...)
+	return results, true
+}
+
+// snapshot returns a copy of the inventory at every location taken under the lock.
+func (db *DB_Type) snapshot() Inventory {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	items := make(Inventory, len(db.items))
+	for loc, stock := range db.items {
+		items[loc] = maps.Clone(stock)
 	}
+	return items
 }
 
-var db = DB_Type{items: map[string]Product{}}
+// snapshotLocation returns a copy of the products at loc taken under the lock.
+func (db *DB_Type) snapshotLocation(loc string) map[string]Product {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	items := maps.Clone(db.items[loc])
+	if items == nil {
+		items = map[string]Product{}
+	}
+	return items
+}
+
+// locations returns the known locations in sorted order, always including
+// defaultLocation.
+func (db *DB_Type) locations() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	locs := slices.Collect(maps.Keys(db.items))
+	if _, ok := db.items[defaultLocation]; !ok {
+		locs = append(locs, defaultLocation)
+	}
+	slices.Sort(locs)
+	return locs
+}
+
+// updateName updates the product's name at loc. If another key at loc already
+// uses newName and force is false, nothing changes and that key is returned
+// so the operator can confirm; otherwise it returns "".
+func (db *DB_Type) updateName(loc, key, newName string, force bool) (conflict string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stock := db.items[loc]
+	prod, exists := stock[key]
+	if !exists {
+		return ""
+	}
+	if !force {
+		for other, p := range stock {
+			if other != key && p.Name == newName {
+				return other
+			}
+		}
+	}
+	prod.Name = newName
+	prod.LastUpdated = time.Now()
+	stock[key] = prod
+	db.notify()
+	return ""
+}
+
+// setThreshold updates the product's reorder threshold at loc.
+func (db *DB_Type) setThreshold(loc, key string, threshold int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if prod, exists := db.items[loc][key]; exists {
+		prod.Threshold = threshold
+		db.items[loc][key] = prod
+		db.notify()
+	}
+}
+
+// setPackSize updates the product's pack size at loc.
+func (db *DB_Type) setPackSize(loc, key string, size int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if prod, exists := db.items[loc][key]; exists {
+		prod.PackSize = size
+		db.items[loc][key] = prod
+		db.notify()
+	}
+}
+
+// setCategory updates the product's category at loc.
+func (db *DB_Type) setCategory(loc, key, category string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if prod, exists := db.items[loc][key]; exists {
+		prod.Category = category
+		db.items[loc][key] = prod
+		db.notify()
+	}
+}
+
+// sum adds up the counts at loc of the listed keys and of every product in
+// category (either may be empty), from one consistent view of the inventory.
+// Listed keys that don't exist are returned as missing.
+func (db *DB_Type) sum(loc string, keys []string, category string) (total int, items map[string]int, missing []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	items = map[string]int{}
+	stock := db.items[loc]
+	for _, key := range keys {
+		if prod, ok := stock[key]; ok {
+			items[key] = prod.Value
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if category != "" {
+		for key, prod := range stock {
+			if prod.Category == category {
+				items[key] = prod.Value
+			}
+		}
+	}
+	for _, v := range items {
+		total += v
+	}
+	return total, items, missing
+}
+
+// setNotes updates the product's notes at loc.
+func (db *DB_Type) setNotes(loc, key, notes string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	prod, exists := db.items[loc][key]
+	if !exists {
+		return false
+	}
+	prod.Notes = notes
+	db.items[loc][key] = prod
+	db.notify()
+	return true
+}
+
+// replace swaps in a whole inventory restored from the backup named ref. Every
+// count it changes is audited as a "restore", and every product it drops as a
+// "restore-remove", so replaying the audit log arrives at the restored
+// inventory. The entries are recorded under the lock, before any later change.
+func (db *DB_Type) replace(items Inventory, aliases Aliases, ref string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var entries []AuditEntry
+	for loc, stock := range items {
+		for key, prod := range stock {
+			if prev := db.items[loc][key].Value; prod.Value != prev || !db.hasLocked(loc, key) {
+				entries = append(entries, AuditEntry{Action: "restore", Location: loc, Key: key, Delta: prod.Value - prev, Value: prod.Value, Ref: ref})
+			}
+		}
+	}
+	for loc, stock := range db.items {
+		for key, prod := range stock {
+			if _, ok := items[loc][key]; !ok {
+				entries = append(entries, AuditEntry{Action: "restore-remove", Location: loc, Key: key, Delta: -prod.Value, Ref: ref})
+			}
+		}
+	}
+	db.items, db.aliases = items, aliases
+	audit.record(entries...)
+	db.notify()
+}
+
+// hasLocked reports whether the product exists at loc. The caller must hold db.mu.
+func (db *DB_Type) hasLocked(loc, key string) bool {
+	_, ok := db.items[loc][key]
+	return ok
+}
+
+// Errors returned by transfer.
+var (
+	ErrInvalidTransfer   = errors.New("transfer needs a positive amount between two different locations")
+	ErrUnknownProduct    = errors.New("unknown product")
+	ErrInsufficientStock = errors.New("not enough stock to transfer")
+)
+
+// transfer moves amount units of key from one location to another under a
+// single lock acquisition, so both counts change together or not at all. It
+// fails without changing anything if the source would go negative. Both sides
+// are written to the audit log.
+func (db *DB_Type) transfer(from, to, key string, amount int) error {
+	if amount <= 0 || from == to {
+		return ErrInvalidTransfer
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	src, exists := db.items[from][key]
+	if !exists {
+		return ErrUnknownProduct
+	}
+	if src.Value < amount {
+		return ErrInsufficientStock
+	}
+
+	_, known := db.items[to][key]
+	out := db.incLocked(from, key, -amount)
+	in := db.incLocked(to, key, amount)
+	if !known {
+		// A product new to the destination keeps its name.
+		in.Name = src.Name
+		db.items[to][key] = in
+	}
+	audit.record(
+		AuditEntry{Action: "transfer-out", Location: from, Key: key, Delta: -amount, Value: out.Value, Ref: to},
+		AuditEntry{Action: "transfer-in", Location: to, Key: key, Delta: amount, Value: in.Value, Ref: from},
+	)
+	db.notify()
+	return nil
+}
+
+var db = DB_Type{items: Inventory{}, changed: make(chan struct{}, 1)}
+
+// templateFuncs are the helpers available to every HTML template.
+var templateFuncs = template.FuncMap{
+	"t":          translate,
+	"pathEscape": url.PathEscape,
+	"fmtTime":    formatTime,
+	"ago":        timeAgo,
+	"orDash":     orDash,
+}
+
+// emptyValue is shown in place of missing values in the UI.
+const emptyValue = "—"
+
+// orDash returns v, or emptyValue when v is nil or its type's zero value, so
+// fields missing from older data don't render as "0" or "0001-01-01".
+func orDash(v any) any {
+	if v == nil || reflect.ValueOf(v).IsZero() {
+		return emptyValue
+	}
+	return v
+}
 
 // Parse HTML templates.
 var (
-	uploadTemplate    = template.Must(template.ParseFiles("templates/upload.html"))
-	dashboardTemplate = template.Must(template.ParseFiles("templates/dashboard.html"))
+	uploadTemplate    = template.Must(template.New("upload.html").Funcs(templateFuncs).ParseFiles("templates/upload.html"))
+	dashboardTemplate = template.Must(template.New("dashboard.html").Funcs(templateFuncs).ParseFiles("templates/dashboard.html"))
+	resultTemplate    = template.Must(template.New("result.html").Funcs(templateFuncs).ParseFiles("templates/result.html"))
+	settingsTemplate  = template.Must(template.New("settings.html").Funcs(templateFuncs).ParseFiles("templates/settings.html"))
 )
 
 func main() {
-	// Frontend routes.
-	http.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
-		switch req.Method {
-		case http.MethodGet:
-			HandleUploadPage(w, req)
-		case http.MethodPost:
-			HandleUpload(w, req)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	cfg := defaultConfig()
+	cfg.registerFlags(flag.CommandLine)
+	selfTest := flag.Bool("selftest", false, "decode a generated sample sheet, print a diagnostic checklist and exit")
+	configFile := flag.String("config", "", "JSON file of settings keyed by flag name; command-line flags and environment variables override it")
+	decodeFile := flag.String("decode", "", "decode this sheet image with the -template scan template, print the results as JSON to stdout and exit")
+	synthOut := flag.String("synth", "", "write a synthetic sample sheet for the default template to this file and exit")
+	flag.Parse()
+	pinSettings()
+	settingsPage.ConfigPath = *configFile
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile, flag.CommandLine); err != nil {
+			log.Fatal("Error loading config: ", err)
 		}
-	})
-	http.HandleFunc("/dashboard", HandleDashboard)
-	http.HandleFunc("/update", HandleUpdateInventory)
-	http.HandleFunc("/updateName", HandleUpdateName)
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+	}
+
+	if err := setTimeDisplay(cfg.TimeZone, cfg.TimeFormat); err != nil {
+		log.Fatal("Invalid -tz: ", err)
+	}
+	var err error
+	if exporter, err = newExporter(cfg.Export, cfg.ExportSheetID, cfg.ExportSheetRange, cfg.ExportWebhook); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.SKUNamesFile != "" {
+		if skuNames, err = loadSKUNames(cfg.SKUNamesFile); err != nil {
+			log.Fatal("Error loading SKU names: ", err)
+		}
+		log.Printf("Loaded names for %d SKUs from %s", len(skuNames), cfg.SKUNamesFile)
+	}
+	if cfg.RulesFile != "" {
+		if sheetRules, err = loadRules(cfg.RulesFile); err != nil {
+			log.Fatal("Error loading rules: ", err)
+		}
+		log.Printf("Loaded %d sheet rules from %s", len(sheetRules), cfg.RulesFile)
+	}
+	if cfg.TemplateDir != "" {
+		if err := scanTemplates.loadDir(cfg.TemplateDir); err != nil {
+			log.Fatal("Error loading templates: ", err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal("Invalid settings: ", err)
+	}
+	audit.path = cfg.AuditFile
+	db.maxProducts = cfg.MaxProducts
+	resultsWebhook.URL = cfg.ResultsWebhook
+	liveConfig.Store(cfg)
+
+	if *selfTest {
+		if !printChecklist(os.Stdout, scanner.SelfTest(cfg.decoding(defaultTemplate))) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *synthOut != "" {
+		if err := scanner.WriteSample(*synthOut, defaultTemplate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *decodeFile != "" {
+		tmpl, _ := cfg.template("")
+		if err := printDecode(os.Stdout, *decodeFile, tmpl); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := scanningDisabled(); err != nil {
+		log.Printf("Scanning disabled: %v", err)
+	}
+
+	var store Store = memoryStore{}
+	if cfg.DataFile != "" {
+		store = fileStore{path: cfg.DataFile}
+	}
+	state, err := store.Load()
+	if err != nil {
+		log.Fatal("Error loading inventory: ", err)
+	}
+	db.items, db.aliases = state.Items, state.Aliases
+	scans.lifetime.Store(state.Scans)
+	saver := newPersister(store, storedState)
+	stopSaver := make(chan struct{})
+	go saver.run(db.changed, stopSaver)
+	if cfg.Backups.enabled() {
+		go runBackups(cfg.Backups.Interval, stopSaver)
+	}
+	if resultsWebhook.URL != "" {
+		go runResultsWebhook(stopSaver)
+	}
+	if exporter != nil && cfg.ExportInterval > 0 {
+		go runExports(cfg.ExportInterval, stopSaver)
+	}
+
+	// The main server has a mux of its own: net/http/pprof registers its
+	// profiles on http.DefaultServeMux, which is only served with -pprof.
+	mux := http.NewServeMux()
+
+	// API routes.
+	mux.Handle("/api/", cors(corsConfig{
+		Origins: splitList(cfg.CORSOrigins),
+		Methods: cfg.CORSMethods,
+		Headers: cfg.CORSHeaders,
+	}, apiMux))
+
+	// Frontend routes.
+	routes := newRouter(mux)
+	routes.HandleFunc("GET /upload", HandleUploadPage)
+	routes.HandleSlowFunc("POST /upload", HandleUpload)
+	routes.HandleFunc("GET /dashboard", HandleDashboard)
+	routes.HandleFunc("POST /update", HandleUpdateInventory)
+	routes.HandleFunc("POST /updateName", HandleUpdateName)
+	routes.HandleFunc("POST /updateThreshold", HandleUpdateThreshold)
+	routes.HandleFunc("POST /updatePackSize", HandleUpdatePackSize)
+	routes.HandleFunc("POST /product/{key}/notes", HandleUpdateNotes)
+	routes.HandleFunc("POST /set", HandleSet)
+	routes.HandleFunc("POST /paste", HandlePaste)
+	routes.HandleFunc("POST /product/{key}/aliases", HandleAddAlias)
+	routes.HandleFunc("POST /product/{key}/aliases/{code}/remove", HandleRemoveAlias)
+	routes.HandleFunc("POST /transfer", HandleTransfer)
+	routes.HandleFunc("GET /lang", HandleLang)
+	routes.HandleFunc("GET /settings", requireAdmin(HandleSettings))
+	routes.HandleFunc("POST /settings", requireAdmin(HandleUpdateSettings))
+	routes.HandleSlowFunc("POST /recalibrate", HandleRecalibrate)
+	routes.HandleSlowFunc("POST /uploads/{id}/redecode", HandleRedecode)
+	routes.HandleStreamFunc("GET /uploads/debug.zip", HandleDebugZip)
+	routes.HandleFunc("GET /uploads/{id}/thumbnail.jpg", HandleThumbnail)
+	routes.HandleFunc("GET /uploads/{id}/original", HandleArchivedOriginal)
+	routes.HandleFunc("GET /uploads/{id}/annotated.png", HandleArchivedAnnotated)
+	routes.HandleSlowFunc("POST /reprocess", HandleReprocess)
+	routes.HandleSlowFunc("GET /diag", HandleDiag)
+	routes.HandleFunc("GET /stats", HandleStats)
+	routes.HandleFunc("POST /staged/{id}/confirm", HandleConfirmStaged)
+	routes.HandleFunc("POST /staged/{id}/discard", HandleDiscardStaged)
+	routes.HandleFunc("POST /quarantine/{key}/admit", HandleAdmitQuarantined)
+	routes.HandleFunc("POST /quarantine/{key}/discard", HandleDiscardQuarantined)
+	routes.HandleFunc("POST /sessions", HandleStartSession)
+	routes.HandleFunc("POST /sessions/{id}/commit", HandleCommitSession)
+	routes.HandleFunc("POST /sessions/{id}/discard", HandleDiscardSession)
+	routes.HandleFunc("POST /sheets/{id}/correct", HandleCorrectSheet)
+	routes.HandleSlowFunc("POST /export/sheet", HandleExportSheet)
+	routes.HandleFunc("GET /backups", HandleBackups)
+	routes.HandleSlowFunc("POST /restore", HandleRestore)
+	routes.HandleSlowFunc("POST /admin/rebuild-from-audit", requireAdmin(HandleRebuildFromAudit))
+	routes.HandleSlowFunc("POST /jobs", HandleCreateJob)
+	routes.HandleFunc("GET /jobs/{token}", HandleJobStatus)
+	routes.HandleFunc("GET /{$}", func(w http.ResponseWriter, req *http.Request) {
 		http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
 	})
+	routes.HandleFunc("/", HandleNotFound)
+
+	if cfg.PprofAddr != "" {
+		go servePprof(cfg.PprofAddr)
+	}
 
-	fmt.Println("Server started on port 3000...")
-	if err := http.ListenAndServe(":3000", nil); err != nil {
+	srv := &http.Server{Addr: cfg.Addr, Handler: chain(mux, withRequestID, withConfig, logRequests)}
+	tls := tlsConfig{CertFile: cfg.TLSCert, KeyFile: cfg.TLSKey, RedirectAddr: cfg.HTTPRedirect}
+	err = runServer(srv, tls)
+	close(stopSaver)
+	if saveErr := saver.save(); saveErr != nil {
+		log.Println("Error saving inventory on shutdown: ", saveErr)
+	}
+	if err != nil {
 		log.Fatal("Server error: ", err)
 	}
 }
 
 // HandleUploadPage renders the file upload page.
 func HandleUploadPage(w http.ResponseWriter, req *http.Request) {
-	if err := uploadTemplate.Execute(w, nil); err != nil {
-		http.Error(w, "Error rendering template", http.StatusInternalServerError)
+	renderUploadPage(w, req, http.StatusOK, "")
+}
+
+// renderResultPage shows a decoded sheet's rows next to its annotated image,
+// so the operator can check the scan before moving on.
+func renderResultPage(w http.ResponseWriter, req *http.Request, status int, uploadID string, sheet Sheet, staged, rejected bool, data []byte, tmpl ScanTemplate) {
+	page := struct {
+		Lang      string
+		UploadID  string
+		Thumbnail bool
+		Sheet     Sheet
+		Staged    bool
+		Rejected  bool // nothing was applied because of -all-or-nothing or -rules
+		// RuleRejected is set when a rule rejected the sheet, rather than
+		// -all-or-nothing.
+		RuleRejected bool
+		Image        template.URL
+	}{
+		Lang:         localeFor(req),
+		UploadID:     uploadID,
+		Sheet:        sheet,
+		Staged:       staged,
+		Rejected:     rejected,
+		RuleRejected: rejected && sheet.rejectedByRules(),
+	}
+	_, page.Thumbnail = uploads.thumbnail(uploadID)
+	if _, png, err := scanner.Annotate(data, tmpl); err != nil {
+		log.Printf("[%s] annotating sheet %s: %v", requestID(req), sheet.ID, err)
+	} else {
+		page.Image = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	var buf bytes.Buffer
+	if err := resultTemplate.Execute(&buf, page); err != nil {
+		httpError(w, req, "error.renderTemplate", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
 }
 
-// HandleUpload handles the file upload and calls DecodeDocument.
-func HandleUpload(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+// renderUploadPage renders the upload page with an optional error message key.
+func renderUploadPage(w http.ResponseWriter, req *http.Request, status int, errKey string) {
+	data := struct {
+		Lang      string
+		Error     string
+		Templates []string
+		Active    string // template preselected; see -template
+		Location  string
+		Locations []string
+		Disabled  string // why scanning is unavailable
+		Session   *ScanSession
+		Help      map[string]string
+	}{
+		Lang:      localeFor(req),
+		Templates: scanTemplates.names(),
+		Active:    configFor(req).Template,
+		Location:  locationFor(req),
+		Locations: db.locations(),
+	}
+	if s, ok := scanSessions.get(req.FormValue("session")); ok {
+		data.Session = &s
+	}
+	data.Help = helpTexts(data.Lang)
+	if errKey != "" {
+		data.Error = translate(data.Lang, errKey)
+	}
+	if err := scanningDisabled(); err != nil {
+		data.Disabled = err.Error()
+	}
+	var buf bytes.Buffer
+	if err := uploadTemplate.Execute(&buf, data); err != nil {
+		httpError(w, req, "error.renderTemplate", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
 
-	err := req.ParseMultipartForm(10 << 20) // up to 10 MB
+// HandleUpload handles the file upload, decodes it with the scanner and hands the
+// decoded sheet to the registered result handlers.
+func HandleUpload(w http.ResponseWriter, req *http.Request) {
+	data, ok := readUploadFile(w, req)
+	if !ok {
+		return
+	}
+	// Check the bytes themselves; the file name and declared type can't be trusted.
+	format, err := utils.DetectImageFormat(bytes.NewReader(data))
 	if err != nil {
-		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		renderUploadPage(w, req, http.StatusUnsupportedMediaType, "error.notImage")
 		return
 	}
-
-	file, _, err := req.FormFile("uploadFile")
+	cfg := configFor(req)
+	tmpl, ok := cfg.template(req.FormValue("template"))
+	if !ok {
+		renderUploadPage(w, req, http.StatusBadRequest, "error.unknownTemplate")
+		return
+	}
+	mode, err := countModeFor(req.FormValue("mode"), tmpl)
 	if err != nil {
-		http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+		renderUploadPage(w, req, http.StatusBadRequest, "error.invalidMode")
 		return
 	}
-	defer file.Close()
+	sessionID := req.FormValue("session")
+	if _, ok := scanSessions.get(sessionID); sessionID != "" && !ok {
+		renderUploadPage(w, req, http.StatusNotFound, "error.noSession")
+		return
+	}
+	// Keep the raw bytes so the sheet can be re-decoded during calibration
+	// or with another template.
+	location := locationFor(req)
+	uploadID := uploads.add(cfg, data, location)
+	log.Printf("[%s] Retained upload %s (template %s)", requestID(req), uploadID, tmpl.Name)
 
 	// Save the uploaded file to a temporary file.
-	tempFile, err := os.CreateTemp("", "upload-*.png")
+	tempFile, err := writeTempImage(data, format)
 	if err != nil {
-		http.Error(w, "Cannot create temporary file", http.StatusInternalServerError)
+		httpError(w, req, "error.tempFile", http.StatusInternalServerError)
 		return
 	}
-	defer os.Remove(tempFile.Name())
+	defer os.Remove(tempFile)
 
-	_, err = io.Copy(tempFile, file)
+	// Process the image to update the inventory.
+	sheet, err := scanner.Decode(tempFile, tmpl)
+	uploads.recordDecode(cfg, uploadID, tmpl, sheet, err)
+	watchdog.observe(cfg.Watchdog, sheet, err)
 	if err != nil {
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		log.Printf("[%s] %v", requestID(req), err)
+		renderUploadPage(w, req, decodeErrorStatus(err), decodeErrorKey(err))
+		return
+	}
+	if abandoned(req) {
+		return
+	}
+	sheet = finishSheet(sheet, uploadID, location, mode)
+	sheetDecoded(uploadID, sheet)
+	// Sheets scanned into a session wait for it to be committed.
+	var staged bool
+	if sessionID != "" {
+		if err = checkSheet(sheet, cfg.Commit); err == nil {
+			if staged = scanSessions.add(sessionID, sheet); !staged {
+				renderUploadPage(w, req, http.StatusNotFound, "error.noSession")
+				return
+			}
+		}
+	} else {
+		staged, err = commitSheet(sheet, cfg.Commit)
+	}
+	if err != nil {
+		// Always show the report so the operator sees which rows to fix.
+		log.Printf("[%s] %v", requestID(req), err)
+		renderResultPage(w, req, http.StatusUnprocessableEntity, uploadID, sheet, staged, true, data, tmpl)
 		return
 	}
-	tempFile.Close()
-
-	// Process the image to update the inventory.
-	DecodeDocument(tempFile.Name())
 
+	if show, _ := strconv.ParseBool(req.FormValue("showResult")); show {
+		renderResultPage(w, req, http.StatusOK, uploadID, sheet, staged, false, data, tmpl)
+		return
+	}
+	if s, ok := scanSessions.get(sessionID); ok {
+		// Back to the upload page for the next sheet of the session.
+		http.Redirect(w, req, sessionUploadURL(s), http.StatusSeeOther)
+		return
+	}
 	// Redirect to the dashboard.
-	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+	http.Redirect(w, req, dashboardURL(sheet.Location), http.StatusSeeOther)
+}
+
+// readUploadFile returns the bytes of the multipart uploadFile field. On
+// failure it replies with an error and returns false.
+func readUploadFile(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	err := req.ParseMultipartForm(10 << 20) // up to 10 MB
+	if err != nil {
+		httpError(w, req, "error.parseForm", http.StatusBadRequest)
+		return nil, false
+	}
+
+	file, _, err := req.FormFile("uploadFile")
+	if err != nil {
+		httpError(w, req, "error.retrieveFile", http.StatusBadRequest)
+		return nil, false
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		httpError(w, req, "error.saveFile", http.StatusInternalServerError)
+		return nil, false
+	}
+	return data, true
 }
 
 // HandleDashboard renders the dashboard with current inventory.
+// With ?lowstock=1 only products at or below their reorder threshold are shown.
 func HandleDashboard(w http.ResponseWriter, req *http.Request) {
+	renderDashboard(w, req, http.StatusOK, nil, nil)
+}
+
+// nameWarning asks the operator to confirm giving Key a name OtherKey already uses.
+type nameWarning struct {
+	Key      string
+	Name     string
+	OtherKey string
+}
+
+// renderDashboard renders the dashboard for the requested location, optionally
+// with a name-collision warning or the outcome of a pasted import.
+func renderDashboard(w http.ResponseWriter, req *http.Request, status int, warning *nameWarning, paste *pasteSummary) {
+	cfg := configFor(req)
+	lowStock, _ := strconv.ParseBool(req.URL.Query().Get("lowstock"))
+	location := locationFor(req)
+	inventory := db.snapshotLocation(location)
+	if lowStock {
+		for key, prod := range inventory {
+			if !prod.LowStock() {
+				delete(inventory, key)
+			}
+		}
+	}
+
+	var reorder []ReorderSuggestion
+	suggestions, err := reorderSuggestions(cfg.Reorder, []string{location}, time.Now())
+	if err != nil {
+		log.Printf("[%s] reorder suggestions: %v", requestID(req), err)
+	}
+	for _, s := range suggestions {
+		if s.Quantity > 0 {
+			reorder = append(reorder, s)
+		}
+	}
+
 	data := struct {
-		Inventory map[string]Product
+		Lang        string
+		Location    string
+		Locations   []string
+		Inventory   map[string]Product
+		Aliases     map[string][]string // product key -> its other codes
+		LowStock    bool
+		Alerts      []Alert
+		Staged      []stagedSheet
+		Quarantined []QuarantinedKey
+		Sessions    []ScanSession
+		Reorder     []ReorderSuggestion
+		Scans       [2]int64      // since start, lifetime
+		Export      string        // name of the configured exporter, if any
+		ExpiryWarn  time.Duration // lots expiring within this are flagged; see -expiry-warning
+		NameWarning *nameWarning
+		Paste       *pasteSummary
+		Help        map[string]string
 	}{
-		Inventory: db.items,
+		Lang:        localeFor(req),
+		Location:    location,
+		Locations:   db.locations(),
+		Inventory:   inventory,
+		Aliases:     db.snapshotAliases().byKey(),
+		LowStock:    lowStock,
+		Alerts:      alerts.recent(),
+		Staged:      stagedSheets.list(),
+		Quarantined: quarantine.list(location),
+		Sessions:    scanSessions.list(),
+		Reorder:     reorder,
+		Scans:       [2]int64{scans.session.Load(), scans.lifetime.Load()},
+		ExpiryWarn:  cfg.ExpiryWarning,
+		NameWarning: warning,
+		Paste:       paste,
+	}
+	if exporter != nil {
+		data.Export = exporter.Name()
 	}
-	if err := dashboardTemplate.Execute(w, data); err != nil {
-		http.Error(w, "Error rendering dashboard", http.StatusInternalServerError)
+	data.Help = helpTexts(data.Lang)
+	var buf bytes.Buffer
+	if err := dashboardTemplate.Execute(&buf, data); err != nil {
+		httpError(w, req, "error.renderDashboard", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
 }
 
 // HandleUpdateInventory handles incrementing or decrementing product value.
 func HandleUpdateInventory(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
-		return
-	}
 	key := req.FormValue("key")
 	action := req.FormValue("action")
 
@@ -158,76 +969,116 @@ func HandleUpdateInventory(w http.ResponseWriter, req *http.Request) {
 	if action == "dec" {
 		delta = -1
 	}
-	db.inc(key, delta)
-	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+	loc := locationFor(req)
+	if _, err := db.inc(loc, key, delta, "adjust", ""); errors.Is(err, ErrProductLimit) {
+		httpError(w, req, "error.productLimit", http.StatusConflict)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
 }
 
 // HandleUpdateName updates the product name based on the form submission.
+// A name already used by another key is only applied once confirmed with force=1.
 func HandleUpdateName(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
-		return
-	}
 	key := req.FormValue("key")
 	newName := req.FormValue("name")
-	db.updateName(key, newName)
-	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+	force, _ := strconv.ParseBool(req.FormValue("force"))
+	loc := locationFor(req)
+	if other := db.updateName(loc, key, newName, force); other != "" {
+		renderDashboard(w, req, http.StatusConflict, &nameWarning{Key: key, Name: newName, OtherKey: other}, nil)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
 }
 
-// DecodeDocument processes the image file, decodes the QR code and bubble regions,
-// and updates the inventory. In the loop, the QR code denotes the product key,
-// the first bubble section gives the tens digit and the second bubble section gives the ones digit.
-func DecodeDocument(inputImage string) {
-	// Read the original image in color.
-	img := gocv.IMRead(inputImage, gocv.IMReadColor)
-	if img.Empty() {
-		fmt.Printf("Error reading image: %s\n", inputImage)
+// HandleUpdateThreshold updates the product's reorder threshold.
+func HandleUpdateThreshold(w http.ResponseWriter, req *http.Request) {
+	threshold, err := formInt(req, "threshold", 0)
+	if err != nil || threshold < 0 {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
 		return
 	}
-	defer img.Close()
-
-	// Loop to process multiple products in the image.
-	for i := range 21 {
-		offset := int(float32(i) * 83.47)
-
-		// Process product key QR region.
-		keyRect := image.Rect(450, 540+offset, 515, 605+offset)
-		key, err := utils.ProcessQRRegion(&img, keyRect)
-		if err != nil {
-			fmt.Printf("QR code not detected for key at offset %d: %v\n", offset, err)
-			continue
-		}
+	loc := locationFor(req)
+	db.setThreshold(loc, req.FormValue("key"), threshold)
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
+}
 
-		if key == "" {
-			continue
-		}
+// HandleUpdatePackSize updates how many units one scanned mark stands for.
+func HandleUpdatePackSize(w http.ResponseWriter, req *http.Request) {
+	size, err := formInt(req, "packSize", 0)
+	if err != nil || size < 0 {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	loc := locationFor(req)
+	db.setPackSize(loc, req.FormValue("key"), size)
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
+}
 
-		// Process tens bubble region.
-		tensRect := image.Rect(534, 541+offset, 951, 576+offset)
-		tens, err := utils.ProcessHorizontalSections(&img, tensRect, 10)
-		if err != nil {
-			fmt.Printf("Error processing horizontal sections (tens) at offset %d: %v\n", offset, err)
-			continue
-		}
+// HandleUpdateNotes replaces the notes of the product named in the path.
+func HandleUpdateNotes(w http.ResponseWriter, req *http.Request) {
+	loc := locationFor(req)
+	if !db.setNotes(loc, req.PathValue("key"), strings.TrimSpace(req.FormValue("notes"))) {
+		httpError(w, req, "error.unknownProduct", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
+}
 
-		// Process ones bubble region.
-		onesRect := image.Rect(980, 541+offset, 1395, 576+offset)
-		ones, err := utils.ProcessHorizontalSections(&img, onesRect, 10)
-		if err != nil {
-			fmt.Printf("Error processing horizontal sections (ones) at offset %d: %v\n", offset, err)
-			continue
-		}
+// HandleSet adds a product or adjusts it to an exact value. It is the manual
+// fallback for sheets that are too damaged to scan.
+func HandleSet(w http.ResponseWriter, req *http.Request) {
+	key := strings.TrimSpace(req.FormValue("key"))
+	if key == "" {
+		httpError(w, req, "error.keyRequired", http.StatusBadRequest)
+		return
+	}
+	value, err := strconv.Atoi(req.FormValue("value"))
+	if err != nil {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	loc := locationFor(req)
+	db.set(loc, key, strings.TrimSpace(req.FormValue("name")), value)
+	if category := strings.TrimSpace(req.FormValue("category")); category != "" {
+		db.setCategory(loc, key, category)
+	}
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
+}
 
-		// Calculate the decoded count.
-		count := tens*10 + ones
+// HandleTransfer moves stock of a product from the posted location to the
+// location named by "to".
+func HandleTransfer(w http.ResponseWriter, req *http.Request) {
+	amount, err := strconv.Atoi(req.FormValue("amount"))
+	if err != nil {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	from := locationFor(req)
+	to := normalizeLocation(req.FormValue("to"))
+	switch err := db.transfer(from, to, strings.TrimSpace(req.FormValue("key")), amount); {
+	case errors.Is(err, ErrUnknownProduct):
+		httpError(w, req, "error.unknownProduct", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrInsufficientStock):
+		httpError(w, req, "error.notEnough", http.StatusConflict)
+		return
+	case err != nil:
+		httpError(w, req, "error.badTransfer", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(from), http.StatusSeeOther)
+}
 
-		// Update inventory.
-		if count != 0 {
-			db.inc(key, count)
-			fmt.Printf("Updated inventory: key: %s, name: %s, new count: %d (added %d)\n", key, db.items[key].Name, db.items[key].Value, count)
-		}
+// locationFor returns the location named by the request's location parameter.
+func locationFor(req *http.Request) string {
+	return normalizeLocation(req.FormValue("location"))
+}
 
+// dashboardURL links to the dashboard of loc.
+func dashboardURL(loc string) string {
+	if loc == defaultLocation {
+		return "/dashboard"
 	}
-	// Optionally write out the image for debugging; not served to the client.
-	gocv.IMWrite("example.png", img)
+	return "/dashboard?location=" + url.QueryEscape(loc)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+)
+
+// middleware wraps a handler with extra behavior.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h with mws so that the first middleware listed runs first.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// requestIDHeader carries the request ID in and out of the server.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds inbound request IDs so clients can't bloat the logs.
+const maxRequestIDLen = 64
+
+type requestIDKey struct{}
+
+// withRequestID assigns every request an ID, reusing a well-formed inbound
+// X-Request-ID, stores it in the request context and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts short IDs of printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID assigned by withRequestID, or "" outside a request.
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requestTimeout and slowTimeout pick how long a request may run before it
+// is answered with a 503 and its context is cancelled: -timeout for reads
+// and quick form posts, -slow-timeout for uploads, decodes and calls to
+// outside services. Zero disables the limit.
+func requestTimeout(c *Config) time.Duration { return c.Timeout }
+func slowTimeout(c *Config) time.Duration    { return c.SlowTimeout }
+
+// withTimeout cuts off requests to next that run longer than the limit
+// picked from the request's Config. It picks it per request, so routes
+// registered before the flags are parsed still get the configured limit.
+func withTimeout(limit func(*Config) time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			d := limit(configFor(req))
+			if d <= 0 {
+				next.ServeHTTP(w, req)
+				return
+			}
+			msg := translate(localeFor(req), "error.timeout")
+			if id := requestID(req); id != "" {
+				msg += " (request " + id + ")"
+			}
+			http.TimeoutHandler(next, d, msg).ServeHTTP(w, req)
+		})
+	}
+}
+
+// withDeadline cancels the context of requests to next that run longer than
+// the limit, like withTimeout, but leaves the response to next: what it
+// already wrote has been sent, so it cannot be replaced with a 503.
+func withDeadline(limit func(*Config) time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			d := limit(configFor(req))
+			if d <= 0 {
+				next.ServeHTTP(w, req)
+				return
+			}
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// abandoned reports, and logs, whether the request was cut off by its
+// timeout or the client went away. Handlers check it after a decode, before
+// changing the inventory, so a client that was sent a 503 does not have its
+// sheet applied behind its back.
+func abandoned(req *http.Request) bool {
+	err := req.Context().Err()
+	if err != nil {
+		log.Printf("[%s] abandoned before applying: %v", requestID(req), err)
+	}
+	return err != nil
+}
+
+// logRequests logs one line per request with its ID, status and duration.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		log.Printf("[%s] %s %s %d %s", requestID(req), req.Method, req.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
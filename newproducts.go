@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// newProductNotifier announces keys that scans create on the fly, so someone
+// can give them a real name and category. Each key is announced once.
+type newProductNotifier struct {
+	mu       sync.Mutex
+	notified map[string]bool
+}
+
+var newProducts newProductNotifier
+
+// newProductEvent is the JSON body POSTed to the new product webhook.
+type newProductEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Location string    `json:"location"`
+	Key      string    `json:"key"`
+	Count    int       `json:"count"`
+}
+
+// created records that key did not exist anywhere before count units of it
+// were added at loc. The announcement is also POSTed to the
+// -new-product-webhook in force.
+func (n *newProductNotifier) created(loc, key string, count int) {
+	n.mu.Lock()
+	if n.notified[key] {
+		n.mu.Unlock()
+		return
+	}
+	if n.notified == nil {
+		n.notified = make(map[string]bool)
+	}
+	n.notified[key] = true
+	n.mu.Unlock()
+
+	if sku, ok := skuNames[key]; ok {
+		log.Printf("New product %q (%s) created at %s with count %d", key, sku.Name, loc, count)
+	} else {
+		log.Printf("New product %q created at %s with count %d; give it a name and category on the dashboard", key, loc, count)
+	}
+	if url := currentConfig().NewProductWebhook; url != "" {
+		go postWebhook("New product", url, newProductEvent{Event: "product-created", Time: time.Now(), Location: loc, Key: key, Count: count})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build nocv
+
+package main
+
+import "errors"
+
+// newScanner returns a disabled scanner: this binary was built without OpenCV.
+func newScanner() Scanner {
+	return disabledScanner{errors.New("built without OpenCV (nocv build tag)")}
+}
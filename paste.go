@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxPasteLines bounds how many lines one paste may hold; larger imports
+// belong in a batch request.
+const maxPasteLines = 500
+
+// pasteSummary reports a pasted import back on the dashboard.
+type pasteSummary struct {
+	Text    string        // the pasted text, put back in the box when nothing was applied
+	Errors  []string      // lines that could not be parsed
+	Results []BatchResult // one per applied line
+}
+
+// parsePaste reads key,value lines with encoding/csv. A value with a leading
+// + or - adjusts the count by that much; a bare number sets it. Blank lines,
+// lines starting with # and a "key,value" header are skipped.
+func parsePaste(text string) ([]BatchItem, []string) {
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	var items []BatchItem
+	var errs []string
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				errs = append(errs, err.Error())
+				break
+			}
+			errs = append(errs, fmt.Sprintf("line %d: %v", perr.Line, perr.Err))
+			if !errors.Is(err, csv.ErrFieldCount) {
+				break // the reader cannot resync after a quoting error
+			}
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		key, value := strings.TrimSpace(rec[0]), strings.TrimSpace(rec[1])
+		if len(items) == 0 && len(errs) == 0 && strings.EqualFold(key, "key") && strings.EqualFold(value, "value") {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		switch {
+		case key == "":
+			errs = append(errs, fmt.Sprintf("line %d: key is required", line))
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("line %d: %q is not a whole number", line, value))
+		case strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-"):
+			items = append(items, BatchItem{Key: key, Delta: &n})
+		default:
+			items = append(items, BatchItem{Key: key, Value: &n})
+		}
+		if len(items)+len(errs) > maxPasteLines {
+			errs = append(errs, fmt.Sprintf("more than %d lines; use the batch API for large imports", maxPasteLines))
+			break
+		}
+	}
+	return items, errs
+}
+
+// HandlePaste applies key,value lines pasted on the dashboard at ?location=
+// and shows what changed. If any line is malformed nothing is applied, so the
+// operator can fix the text and submit it again.
+func HandlePaste(w http.ResponseWriter, req *http.Request) {
+	text := req.FormValue("csv")
+	items, errs := parsePaste(text)
+	if len(errs) > 0 || len(items) == 0 {
+		if len(errs) == 0 {
+			errs = []string{translate(localeFor(req), "paste.empty")}
+		}
+		renderDashboard(w, req, http.StatusBadRequest, nil, &pasteSummary{Text: text, Errors: errs})
+		return
+	}
+	results, _ := db.applyBatch(locationFor(req), items, false)
+	renderDashboard(w, req, http.StatusOK, nil, &pasteSummary{Results: results})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// persister writes inventory snapshots to a Store in the background. Transient
+// failures are retried with exponential backoff and jitter; if every attempt
+// fails, the change stays queued in memory, an alert is raised, and the save is
+// retried periodically until it succeeds.
+type persister struct {
+	store    Store
+	snapshot func() StoredState
+
+	attempts      int           // tries per save before giving up for now
+	baseDelay     time.Duration // first backoff delay, doubled on every retry
+	maxDelay      time.Duration // cap on a single backoff delay
+	retryInterval time.Duration // how often a queued snapshot is retried
+
+	mu      sync.Mutex // serializes saves
+	pending bool       // the latest change has not been saved yet
+}
+
+func newPersister(store Store, snapshot func() StoredState) *persister {
+	return &persister{
+		store:         store,
+		snapshot:      snapshot,
+		attempts:      5,
+		baseDelay:     100 * time.Millisecond,
+		maxDelay:      5 * time.Second,
+		retryInterval: 30 * time.Second,
+	}
+}
+
+// run saves after every signal on changed, and retries queued saves, until done is closed.
+func (p *persister) run(changed <-chan struct{}, done <-chan struct{}) {
+	ticker := time.NewTicker(p.retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-changed:
+			p.save()
+		case <-ticker.C:
+			if p.isPending() {
+				p.save()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *persister) isPending() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending
+}
+
+// save writes the current inventory, retrying with backoff. The snapshot is
+// taken when the save starts, so it always includes every queued change.
+func (p *persister) save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.snapshot()
+	err := retry(p.attempts, p.baseDelay, p.maxDelay, func() error {
+		return p.store.Save(state)
+	})
+	if err != nil {
+		if !p.pending {
+			alertf("Inventory could not be saved, keeping changes in memory and retrying: %v", err)
+		}
+		p.pending = true
+		return err
+	}
+	if p.pending {
+		log.Println("Inventory saved after earlier failures")
+		p.pending = false
+	}
+	return nil
+}
+
+// retry calls fn up to attempts times, sleeping a random duration of up to
+// base*2^n (capped at limit) between tries. It returns the last error.
+func retry(attempts int, base, limit time.Duration, fn func() error) error {
+	var err error
+	for n := range attempts {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if n == attempts-1 {
+			break
+		}
+		delay := min(base<<n, limit)
+		time.Sleep(rand.N(delay) + 1)
+	}
+	return err
+}
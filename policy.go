@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommitPolicy decides when decoded sheets change the inventory.
+type CommitPolicy string
+
+const (
+	CommitAuto      CommitPolicy = "auto"      // apply every row immediately (the default)
+	CommitConfident CommitPolicy = "confident" // apply rows at or above the minimum confidence, stage the rest
+	CommitConfirm   CommitPolicy = "confirm"   // stage every sheet until an operator confirms it
+)
+
+// commitConfig is set from the -commit-policy, -commit-min-confidence and
+// -all-or-nothing flags.
+type commitConfig struct {
+	Policy        CommitPolicy
+	MinConfidence float64
+	AllOrNothing  bool // reject sheets with any failed row instead of applying the rows that decoded
+}
+
+// ErrIncompleteSheet is returned for a sheet with failed rows when
+// -all-or-nothing is set. None of its rows are applied.
+var ErrIncompleteSheet = errors.New("sheet rejected: not every row decoded")
+
+// checkSheet returns an ErrIncompleteSheet naming the failed rows of sheet
+// when c has -all-or-nothing set, an ErrRuleViolation when it broke a rule
+// that rejects it, and nil otherwise.
+func checkSheet(sheet Sheet, c commitConfig) error {
+	var failed []int
+	for _, r := range sheet.Results {
+		if r.Error != "" {
+			failed = append(failed, r.Row)
+		}
+	}
+	if c.AllOrNothing && len(failed) > 0 {
+		return fmt.Errorf("%w: rows %v failed", ErrIncompleteSheet, failed)
+	}
+	var broken []string
+	for _, v := range sheet.Violations {
+		if v.Reject {
+			broken = append(broken, v.Message)
+		}
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("%w: %s", ErrRuleViolation, strings.Join(broken, "; "))
+	}
+	return nil
+}
+
+// parseCommitPolicy validates a -commit-policy value.
+func parseCommitPolicy(s string) (CommitPolicy, error) {
+	switch p := CommitPolicy(s); p {
+	case CommitAuto, CommitConfident, CommitConfirm:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown commit policy %q (want auto, confident or confirm)", s)
+}
+
+func (p *CommitPolicy) String() string { return string(*p) }
+
+func (p *CommitPolicy) Set(s string) error {
+	v, err := parseCommitPolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// commitSheet applies a decoded sheet according to the commit policy of c and
+// stages whatever it holds back for confirmation, reporting whether it did.
+// A sheet checkSheet turns down is neither applied nor staged; its error is
+// returned instead.
+func commitSheet(sheet Sheet, c commitConfig) (staged bool, err error) {
+	if err := checkSheet(sheet, c); err != nil {
+		return false, err
+	}
+	switch c.Policy {
+	case CommitConfirm:
+		stagedSheets.add(sheet, c.Policy)
+		return true, nil
+	case CommitConfident:
+		confident, held := sheet, sheet
+		confident.Results, held.Results = nil, nil
+		for _, r := range sheet.Results {
+			if r.Error == "" && r.Confidence >= c.MinConfidence {
+				confident.Results = append(confident.Results, r)
+			} else {
+				held.Results = append(held.Results, r)
+			}
+		}
+		if len(confident.Results) > 0 {
+			dispatchResults(confident)
+		}
+		if len(held.Results) > 0 {
+			stagedSheets.add(held, c.Policy)
+			return true, nil
+		}
+	default:
+		dispatchResults(sheet)
+	}
+	return false, nil
+}
+
+// stagedSheet is a decoded sheet waiting for an operator to confirm it.
+type stagedSheet struct {
+	ID     string
+	Time   time.Time
+	Sheet  Sheet
+	Policy CommitPolicy
+}
+
+// stagedRegistry holds the staged sheets, oldest first.
+type stagedRegistry struct {
+	mu    sync.Mutex
+	items []stagedSheet
+}
+
+var stagedSheets stagedRegistry
+
+// add stages sheet, held back by policy.
+func (r *stagedRegistry) add(sheet Sheet, policy CommitPolicy) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, stagedSheet{ID: hex.EncodeToString(b), Time: time.Now(), Sheet: sheet, Policy: policy})
+}
+
+// list returns the staged sheets, oldest first.
+func (r *stagedRegistry) list() []stagedSheet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.items)
+}
+
+// holds reports whether a sheet of the given upload is staged.
+func (r *stagedRegistry) holds(uploadID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.ContainsFunc(r.items, func(s stagedSheet) bool { return s.Sheet.UploadID == uploadID })
+}
+
+// take removes and returns the staged sheet with the given ID.
+func (r *stagedRegistry) take(id string) (stagedSheet, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.items, func(s stagedSheet) bool { return s.ID == id })
+	if i < 0 {
+		return stagedSheet{}, false
+	}
+	s := r.items[i]
+	r.items = slices.Delete(r.items, i, i+1)
+	return s, true
+}
+
+// HandleConfirmStaged applies a staged sheet to the inventory.
+func HandleConfirmStaged(w http.ResponseWriter, req *http.Request) {
+	s, ok := stagedSheets.take(req.PathValue("id"))
+	if !ok {
+		httpError(w, req, "error.unknownStaged", http.StatusNotFound)
+		return
+	}
+	dispatchResults(s.Sheet)
+	http.Redirect(w, req, dashboardURL(normalizeLocation(s.Sheet.Location)), http.StatusSeeOther)
+}
+
+// HandleDiscardStaged drops a staged sheet without applying it.
+func HandleDiscardStaged(w http.ResponseWriter, req *http.Request) {
+	s, ok := stagedSheets.take(req.PathValue("id"))
+	if !ok {
+		httpError(w, req, "error.unknownStaged", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(normalizeLocation(s.Sheet.Location)), http.StatusSeeOther)
+}
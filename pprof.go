@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	_ "net/http/pprof" // registers the /debug/pprof handlers on http.DefaultServeMux
+)
+
+// servePprof serves the runtime profiles of net/http/pprof on addr, a
+// listener of its own so they are never reachable on the main address. When
+// an -admin-password is set the profiles ask for it too. It returns only if
+// the listener fails, which is alerted but leaves the server running.
+func servePprof(addr string) {
+	var h http.Handler = http.DefaultServeMux
+	if currentConfig().AdminPassword != "" {
+		h = requireAdmin(http.DefaultServeMux.ServeHTTP)
+	}
+	log.Printf("Serving profiles on %s/debug/pprof/", addr)
+	if err := http.ListenAndServe(addr, h); err != nil {
+		alertf("Profiling server on %s failed: %v", addr, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrProductLimit is returned by db.inc when creating a new product would
+// exceed db.maxProducts. The units are quarantined instead of applied.
+var ErrProductLimit = errors.New("product limit reached")
+
+// maxQuarantined bounds how many keys are held for review; units for further
+// keys are dropped so a flood of misreads cannot grow memory without limit.
+const maxQuarantined = 500
+
+// QuarantinedKey is a new key that arrived after the product limit was
+// reached, held for an operator to admit or discard.
+type QuarantinedKey struct {
+	Location string
+	Key      string
+	Units    int // held back, summed over every scan of the key
+	Scans    int
+	First    time.Time
+	Last     time.Time
+}
+
+// quarantineRegistry holds the quarantined keys, oldest first.
+type quarantineRegistry struct {
+	mu    sync.Mutex
+	items []QuarantinedKey
+}
+
+var quarantine quarantineRegistry
+
+// add holds units of key at loc. It reports false when the key had to be
+// dropped because the registry is full.
+func (r *quarantineRegistry) add(loc, key string, units int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	i := slices.IndexFunc(r.items, func(q QuarantinedKey) bool { return q.Location == loc && q.Key == key })
+	if i < 0 {
+		if len(r.items) >= maxQuarantined {
+			return false
+		}
+		r.items = append(r.items, QuarantinedKey{Location: loc, Key: key, First: now})
+		i = len(r.items) - 1
+	}
+	r.items[i].Units += units
+	r.items[i].Scans++
+	r.items[i].Last = now
+	return true
+}
+
+// list returns the keys quarantined at loc, oldest first.
+func (r *quarantineRegistry) list(loc string) []QuarantinedKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []QuarantinedKey
+	for _, q := range r.items {
+		if q.Location == loc {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+// take removes and returns the quarantined key at loc.
+func (r *quarantineRegistry) take(loc, key string) (QuarantinedKey, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.items, func(q QuarantinedKey) bool { return q.Location == loc && q.Key == key })
+	if i < 0 {
+		return QuarantinedKey{}, false
+	}
+	q := r.items[i]
+	r.items = slices.Delete(r.items, i, i+1)
+	return q, true
+}
+
+// HandleAdmitQuarantined creates the quarantined product at ?location= with
+// its held units, bypassing the product limit.
+func HandleAdmitQuarantined(w http.ResponseWriter, req *http.Request) {
+	loc := locationFor(req)
+	q, ok := quarantine.take(loc, req.PathValue("key"))
+	if !ok {
+		httpError(w, req, "error.noQuarantine", http.StatusNotFound)
+		return
+	}
+	db.mu.Lock()
+	isNew := !db.knownLocked(q.Key)
+	prod := db.incLocked(loc, q.Key, q.Units)
+	if isNew {
+		newProducts.created(loc, q.Key, prod.Value)
+	}
+	audit.record(AuditEntry{Action: "admit", Location: loc, Key: q.Key, Delta: q.Units, Value: prod.Value})
+	db.mu.Unlock()
+	db.notify()
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
+}
+
+// HandleDiscardQuarantined drops a quarantined key and its held units.
+func HandleDiscardQuarantined(w http.ResponseWriter, req *http.Request) {
+	loc := locationFor(req)
+	if _, ok := quarantine.take(loc, req.PathValue("key")); !ok {
+		httpError(w, req, "error.noQuarantine", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(loc), http.StatusSeeOther)
+}
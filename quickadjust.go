@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrNoQR is returned by Scanner.ReadQR when the image holds no readable QR code.
+var ErrNoQR = errors.New("no QR code found")
+
+// quickAdjustResponse is the JSON body returned by HandleQuickAdjust.
+type quickAdjustResponse struct {
+	Location string `json:"location"`
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Delta    int    `json:"delta"`
+	Value    int    `json:"value"`
+}
+
+// HandleQuickAdjust adds delta to the product whose QR code fills the
+// uploaded image (the uploadFile form field), at ?location=. It is for
+// one-off adjustments at a terminal without filling in a sheet.
+func HandleQuickAdjust(w http.ResponseWriter, req *http.Request) {
+	data, ok := readUploadFile(w, req)
+	if !ok {
+		return
+	}
+	delta, err := strconv.Atoi(strings.TrimSpace(req.FormValue("delta")))
+	if err != nil || delta == 0 {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	key, err := scanner.ReadQR(data, configFor(req).Decode.Limits)
+	switch {
+	case errors.Is(err, ErrScanningDisabled):
+		httpError(w, req, "error.noScanner", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, ErrNoQR):
+		httpError(w, req, "error.noQR", http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		log.Printf("[%s] quick adjust: %v", requestID(req), err)
+		httpError(w, req, "error.notImage", http.StatusUnsupportedMediaType)
+		return
+	}
+	if key = strings.TrimSpace(key); key == "" {
+		httpError(w, req, "error.noQR", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if abandoned(req) {
+		return
+	}
+	key = db.canonicalKey(key)
+
+	loc := locationFor(req)
+	prod, err := db.inc(loc, key, delta, "adjust", "")
+	if errors.Is(err, ErrProductLimit) {
+		httpError(w, req, "error.productLimit", http.StatusConflict)
+		return
+	}
+	log.Printf("[%s] Quick adjust at %s: %s %+d = %d", requestID(req), loc, key, delta, prod.Value)
+	writeJSON(w, http.StatusOK, quickAdjustResponse{Location: loc, Key: key, Name: prod.Name, Delta: delta, Value: prod.Value})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ErrNoAuditLog is returned when the inventory is to be rebuilt from an audit
+// log that is kept in memory only, or holds no entries.
+var ErrNoAuditLog = errors.New("no audit log file to rebuild from")
+
+// rebuildSummary is the JSON body returned by HandleRebuildFromAudit.
+type rebuildSummary struct {
+	Entries   int                      `json:"entries"`          // audit entries replayed
+	Backup    string                   `json:"backup,omitempty"` // backup of the inventory that was replaced
+	Locations map[string]locationTotal `json:"locations"`
+}
+
+// locationTotal sums the rebuilt inventory of one location.
+type locationTotal struct {
+	Products int `json:"products"`
+	Units    int `json:"units"`
+}
+
+// replayAudit rebuilds an inventory from audit entries by summing the deltas
+// of each product, starting from an empty inventory. Sums do not depend on
+// the order of the entries, which may be appended out of order by concurrent
+// changes, so the log must reach back to when the inventory was empty.
+// A product whose newest entry is the restore-remove of a backup restore is
+// left out, as the restore left it. Products get their names from
+// -sku-names, or their key; thresholds, notes, pack sizes and lots are not
+// audited and start out empty.
+func replayAudit(entries []AuditEntry) Inventory {
+	items := Inventory{}
+	removed := map[[2]string]bool{} // location and key whose newest entry removed them
+	for _, e := range entries {
+		loc := normalizeLocation(e.Location)
+		stock, ok := items[loc]
+		if !ok {
+			stock = map[string]Product{}
+			items[loc] = stock
+		}
+		prod, ok := stock[e.Key]
+		if !ok {
+			prod = newProduct(e.Key)
+		}
+		prod.Value += e.Delta
+		if !e.Time.Before(prod.LastUpdated) {
+			prod.LastUpdated = e.Time
+			removed[[2]string{loc, e.Key}] = e.Action == "restore-remove"
+		}
+		stock[e.Key] = prod
+	}
+	for p, gone := range removed {
+		if gone && items[p[0]][p[1]].Value == 0 {
+			delete(items[p[0]], p[1])
+			if len(items[p[0]]) == 0 {
+				delete(items, p[0])
+			}
+		}
+	}
+	return items
+}
+
+// rebuildFromAudit replaces the inventory with the one the audit file replays
+// to and returns the number of entries replayed. The file is read under the
+// lock, so no change lands between reading it and replacing the inventory,
+// and every change records its entry under the lock too, so none made before
+// the rebuild is missing from it. Aliases are not audited and are kept. The rebuild itself is not audited: replaying the log again arrives
+// at the same inventory.
+func (db *DB_Type) rebuildFromAudit() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if audit.path == "" {
+		return 0, ErrNoAuditLog
+	}
+	entries, err := audit.since(time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, ErrNoAuditLog
+	}
+	db.items = replayAudit(entries)
+	db.notify()
+	return len(entries), nil
+}
+
+// HandleRebuildFromAudit resets the inventory and replays the audit log into
+// it, for when the inventory file is lost but the audit log survives. The
+// current inventory is backed up first when backups are enabled.
+func HandleRebuildFromAudit(w http.ResponseWriter, req *http.Request) {
+	var summary rebuildSummary
+	if backups := configFor(req).Backups; backups.enabled() {
+		saved, err := backups.backup()
+		if err != nil {
+			log.Printf("[%s] backup before rebuild: %v", requestID(req), err)
+			httpError(w, req, "error.backup", http.StatusInternalServerError)
+			return
+		}
+		summary.Backup = saved
+	}
+	n, err := db.rebuildFromAudit()
+	switch {
+	case errors.Is(err, ErrNoAuditLog):
+		httpError(w, req, "error.noAuditLog", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("[%s] rebuild from audit: %v", requestID(req), err)
+		httpError(w, req, "error.readAudit", http.StatusInternalServerError)
+		return
+	}
+	summary.Entries = n
+	summary.Locations = map[string]locationTotal{}
+	for loc, stock := range db.snapshot() {
+		total := locationTotal{Products: len(stock)}
+		for _, prod := range stock {
+			total.Units += prod.Value
+		}
+		summary.Locations[loc] = total
+	}
+	log.Printf("[%s] Inventory rebuilt from %d audit entries (previous inventory saved as %q)", requestID(req), n, summary.Backup)
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"scantron_inventory/utils"
+)
+
+// recalibrateResponse is the JSON body returned by HandleRecalibrate.
+type recalibrateResponse struct {
+	Template ScanTemplate `json:"template"`
+	SheetID  string       `json:"sheetId"`
+	Results  []ScanResult `json:"results"`
+	Blank    bool         `json:"blank"` // no row could be read; see ErrBlankSheet
+	Image    string       `json:"image"` // annotated sheet as a PNG data URL
+}
+
+// HandleRecalibrate re-runs the decoder on the most recent upload with the
+// posted parameters (darkThreshold, thresholdFactor, innerMargin,
+// smudgeCloseness, mode, startRow, endRow, offsetX, offsetY) and returns the
+// results and annotated image. The inventory is not modified.
+func HandleRecalibrate(w http.ResponseWriter, req *http.Request) {
+	data := uploads.latest()
+	if data == nil {
+		httpError(w, req, "error.noUpload", http.StatusConflict)
+		return
+	}
+
+	tmpl := configFor(req).decoding(defaultTemplate)
+	var err error
+	if tmpl.Sections.DarkThreshold, err = formFloat(req, "darkThreshold", tmpl.Sections.DarkThreshold); err != nil {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	if tmpl.Sections.ThresholdFactor, err = formFloat(req, "thresholdFactor", tmpl.Sections.ThresholdFactor); err != nil {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	if tmpl.Sections.InnerMargin, err = formInt(req, "innerMargin", tmpl.Sections.InnerMargin); err != nil || tmpl.Sections.InnerMargin < 0 {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	if tmpl.Sections.SmudgeCloseness, err = formFloat(req, "smudgeCloseness", tmpl.Sections.SmudgeCloseness); err != nil || tmpl.Sections.SmudgeCloseness < 0 || tmpl.Sections.SmudgeCloseness > 1 {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	switch mode := utils.MarkMode(req.FormValue("mode")); mode {
+	case "":
+	case utils.MarkIntensity, utils.MarkColor:
+		tmpl.Sections.Mode = mode
+	default:
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	// startRow and endRow (0-based, inclusive) decode just part of the sheet.
+	start, err := formInt(req, "startRow", 0)
+	if err != nil || start < 0 || start >= tmpl.Rows {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	last, err := formInt(req, "endRow", tmpl.Rows-1)
+	if err != nil || last < start || last >= tmpl.Rows {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	tmpl.Only = RowRange{Start: start, Count: last - start + 1}
+	dx, err := formInt(req, "offsetX", 0)
+	if err != nil {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	dy, err := formInt(req, "offsetY", 0)
+	if err != nil {
+		httpError(w, req, "error.invalidValue", http.StatusBadRequest)
+		return
+	}
+	tmpl = tmpl.Shift(dx, dy)
+
+	sheet, png, err := scanner.Annotate(data, tmpl)
+	if err != nil {
+		httpError(w, req, decodeErrorKey(err), decodeErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recalibrateResponse{
+		Template: tmpl,
+		SheetID:  sheet.ID,
+		Results:  sheet.Results,
+		Blank:    len(sheet.Results) == 0,
+		Image:    "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// formFloat parses an optional float form value, returning def when it is absent.
+func formFloat(req *http.Request, name string, def float64) (float64, error) {
+	v := req.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// formInt parses an optional integer form value, returning def when it is absent.
+func formInt(req *http.Request, name string, def int) (int, error) {
+	v := req.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
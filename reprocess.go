@@ -0,0 +1,199 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// reprocessConfirm must be posted as confirm= to apply a reprocess, since
+// applying rewrites counts that operators may have corrected by hand.
+const reprocessConfirm = "reprocess"
+
+// reprocessChange is how one product's count from the retained sheets would
+// change when they are decoded again.
+type reprocessChange struct {
+	Location string `json:"location"`
+	Key      string `json:"key"`
+	Before   int    `json:"before"` // units the sheets applied
+	After    int    `json:"after"`  // units from the same rows decoded again
+	Delta    int    `json:"delta"`
+}
+
+// reprocessReport is the JSON body returned by HandleReprocess.
+type reprocessReport struct {
+	Uploads int               `json:"uploads"`
+	Skipped []string          `json:"skipped,omitempty"` // uploads applied as full counts, which are not diffed
+	Failed  map[string]string `json:"failed,omitempty"`  // upload ID to decode error
+	Changes []reprocessChange `json:"changes"`
+	Applied bool              `json:"applied"`
+	Backup  string            `json:"backup,omitempty"` // taken before applying
+}
+
+// reprocessed is the outcome of decoding one retained upload again.
+type reprocessed struct {
+	upload retainedUpload
+	tmpl   ScanTemplate
+	sheet  Sheet
+	err    error
+}
+
+// HandleReprocess decodes every retained upload that was applied to the
+// inventory again, with its last template or the one named by template, and
+// reports how the counts its applied rows contributed would change. Uploads
+// applied as full counts are skipped, since they replaced the stock rather
+// than adding to it. With apply=true and confirm=reprocess it backs up the
+// inventory (when backups are enabled), replaces those contributions with the
+// new ones, and records the new results.
+func HandleReprocess(w http.ResponseWriter, req *http.Request) {
+	if err := scanningDisabled(); err != nil {
+		httpError(w, req, "error.noScanner", http.StatusServiceUnavailable)
+		return
+	}
+	cfg := configFor(req)
+	override := req.FormValue("template")
+	if _, ok := cfg.template(override); override != "" && !ok {
+		httpError(w, req, "error.unknownTemplate", http.StatusBadRequest)
+		return
+	}
+	apply, _ := strconv.ParseBool(req.FormValue("apply"))
+	if apply && req.FormValue("confirm") != reprocessConfirm {
+		httpError(w, req, "error.confirmApply", http.StatusBadRequest)
+		return
+	}
+
+	var report reprocessReport
+	var applied []retainedUpload
+	for _, u := range uploads.list() {
+		switch {
+		case len(u.Applied) == 0:
+			continue
+		case slices.ContainsFunc(u.Applied, func(s Sheet) bool { return s.Mode == CountSet }):
+			report.Skipped = append(report.Skipped, u.ID)
+			continue
+		}
+		applied = append(applied, u)
+	}
+	outcomes := make([]reprocessed, len(applied))
+	// -reprocess-workers bounds how many uploads are decoded at once.
+	slots := make(chan struct{}, max(cfg.ReprocessWorkers, 1))
+	var wg sync.WaitGroup
+	for i, u := range applied {
+		name := override
+		if name == "" {
+			name = u.Template
+		}
+		tmpl, ok := cfg.template(name)
+		if !ok {
+			tmpl = cfg.decoding(defaultTemplate)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			sheet, err := redecode(u.Data, tmpl)
+			if err == nil {
+				sheet = reapplicable(finishSheet(sheet, u.ID, u.Applied[0].Location, CountAdd), u.Applied)
+			}
+			outcomes[i] = reprocessed{upload: u, tmpl: tmpl, sheet: sheet, err: err}
+		}()
+	}
+	wg.Wait()
+
+	report.Uploads = len(applied)
+	type productAt struct{ loc, key string }
+	totals := map[productAt]*reprocessChange{}
+	add := func(sheet Sheet, after bool) {
+		loc := normalizeLocation(sheet.Location)
+		for _, r := range sheet.Results {
+			if r.Error != "" {
+				continue
+			}
+			k := productAt{loc, r.Key}
+			if totals[k] == nil {
+				totals[k] = &reprocessChange{Location: loc, Key: r.Key}
+			}
+			if after {
+				totals[k].After += r.Units
+			} else {
+				totals[k].Before += r.Units
+			}
+		}
+	}
+	for _, o := range outcomes {
+		if o.err != nil {
+			if report.Failed == nil {
+				report.Failed = map[string]string{}
+			}
+			report.Failed[o.upload.ID] = o.err.Error()
+			continue
+		}
+		for _, s := range o.upload.Applied {
+			add(s, false)
+		}
+		add(o.sheet, true)
+	}
+	for _, c := range totals {
+		if c.Delta = c.After - c.Before; c.Delta != 0 {
+			report.Changes = append(report.Changes, *c)
+		}
+	}
+	slices.SortFunc(report.Changes, func(a, b reprocessChange) int {
+		return cmp.Or(cmp.Compare(a.Location, b.Location), cmp.Compare(a.Key, b.Key))
+	})
+
+	if apply {
+		if cfg.Backups.enabled() {
+			name, err := cfg.Backups.backup()
+			if err != nil {
+				log.Printf("[%s] backup before reprocess: %v", requestID(req), err)
+				httpError(w, req, "error.backup", http.StatusInternalServerError)
+				return
+			}
+			report.Backup = name
+		}
+		for _, c := range report.Changes {
+			if _, err := db.inc(c.Location, c.Key, c.Delta, "reprocess", ""); errors.Is(err, ErrProductLimit) {
+				alertf("Reprocess: product limit of %d reached; new key %q at %s quarantined for review", db.maxProducts, c.Key, c.Location)
+			}
+		}
+		for _, o := range outcomes {
+			if o.err == nil {
+				uploads.recordDecode(cfg, o.upload.ID, o.tmpl, o.sheet, nil)
+				uploads.replaceApplied(o.sheet)
+			}
+		}
+		report.Applied = true
+		log.Printf("[%s] Reprocessed %d uploads, %d products changed", requestID(req), report.Uploads, len(report.Changes))
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// reapplicable keeps the rows of sheet that applied when its upload was
+// first decoded, so rows held for review or rejected are not counted now.
+func reapplicable(sheet Sheet, applied []Sheet) Sheet {
+	rows := map[int]bool{}
+	for _, s := range applied {
+		for _, r := range s.Results {
+			rows[r.Row] = true
+		}
+	}
+	sheet.Results = slices.DeleteFunc(sheet.Results, func(r ScanResult) bool { return !rows[r.Row] })
+	return sheet
+}
+
+// redecode runs the scanner on retained upload bytes.
+func redecode(data []byte, tmpl ScanTemplate) (Sheet, error) {
+	path, err := writeTempImage(data, "")
+	if err != nil {
+		return Sheet{}, err
+	}
+	defer os.Remove(path)
+	return scanner.Decode(path, tmpl)
+}
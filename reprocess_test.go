@@ -0,0 +1,26 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReapplicable(t *testing.T) {
+	applied := []Sheet{
+		{Results: []ScanResult{{Row: 0, Key: "A", Count: 3}}},
+		{Results: []ScanResult{{Row: 2, Key: "C", Count: 1}}}, // approved from review later
+	}
+	sheet := Sheet{Results: []ScanResult{
+		{Row: 0, Key: "A", Count: 4},
+		{Row: 1, Key: "B", Count: 9}, // held for review and rejected
+		{Row: 2, Key: "C", Count: 1},
+		{Row: 3, Error: "no key"},
+	}}
+	var rows []int
+	for _, r := range reapplicable(sheet, applied).Results {
+		rows = append(rows, r.Row)
+	}
+	if !slices.Equal(rows, []int{0, 2}) {
+		t.Errorf("kept rows %v, want [0 2]", rows)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+)
+
+// ResultHandler receives the ID and results of every applied sheet.
+type ResultHandler func(sheetID string, results []ScanResult)
+
+// resultHandlers holds the registered handlers.
+var resultHandlers struct {
+	mu       sync.RWMutex
+	handlers []ResultHandler
+}
+
+// RegisterResultHandler adds h to the handlers invoked after every applied
+// sheet. Each call runs in its own goroutine with its own copy of the results.
+func RegisterResultHandler(h ResultHandler) {
+	resultHandlers.mu.Lock()
+	defer resultHandlers.mu.Unlock()
+	resultHandlers.handlers = append(resultHandlers.handlers, h)
+}
+
+// dispatchResults applies a decoded sheet to the inventory and hands it to
+// every registered handler.
+func dispatchResults(sheet Sheet) {
+	dispatchSheets([]Sheet{sheet})
+}
+
+// dispatchSheets applies sheets to the inventory together (see applyResults),
+// records each on its upload as applied and then hands each to every
+// registered handler. Applying is not itself a registered handler: it runs
+// first and synchronously, so the dashboard reflects the upload it redirects
+// to, and takes every sheet under one lock, so a session commits at once.
+func dispatchSheets(sheets []Sheet) {
+	applyResults(sheets...)
+
+	resultHandlers.mu.RLock()
+	handlers := slices.Clone(resultHandlers.handlers)
+	resultHandlers.mu.RUnlock()
+
+	for _, sheet := range sheets {
+		uploads.recordApplied(sheet)
+		for _, h := range handlers {
+			go runResultHandler(h, sheet.ID, slices.Clone(sheet.Results))
+		}
+	}
+}
+
+// runResultHandler calls h, logging instead of crashing if it panics.
+func runResultHandler(h ResultHandler, sheetID string, results []ScanResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Result handler for sheet %s panicked: %v", sheetID, r)
+		}
+	}()
+	h(sheetID, results)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+)
+
+// resultsQueueSize bounds how many decoded sheets wait for the results
+// webhook; further sheets are dropped with an alert while it is behind.
+const resultsQueueSize = 100
+
+// resultsWebhook POSTs every decoded upload, applied or not, to a data
+// pipeline. Sheets are sent in order by one background sender, each retried
+// with backoff before it is given up on.
+var resultsWebhook = struct {
+	URL      string // empty disables the webhook
+	Attempts int
+	queue    chan sheetDecodedEvent
+}{Attempts: 5, queue: make(chan sheetDecodedEvent, resultsQueueSize)}
+
+// sheetDecodedEvent is the JSON body POSTed to the results webhook.
+type sheetDecodedEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	UploadID string    `json:"uploadId"`
+	Sheet    Sheet     `json:"sheet"`
+}
+
+// sheetDecoded queues sheet, decoded from upload uploadID, for the results
+// webhook. It never blocks the upload.
+func sheetDecoded(uploadID string, sheet Sheet) {
+	if resultsWebhook.URL == "" {
+		return
+	}
+	sheet.Results = slices.Clone(sheet.Results)
+	select {
+	case resultsWebhook.queue <- sheetDecodedEvent{Event: "sheet-decoded", Time: time.Now(), UploadID: uploadID, Sheet: sheet}:
+	default:
+		alertf("Results webhook is %d sheets behind; dropped sheet %s", resultsQueueSize, sheet.ID)
+	}
+}
+
+// runResultsWebhook sends queued sheets until done is closed.
+func runResultsWebhook(done <-chan struct{}) {
+	for {
+		select {
+		case ev := <-resultsWebhook.queue:
+			err := retry(resultsWebhook.Attempts, time.Second, 30*time.Second, func() error {
+				return sendJSON(http.MethodPost, resultsWebhook.URL, nil, ev)
+			})
+			if err != nil {
+				alertf("Results webhook: giving up on sheet %s: %v", ev.Sheet.ID, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
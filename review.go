@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// reviewConfig configures the file that rejected and low-confidence rows are
+// appended to, for later tuning of templates and thresholds.
+type reviewConfig struct {
+	Path          string  // JSON lines file; empty disables the queue
+	MinConfidence float64 // rows below this confidence are queued
+}
+
+// reviewEntry is one row queued for review. Regions are in the coordinates of
+// the prepared (scaled and, see Orientation, rotated) image.
+type reviewEntry struct {
+	Time        time.Time                  `json:"time"`
+	SheetID     string                     `json:"sheetId"`
+	Orientation int                        `json:"orientation"`
+	Row         int                        `json:"row"`
+	Key         string                     `json:"key,omitempty"`
+	Count       int                        `json:"count"`
+	Confidence  float64                    `json:"confidence"`
+	Reason      string                     `json:"reason"`
+	Regions     map[string]image.Rectangle `json:"regions"`
+	Crops       []string                   `json:"crops,omitempty"` // see ScanResult.Crops
+}
+
+// queueForReview appends the failed, low-confidence and missing rows of a
+// decoded sheet to the review queue of tmpl.Decode.
+func queueForReview(sheet Sheet, tmpl ScanTemplate) {
+	queue := tmpl.Decode.Review
+	if queue.Path == "" {
+		return
+	}
+	now := time.Now()
+	entry := func(row int, reason string) reviewEntry {
+		offset := tmpl.rowOffset(row)
+		regions := make(map[string]image.Rectangle)
+		for _, f := range tmpl.fields() {
+			regions[f.Name] = f.Rect.Add(offset)
+		}
+		if !tmpl.RowMarkerRect.Empty() {
+			regions["marker"] = tmpl.RowMarkerRect.Add(offset)
+		}
+		return reviewEntry{Time: now, SheetID: sheet.ID, Orientation: sheet.Orientation, Row: row, Reason: reason, Regions: regions}
+	}
+
+	var entries []reviewEntry
+	minConfidence := queue.MinConfidence
+	for _, r := range sheet.Results {
+		var reason string
+		switch {
+		case r.Error != "":
+			reason = r.Error
+		case r.Confidence < minConfidence:
+			reason = fmt.Sprintf("confidence %.2f below %.2f", r.Confidence, minConfidence)
+		case len(r.Warnings) > 0:
+			reason = strings.Join(r.Warnings, "; ")
+		default:
+			continue
+		}
+		e := entry(r.Row, reason)
+		e.Key, e.Count, e.Confidence, e.Crops = r.Key, r.Count, r.Confidence, r.Crops
+		entries = append(entries, e)
+	}
+	for _, row := range sheet.MissingRows {
+		entries = append(entries, entry(row, "row marker missing"))
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if err := appendJSONLines(queue.Path, entries); err != nil {
+		alertf("Writing review queue %s failed: %v", queue.Path, err)
+	}
+}
+
+// cropConfig configures where the pixel crops of failed rows are saved.
+type cropConfig struct {
+	Dir  string // one subdirectory per sheet; empty disables crops
+	Keep int    // how many sheet subdirectories to keep
+}
+
+// dir returns the directory for a sheet's crops. Sheet IDs come from QR
+// codes, so anything but a few safe characters is replaced.
+func (c cropConfig) dir(sheetID string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, sheetID)
+	return filepath.Join(c.Dir, strings.TrimLeft(safe, "."))
+}
+
+// pruneSubdirs removes the oldest subdirectories of root beyond keep.
+func pruneSubdirs(root string, keep int) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	type dir struct {
+		name string
+		mod  time.Time
+	}
+	var dirs []dir
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && e.IsDir() {
+			dirs = append(dirs, dir{e.Name(), info.ModTime()})
+		}
+	}
+	if len(dirs) <= keep {
+		return nil
+	}
+	slices.SortFunc(dirs, func(a, b dir) int { return a.mod.Compare(b.mod) })
+	for _, d := range dirs[:len(dirs)-keep] {
+		if err := os.RemoveAll(filepath.Join(root, d.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
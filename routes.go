@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// router registers routes on a ServeMux. For "METHOD /path" patterns it also
+// registers the bare path, so other methods get a 405 listing the allowed
+// ones instead of falling through to the not-found handler.
+type router struct {
+	mux     *http.ServeMux
+	methods map[string][]string // path pattern -> methods registered for it
+}
+
+func newRouter(mux *http.ServeMux) *router {
+	return &router{mux: mux, methods: map[string][]string{}}
+}
+
+// HandleFunc registers h for pattern, as http.ServeMux.HandleFunc does,
+// limited to the -timeout.
+func (r *router) HandleFunc(pattern string, h http.HandlerFunc) {
+	r.handle(pattern, withTimeout(requestTimeout)(h))
+}
+
+// HandleSlowFunc is HandleFunc for routes that upload or decode sheets or
+// call outside services, limited to the -slow-timeout.
+func (r *router) HandleSlowFunc(pattern string, h http.HandlerFunc) {
+	r.handle(pattern, withTimeout(slowTimeout)(h))
+}
+
+// HandleStreamFunc is HandleSlowFunc for routes that stream a long response
+// as they build it. They get a context deadline instead of withTimeout,
+// which would buffer the whole response, and must stop once it passes.
+func (r *router) HandleStreamFunc(pattern string, h http.HandlerFunc) {
+	r.handle(pattern, withDeadline(slowTimeout)(h))
+}
+
+func (r *router) handle(pattern string, h http.Handler) {
+	r.mux.Handle(pattern, h)
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		return
+	}
+	if _, seen := r.methods[path]; !seen {
+		r.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			methodNotAllowed(w, req, r.methods[path])
+		})
+	}
+	r.methods[path] = append(r.methods[path], method)
+	if method == http.MethodGet {
+		r.methods[path] = append(r.methods[path], http.MethodHead)
+	}
+}
+
+// apiError is the JSON body of API error replies.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// replyError sends the translated message for key with the status code:
+// as an apiError to API requests and as plain text to everything else.
+func replyError(w http.ResponseWriter, req *http.Request, key string, code int) {
+	if strings.HasPrefix(req.URL.Path, "/api/") {
+		msg := translate(localeFor(req), key)
+		if id := requestID(req); id != "" {
+			msg += " (request " + id + ")"
+		}
+		writeJSON(w, code, apiError{Error: msg})
+		return
+	}
+	httpError(w, req, key, code)
+}
+
+// HandleNotFound answers requests that match no route.
+func HandleNotFound(w http.ResponseWriter, req *http.Request) {
+	replyError(w, req, "error.notFound", http.StatusNotFound)
+}
+
+// methodNotAllowed answers a request whose path exists but not for its method.
+func methodNotAllowed(w http.ResponseWriter, req *http.Request, allowed []string) {
+	w.Header().Set("Allow", strings.Join(slices.Compact(slices.Sorted(slices.Values(allowed))), ", "))
+	replyError(w, req, "error.method", http.StatusMethodNotAllowed)
+}
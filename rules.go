@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// RuleAction decides what breaking a SheetRule does.
+type RuleAction string
+
+const (
+	RuleWarn   RuleAction = "warn"   // report the violation and apply the sheet anyway (the default)
+	RuleReject RuleAction = "reject" // apply nothing from the sheet, like -all-or-nothing
+)
+
+// SheetRule is a business rule every decoded sheet is checked against before
+// it is applied. A rule either bounds the count of one product (Key with Min
+// and/or Max) or lists products that must not share a sheet (Exclusive).
+type SheetRule struct {
+	Name   string     `json:"name"`
+	Action RuleAction `json:"action,omitempty"`
+
+	// Key, Min and Max bound the total count the sheet's rows give Key, as
+	// decoded before pack sizes. Sheets without the key are not checked.
+	Key string `json:"key,omitempty"`
+	Min *int   `json:"min,omitempty"`
+	Max *int   `json:"max,omitempty"`
+
+	// Exclusive lists keys at most one of which may appear on a sheet.
+	Exclusive []string `json:"exclusive,omitempty"`
+}
+
+// RuleViolation is a SheetRule a sheet broke.
+type RuleViolation struct {
+	Rule    string `json:"rule"`
+	Reject  bool   `json:"reject"` // the rule's action is RuleReject
+	Message string `json:"message"`
+	Rows    []int  `json:"rows"` // the rows involved
+}
+
+// ErrRuleViolation is returned for a sheet that broke a rule whose action is
+// RuleReject. None of its rows are applied.
+var ErrRuleViolation = errors.New("sheet rejected by validation rules")
+
+// sheetRules are loaded once at startup from the -rules file and read-only
+// after.
+var sheetRules []SheetRule
+
+// loadRules reads a JSON array of SheetRules, such as
+//
+//	[{"name": "fragile cap", "key": "SKU-FRAGILE", "max": 50, "action": "reject"},
+//	 {"name": "one size", "exclusive": ["CUP-S", "CUP-L"]}]
+func loadRules(path string) ([]SheetRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []SheetRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range rules {
+		if rules[i].Action == "" {
+			rules[i].Action = RuleWarn
+		}
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i, err)
+		}
+	}
+	return rules, nil
+}
+
+// validate checks that the rule has a name, a known action and exactly one
+// kind of check.
+func (r SheetRule) validate() error {
+	switch {
+	case r.Name == "":
+		return errors.New("name is required")
+	case r.Action != RuleWarn && r.Action != RuleReject:
+		return fmt.Errorf("unknown action %q (want warn or reject)", r.Action)
+	case r.Key != "" && len(r.Exclusive) > 0:
+		return errors.New("key and exclusive are mutually exclusive")
+	case r.Key != "" && r.Min == nil && r.Max == nil:
+		return errors.New("a key rule needs min or max")
+	case r.Key != "" && r.Min != nil && r.Max != nil && *r.Min > *r.Max:
+		return errors.New("min is above max")
+	case r.Key == "" && (r.Min != nil || r.Max != nil):
+		return errors.New("min and max need a key")
+	case r.Key == "" && len(r.Exclusive) < 2:
+		return errors.New("one of key or at least two exclusive keys is required")
+	}
+	return nil
+}
+
+// check returns the rule's violation by sheet, if it breaks it. Failed rows
+// are left out; -all-or-nothing decides about those.
+func (r SheetRule) check(sheet Sheet) (RuleViolation, bool) {
+	v := RuleViolation{Rule: r.Name, Reject: r.Action == RuleReject}
+	if r.Key != "" {
+		total := 0
+		for _, res := range sheet.Results {
+			if res.Error == "" && res.Key == r.Key {
+				total += res.Count
+				v.Rows = append(v.Rows, res.Row)
+			}
+		}
+		switch {
+		case v.Rows == nil:
+			return v, false
+		case r.Max != nil && total > *r.Max:
+			v.Message = fmt.Sprintf("%s: %s counts %d, more than %d", r.Name, r.Key, total, *r.Max)
+		case r.Min != nil && total < *r.Min:
+			v.Message = fmt.Sprintf("%s: %s counts %d, fewer than %d", r.Name, r.Key, total, *r.Min)
+		default:
+			return v, false
+		}
+		return v, true
+	}
+	var found []string
+	for _, res := range sheet.Results {
+		if res.Error == "" && slices.Contains(r.Exclusive, res.Key) {
+			if !slices.Contains(found, res.Key) {
+				found = append(found, res.Key)
+			}
+			v.Rows = append(v.Rows, res.Row)
+		}
+	}
+	if len(found) < 2 {
+		return v, false
+	}
+	v.Message = fmt.Sprintf("%s: %s may not appear on the same sheet", r.Name, strings.Join(found, ", "))
+	return v, true
+}
+
+// checkRules returns the violations of every rule by sheet, in rule order.
+func checkRules(sheet Sheet) []RuleViolation {
+	var out []RuleViolation
+	for _, r := range sheetRules {
+		if v, ok := r.check(sheet); ok {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// rejectedByRules reports whether the sheet broke a rule that rejects it.
+func (s Sheet) rejectedByRules() bool {
+	return slices.ContainsFunc(s.Violations, func(v RuleViolation) bool { return v.Reject })
+}
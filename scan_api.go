@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"scantron_inventory/utils"
+)
+
+// maxScanImageBytes bounds the decoded image size accepted by /api/scan.
+const maxScanImageBytes = 10 << 20
+
+// scanRequest is the JSON body accepted by HandleAPIScan.
+type scanRequest struct {
+	Image    string `json:"image"`    // data:image/...;base64,... URL
+	Template string `json:"template"` // template name; empty for the default
+	Apply    bool   `json:"apply"`    // apply the results to the inventory
+	Location string `json:"location"` // inventory to apply to, unless the sheet names one
+	Mode     string `json:"mode"`     // "add" or "set"; empty for the template's
+}
+
+// scanResponse is the JSON body returned by HandleAPIScan.
+type scanResponse struct {
+	UploadID   string          `json:"uploadId"` // for POST /uploads/{id}/redecode
+	SheetID    string          `json:"sheetId"`
+	Location   string          `json:"location"`
+	Results    []ScanResult    `json:"results"`
+	Violations []RuleViolation `json:"violations,omitempty"` // see -rules
+	Confidence confidenceStats `json:"confidence"`
+	Applied    bool            `json:"applied"`
+	// Staged is set when -commit-policy held rows back for an operator to
+	// confirm; with confident, the other rows were applied.
+	Staged bool   `json:"staged,omitempty"`
+	Error  string `json:"error,omitempty"` // why the results were not applied
+}
+
+// HandleAPIScan decodes a sheet posted as a base64 data URL and returns its
+// results, applying them to the inventory when requested.
+func HandleAPIScan(w http.ResponseWriter, req *http.Request) {
+	// Base64 inflates the payload by 4/3; leave room for the other fields.
+	req.Body = http.MaxBytesReader(w, req.Body, maxScanImageBytes*4/3+4096)
+	var body scanRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, req, "error.imageTooLarge", http.StatusRequestEntityTooLarge)
+			return
+		}
+		httpError(w, req, "error.invalidJSON", http.StatusBadRequest)
+		return
+	}
+	cfg := configFor(req)
+	tmpl, ok := cfg.template(body.Template)
+	if !ok {
+		httpError(w, req, "error.unknownTemplate", http.StatusBadRequest)
+		return
+	}
+	mode, err := countModeFor(body.Mode, tmpl)
+	if err != nil {
+		httpError(w, req, "error.invalidMode", http.StatusBadRequest)
+		return
+	}
+	data, err := decodeDataURL(body.Image)
+	if err != nil {
+		httpError(w, req, "error.invalidImage", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxScanImageBytes {
+		httpError(w, req, "error.imageTooLarge", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// The data URL's media type is as untrustworthy as a file name.
+	format, err := utils.DetectImageFormat(bytes.NewReader(data))
+	if err != nil {
+		httpError(w, req, "error.notImage", http.StatusUnsupportedMediaType)
+		return
+	}
+	uploadID := uploads.add(cfg, data, normalizeLocation(body.Location))
+
+	path, err := writeTempImage(data, format)
+	if err != nil {
+		httpError(w, req, "error.tempFile", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(path)
+
+	sheet, err := scanner.Decode(path, tmpl)
+	uploads.recordDecode(cfg, uploadID, tmpl, sheet, err)
+	watchdog.observe(cfg.Watchdog, sheet, err)
+	if err != nil {
+		httpError(w, req, decodeErrorKey(err), decodeErrorStatus(err))
+		return
+	}
+	if abandoned(req) {
+		return
+	}
+	sheet = finishSheet(sheet, uploadID, normalizeLocation(body.Location), mode)
+	sheetDecoded(uploadID, sheet)
+	writeScanResponse(w, cfg.Commit, uploadID, sheet, body.Apply)
+}
+
+// writeScanResponse commits sheet when apply is set, then replies with its
+// results; see scanReply.
+func writeScanResponse(w http.ResponseWriter, c commitConfig, uploadID string, sheet Sheet, apply bool) {
+	resp, status := scanReply(c, uploadID, sheet, apply)
+	writeJSON(w, status, resp)
+}
+
+// scanReply commits sheet through commitSheet with c when apply is set, so
+// the commit policy holds for API clients too, and returns the reply
+// describing it with its status code.
+func scanReply(c commitConfig, uploadID string, sheet Sheet, apply bool) (scanResponse, int) {
+	resp := scanResponse{
+		UploadID:   uploadID,
+		SheetID:    sheet.ID,
+		Location:   sheet.Location,
+		Results:    sheet.Results,
+		Violations: sheet.Violations,
+		Confidence: summarizeConfidence(sheet.Results),
+	}
+	status := http.StatusOK
+	if apply {
+		staged, err := commitSheet(sheet, c)
+		switch {
+		case err != nil:
+			resp.Error, status = err.Error(), http.StatusUnprocessableEntity
+		case staged:
+			resp.Staged = true
+		default:
+			resp.Applied = true
+		}
+	}
+	return resp, status
+}
+
+// decodeDataURL returns the bytes of a base64 encoded image data URL.
+func decodeDataURL(s string) ([]byte, error) {
+	meta, payload, ok := strings.Cut(s, ",")
+	if !ok || !strings.HasPrefix(meta, "data:image/") || !strings.HasSuffix(meta, ";base64") {
+		return nil, errors.New("not a base64 image data URL")
+	}
+	return base64.StdEncoding.DecodeString(payload)
+}
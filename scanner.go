@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Scanner reads scantron images. The OpenCV implementation is compiled in
+// unless the nocv build tag is set; without it, or when OpenCV fails to
+// initialize, a disabled scanner lets the dashboard, manual entry and API
+// run with scanning turned off.
+type Scanner interface {
+	// Decode reads the sheet image at path (see DecodeDocument).
+	Decode(path string, tmpl ScanTemplate) (Sheet, error)
+	// DecodeData decodes image bytes like Decode, but without its side
+	// effects: the sheet is not counted, annotated, cropped or queued for
+	// review.
+	DecodeData(data []byte, tmpl ScanTemplate) (Sheet, error)
+	// Annotate decodes image bytes and also returns the annotated sheet as PNG.
+	Annotate(data []byte, tmpl ScanTemplate) (Sheet, []byte, error)
+	// SelfTest decodes a generated sample sheet and reports each stage.
+	SelfTest(tmpl ScanTemplate) []diagCheck
+	// WriteSample writes a generated sample sheet to path.
+	WriteSample(path string, tmpl ScanTemplate) error
+	// Thumbnail returns image bytes downscaled to fit maxSide pixels, as
+	// JPEG. Images beyond limits are refused.
+	Thumbnail(data []byte, maxSide int, limits dimensionLimits) ([]byte, error)
+	// ReadQR decodes the single QR code that fills image bytes. Images
+	// beyond limits are refused.
+	ReadQR(data []byte, limits dimensionLimits) (string, error)
+}
+
+// scanner is the Scanner used by every handler.
+var scanner = newScanner()
+
+// ErrScanningDisabled is returned by every method of a disabled scanner.
+var ErrScanningDisabled = errors.New("scanning is disabled")
+
+// errEncodeImage is returned when the annotated sheet cannot be encoded.
+var errEncodeImage = errors.New("error encoding the annotated image")
+
+// disabledScanner refuses every scan, explaining why.
+type disabledScanner struct {
+	reason error
+}
+
+func (d disabledScanner) err() error {
+	return fmt.Errorf("%w: %v", ErrScanningDisabled, d.reason)
+}
+
+func (d disabledScanner) Decode(string, ScanTemplate) (Sheet, error) {
+	return Sheet{}, d.err()
+}
+
+func (d disabledScanner) DecodeData([]byte, ScanTemplate) (Sheet, error) {
+	return Sheet{}, d.err()
+}
+
+func (d disabledScanner) Annotate([]byte, ScanTemplate) (Sheet, []byte, error) {
+	return Sheet{}, nil, d.err()
+}
+
+func (d disabledScanner) SelfTest(ScanTemplate) []diagCheck {
+	return []diagCheck{{Name: "scanner available", Detail: d.reason.Error()}}
+}
+
+func (d disabledScanner) WriteSample(string, ScanTemplate) error {
+	return d.err()
+}
+
+func (d disabledScanner) Thumbnail([]byte, int, dimensionLimits) ([]byte, error) {
+	return nil, d.err()
+}
+
+func (d disabledScanner) ReadQR([]byte, dimensionLimits) (string, error) {
+	return "", d.err()
+}
+
+// scanningDisabled returns why scanning is off, or nil when it works.
+func scanningDisabled() error {
+	if d, ok := scanner.(disabledScanner); ok {
+		return d.reason
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "sync/atomic"
+
+// scanCounter counts the sheets decoded successfully, since the server started
+// and over its lifetime. The lifetime count is persisted with the inventory.
+type scanCounter struct {
+	session  atomic.Int64
+	lifetime atomic.Int64
+}
+
+var scans scanCounter
+
+// add counts one decoded sheet and schedules a save of the lifetime count.
+func (c *scanCounter) add() {
+	c.session.Add(1)
+	c.lifetime.Add(1)
+	db.notify()
+}
+
+// storedState is the snapshot the persister and backups save.
+func storedState() StoredState {
+	return StoredState{Items: db.snapshot(), Aliases: db.snapshotAliases(), Scans: scans.lifetime.Load()}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// diagCheck is one line of the self-test checklist.
+type diagCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// printChecklist writes checks as a red/green checklist and reports whether all passed.
+func printChecklist(w io.Writer, checks []diagCheck) bool {
+	passed := true
+	for _, c := range checks {
+		mark := "\033[32m[ OK ]\033[0m"
+		if !c.OK {
+			mark = "\033[31m[FAIL]\033[0m"
+			passed = false
+		}
+		fmt.Fprintf(w, "%s %s", mark, c.Name)
+		if c.Detail != "" {
+			fmt.Fprintf(w, ": %s", c.Detail)
+		}
+		fmt.Fprintln(w)
+	}
+	return passed
+}
+
+// printDecode decodes the sheet image at path and writes its results to w as
+// a JSON array. Rows that could not be read are included with their error.
+// Whatever was read is printed even when the decode fails (for example with
+// ErrBlankSheet); the error is returned afterwards.
+func printDecode(w io.Writer, path string, tmpl ScanTemplate) error {
+	sheet, err := scanner.Decode(path, tmpl)
+	results := sheet.Results
+	if results == nil {
+		results = []ScanResult{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if encErr := enc.Encode(results); encErr != nil {
+		return encErr
+	}
+	return err
+}
+
+// HandleDiag runs the self test and returns the checklist as JSON.
+func HandleDiag(w http.ResponseWriter, req *http.Request) {
+	checks := scanner.SelfTest(configFor(req).decoding(defaultTemplate))
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, checks)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long in-flight requests may run after a stop signal.
+const shutdownTimeout = 10 * time.Second
+
+// tlsConfig selects between plain HTTP and HTTPS serving.
+type tlsConfig struct {
+	CertFile     string
+	KeyFile      string
+	RedirectAddr string // if set, plain HTTP on this address redirects to HTTPS
+}
+
+// enabled reports whether a certificate and key were configured.
+func (c tlsConfig) enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// runServer serves srv until SIGINT/SIGTERM, then shuts it down gracefully.
+// With TLS configured it serves HTTPS and optionally an HTTP->HTTPS redirect.
+func runServer(srv *http.Server, tls tlsConfig) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	servers := []*http.Server{srv}
+	errc := make(chan error, 2)
+	if tls.enabled() {
+		if tls.RedirectAddr != "" {
+			redirect := &http.Server{Addr: tls.RedirectAddr, Handler: httpsRedirect(srv.Addr)}
+			servers = append(servers, redirect)
+			go func() { errc <- redirect.ListenAndServe() }()
+			fmt.Printf("Redirecting HTTP on %s to HTTPS...\n", tls.RedirectAddr)
+		}
+		go func() { errc <- srv.ListenAndServeTLS(tls.CertFile, tls.KeyFile) }()
+		fmt.Printf("Server started with TLS on %s...\n", srv.Addr)
+	} else {
+		go func() { errc <- srv.ListenAndServe() }()
+		fmt.Printf("Server started on %s...\n", srv.Addr)
+	}
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	case <-ctx.Done():
+		log.Println("Shutting down...")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var errs []error
+	for _, s := range servers {
+		errs = append(errs, s.Shutdown(shutdownCtx))
+	}
+	return errors.Join(errs...)
+}
+
+// httpsRedirect sends every request to the same host and path over HTTPS,
+// using the port of tlsAddr unless it is the default 443.
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ScanSession collects the sheets of one delivery so they can be reviewed
+// and committed or discarded together instead of each applying on upload.
+type ScanSession struct {
+	ID       string
+	Location string // where the session was started; sheets may name others
+	Started  time.Time
+	Sheets   []Sheet
+}
+
+// sessionTotal is the units a session adds to one product.
+type sessionTotal struct {
+	Location string
+	Key      string
+	Units    int
+	Set      bool // a count sheet set the product to Units plus any later additions
+	Sheets   int  // how many sheets of the session read the key
+}
+
+// Totals sums the valid rows of every sheet in the session per location and
+// key, in upload order, sorted by location then key. A full count sheet
+// (CountSet) replaces what earlier sheets added.
+func (s ScanSession) Totals() []sessionTotal {
+	type locKey struct{ loc, key string }
+	byKey := make(map[locKey]*sessionTotal)
+	for _, sheet := range s.Sheets {
+		loc := normalizeLocation(sheet.Location)
+		seen := make(map[string]bool)
+		for _, r := range sheet.Results {
+			set := sheet.Mode == CountSet
+			if r.Error != "" || r.Key == "" || r.Count == 0 && !set {
+				continue
+			}
+			t := byKey[locKey{loc, r.Key}]
+			if t == nil {
+				t = &sessionTotal{Location: loc, Key: r.Key}
+				byKey[locKey{loc, r.Key}] = t
+			}
+			if set && !seen[r.Key] {
+				t.Units, t.Set = 0, true
+			}
+			t.Units += r.Units
+			if !seen[r.Key] {
+				seen[r.Key] = true
+				t.Sheets++
+			}
+		}
+	}
+	out := make([]sessionTotal, 0, len(byKey))
+	for _, t := range byKey {
+		out = append(out, *t)
+	}
+	slices.SortFunc(out, func(a, b sessionTotal) int {
+		return cmp.Or(cmp.Compare(a.Location, b.Location), cmp.Compare(a.Key, b.Key))
+	})
+	return out
+}
+
+// sessionRegistry holds the open sessions, oldest first.
+type sessionRegistry struct {
+	mu    sync.Mutex
+	items []ScanSession
+}
+
+var scanSessions sessionRegistry
+
+// start opens an empty session at loc and returns its ID.
+func (r *sessionRegistry) start(loc string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, ScanSession{ID: id, Location: loc, Started: time.Now()})
+	return id
+}
+
+// get returns a copy of the open session with the given ID.
+func (r *sessionRegistry) get(id string) (ScanSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.items, func(s ScanSession) bool { return s.ID == id })
+	if i < 0 {
+		return ScanSession{}, false
+	}
+	s := r.items[i]
+	s.Sheets = slices.Clone(s.Sheets)
+	return s, true
+}
+
+// add appends sheet to the open session with the given ID, reporting false
+// when there is none.
+func (r *sessionRegistry) add(id string, sheet Sheet) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.items, func(s ScanSession) bool { return s.ID == id })
+	if i < 0 {
+		return false
+	}
+	r.items[i].Sheets = append(r.items[i].Sheets, sheet)
+	return true
+}
+
+// list returns the open sessions, oldest first.
+func (r *sessionRegistry) list() []ScanSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.items)
+}
+
+// take closes and returns the session with the given ID.
+func (r *sessionRegistry) take(id string) (ScanSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.items, func(s ScanSession) bool { return s.ID == id })
+	if i < 0 {
+		return ScanSession{}, false
+	}
+	s := r.items[i]
+	r.items = slices.Delete(r.items, i, i+1)
+	return s, true
+}
+
+// takeValid closes and returns the session with the given ID if every sheet
+// in it still passes checkSheet with c, which may have changed with the
+// settings since the sheet was scanned. Otherwise the session stays open and
+// the first failure is returned.
+func (r *sessionRegistry) takeValid(id string, c commitConfig) (ScanSession, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.items, func(s ScanSession) bool { return s.ID == id })
+	if i < 0 {
+		return ScanSession{}, false, nil
+	}
+	s := r.items[i]
+	for _, sheet := range s.Sheets {
+		if err := checkSheet(sheet, c); err != nil {
+			return s, true, fmt.Errorf("sheet %s: %w", sheet.ID, err)
+		}
+	}
+	r.items = slices.Delete(r.items, i, i+1)
+	return s, true, nil
+}
+
+// sessionUploadURL is the upload page for adding sheets to a session.
+func sessionUploadURL(s ScanSession) string {
+	return "/upload?" + url.Values{"location": {s.Location}, "session": {s.ID}}.Encode()
+}
+
+// HandleStartSession opens a session at ?location= and sends the operator to
+// the upload page to scan into it.
+func HandleStartSession(w http.ResponseWriter, req *http.Request) {
+	id := scanSessions.start(locationFor(req))
+	s, _ := scanSessions.get(id)
+	http.Redirect(w, req, sessionUploadURL(s), http.StatusSeeOther)
+}
+
+// HandleCommitSession closes a session and applies all of its sheets at once,
+// unless one of them no longer passes checkSheet.
+func HandleCommitSession(w http.ResponseWriter, req *http.Request) {
+	s, ok, err := scanSessions.takeValid(req.PathValue("id"), configFor(req).Commit)
+	if !ok {
+		httpError(w, req, "error.noSession", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] session %s not committed: %v", requestID(req), s.ID, err)
+		httpError(w, req, "error.sessionRejected", http.StatusUnprocessableEntity)
+		return
+	}
+	dispatchSheets(s.Sheets)
+	http.Redirect(w, req, dashboardURL(s.Location), http.StatusSeeOther)
+}
+
+// HandleDiscardSession closes a session without applying any of its sheets.
+func HandleDiscardSession(w http.ResponseWriter, req *http.Request) {
+	s, ok := scanSessions.take(req.PathValue("id"))
+	if !ok {
+		httpError(w, req, "error.noSession", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, req, dashboardURL(s.Location), http.StatusSeeOther)
+}
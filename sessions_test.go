@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestApplySheetsMatchesSessionTotals(t *testing.T) {
+	d := &DB_Type{items: Inventory{"a": {"SKU-1": {Name: "SKU-1", Value: 50}}}, changed: make(chan struct{}, 1)}
+	s := ScanSession{Sheets: []Sheet{
+		{ID: "s1", Location: "a", Mode: CountAdd, Results: []ScanResult{
+			{Row: 0, Key: "SKU-1", Count: 2, Units: 2},
+			{Row: 1, Key: "SKU-2", Count: 5, Units: 5},
+			{Row: 2, Error: "unreadable"},
+		}},
+		{ID: "s2", Location: "a", Mode: CountSet, Results: []ScanResult{{Row: 0, Key: "SKU-1", Count: 7, Units: 7}}},
+		{ID: "s3", Location: "a", Mode: CountAdd, Results: []ScanResult{{Row: 0, Key: "SKU-1", Count: 1, Units: 1}}},
+	}}
+	d.applySheets(s.Sheets)
+	for _, total := range s.Totals() {
+		want := total.Units
+		if !total.Set {
+			want += map[string]int{"SKU-1": 50}[total.Key]
+		}
+		if got := d.items[total.Location][total.Key].Value; got != want {
+			t.Errorf("%s/%s = %d, want %d", total.Location, total.Key, got, want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// settingsMu serializes the settings page's changes to the Config and its
+// config file. Readers don't take it: requests read the Config withConfig
+// loaded for them, background work the one in force.
+var settingsMu sync.Mutex
+
+// settingsPage configures the /settings page.
+var settingsPage = struct {
+	ConfigPath string          // the -config file changes are saved to; empty keeps them until restart
+	pinned     map[string]bool // flags set on the command line or through the environment
+}{}
+
+// hotSettings name the flags the settings page may change while the server
+// runs. They are safe to change without a restart because each request
+// reads them from the Config loaded when it arrived rather than from values
+// captured at startup; a change applies from the next request. The flag
+// name is also the form field and config file key.
+var hotSettings = []string{
+	"template",
+	"commit-policy",
+	"commit-min-confidence",
+	"all-or-nothing",
+	"duplicate-keys",
+	"review-below",
+	"blank-tens-fill",
+	"require-sheet-id",
+	"watchdog-threshold",
+	"watchdog-window",
+	"watchdog-webhook",
+	"new-product-webhook",
+	"expiry-warning",
+	"backup-keep",
+	"crop-keep",
+	"upload-keep",
+}
+
+// pinSettings records which flags were set on the command line or through
+// their environment variable, which take precedence over the config file, so
+// the page can warn that changing them lasts only until a restart. It must
+// run after flag.Parse and before the config file is loaded.
+func pinSettings() {
+	settingsPage.pinned = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { settingsPage.pinned[f.Name] = true })
+	for name, env := range flagEnv {
+		if _, set := os.LookupEnv(env); set {
+			settingsPage.pinned[name] = true
+		}
+	}
+}
+
+// applySettings returns a copy of cur with every hot setting whose value in
+// form differs from its current one changed, and the new values by flag
+// name. A missing bool setting is an unchecked box and means false. If any
+// value is rejected, an error is returned and cur stays as it was.
+func applySettings(cur *Config, form url.Values) (*Config, map[string]string, error) {
+	next := *cur
+	flags := next.flagSet()
+	changed := map[string]string{}
+	for _, name := range hotSettings {
+		f := flags.Lookup(name)
+		v := form.Get(name)
+		if isBoolFlag(f) {
+			v = strconv.FormatBool(v != "")
+		} else if !form.Has(name) {
+			continue
+		}
+		if v == f.Value.String() {
+			continue
+		}
+		if err := flags.Set(name, v); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		changed[name] = f.Value.String()
+	}
+	if err := next.validate(); err != nil {
+		return nil, nil, err
+	}
+	return &next, changed, nil
+}
+
+// isBoolFlag reports whether f is a flag that takes no value, like -all-or-nothing.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// saveSettings writes changed into the config file at path, keeping the
+// settings already in it, so the changes survive a restart. Numbers and
+// booleans are written as JSON numbers and booleans, as loadConfigFile reads
+// them back.
+func saveSettings(path string, changed map[string]string) error {
+	values := map[string]any{}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	flags := defaultConfig().flagSet()
+	for name, v := range changed {
+		if b, err := strconv.ParseBool(v); err == nil && isBoolFlag(flags.Lookup(name)) {
+			values[name] = b
+		} else if n, err := strconv.ParseFloat(v, 64); err == nil {
+			values[name] = n
+		} else {
+			values[name] = v
+		}
+	}
+	if data, err = json.MarshalIndent(values, "", "  "); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// requireAdmin lets requests through to h only with the -admin-password,
+// given with HTTP basic auth under any user name. Without a password set
+// admin pages are not served at all.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		want := configFor(req).AdminPassword
+		if want == "" {
+			httpError(w, req, "error.noAdminPassword", http.StatusForbidden)
+			return
+		}
+		_, password, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="settings", charset="UTF-8"`)
+			httpError(w, req, "error.unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// settingRow is one setting as shown on the settings page.
+type settingRow struct {
+	Name   string
+	Value  string
+	Usage  string
+	Bool   bool
+	Pinned bool // set on the command line or environment; see pinSettings
+}
+
+// HandleSettings shows the hot settings with their current values.
+func HandleSettings(w http.ResponseWriter, req *http.Request) {
+	renderSettings(w, req, http.StatusOK, req.FormValue("saved") != "", "")
+}
+
+// HandleUpdateSettings applies the posted settings to the running server and
+// saves them to the -config file.
+func HandleUpdateSettings(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		httpError(w, req, "error.parseForm", http.StatusBadRequest)
+		return
+	}
+	// The lock is held while saving too, so two posts can't interleave
+	// their read and write of the config file.
+	settingsMu.Lock()
+	next, changed, err := applySettings(currentConfig(), req.PostForm)
+	var saveErr error
+	if err == nil && len(changed) > 0 {
+		liveConfig.Store(next)
+		if settingsPage.ConfigPath != "" {
+			saveErr = saveSettings(settingsPage.ConfigPath, changed)
+		}
+	}
+	settingsMu.Unlock()
+	if err != nil {
+		renderSettings(w, req, http.StatusBadRequest, false, err.Error())
+		return
+	}
+	if len(changed) > 0 {
+		log.Printf("[%s] Settings changed: %v", requestID(req), changed)
+	}
+	if saveErr != nil {
+		log.Printf("[%s] saving settings: %v", requestID(req), saveErr)
+		renderSettings(w, req, http.StatusInternalServerError, false, translate(localeFor(req), "settings.notSaved", saveErr))
+		return
+	}
+	http.Redirect(w, req, "/settings?saved=1", http.StatusSeeOther)
+}
+
+// renderSettings renders the settings page with an optional confirmation or
+// error message.
+func renderSettings(w http.ResponseWriter, req *http.Request, status int, saved bool, errMsg string) {
+	data := struct {
+		Lang       string
+		Settings   []settingRow
+		Templates  []string
+		ConfigPath string
+		Saved      bool
+		Error      string
+	}{
+		Lang:       localeFor(req),
+		Templates:  scanTemplates.names(),
+		ConfigPath: settingsPage.ConfigPath,
+		Saved:      saved,
+		Error:      errMsg,
+	}
+	flags := currentConfig().flagSet()
+	for _, name := range hotSettings {
+		f := flags.Lookup(name)
+		data.Settings = append(data.Settings, settingRow{
+			Name:   name,
+			Value:  f.Value.String(),
+			Usage:  f.Usage,
+			Bool:   isBoolFlag(f),
+			Pinned: settingsPage.pinned[name],
+		})
+	}
+	var buf bytes.Buffer
+	if err := settingsTemplate.Execute(&buf, data); err != nil {
+		httpError(w, req, "error.renderTemplate", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// skuName is what a product created on the fly is called.
+type skuName struct {
+	Name     string
+	Category string
+}
+
+// skuNames maps product keys to the name, and optionally the category, that
+// products created by scans or adjustments start with instead of their key.
+// It is loaded once at startup from the -sku-names file and read-only after.
+var skuNames map[string]skuName
+
+// loadSKUNames reads a CSV file of key,name[,category] lines. Blank lines,
+// lines starting with # and a "key,name" header are skipped.
+func loadSKUNames(path string) (map[string]skuName, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	names := map[string]skuName{}
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		line, _ := r.FieldPos(0)
+		if len(rec) < 2 || len(rec) > 3 {
+			return nil, fmt.Errorf("%s: line %d: want key,name or key,name,category", path, line)
+		}
+		key, name := strings.TrimSpace(rec[0]), strings.TrimSpace(rec[1])
+		if len(names) == 0 && strings.EqualFold(key, "key") && strings.EqualFold(name, "name") {
+			continue
+		}
+		if key == "" || name == "" {
+			return nil, fmt.Errorf("%s: line %d: key and name are required", path, line)
+		}
+		n := skuName{Name: name}
+		if len(rec) == 3 {
+			n.Category = strings.TrimSpace(rec[2])
+		}
+		names[key] = n
+	}
+}
+
+// newProduct returns a product created for key: named from skuNames when it
+// is listed there and after its key otherwise.
+func newProduct(key string) Product {
+	if n, ok := skuNames[key]; ok {
+		return Product{Name: n.Name, Category: n.Category}
+	}
+	return Product{Name: key}
+}
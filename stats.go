@@ -0,0 +1,59 @@
+package main
+
+import "net/http"
+
+// confidenceBuckets is the number of equal-width histogram buckets over [0, 1].
+const confidenceBuckets = 10
+
+// confidenceStats summarizes the per-row confidences of one or more sheets.
+type confidenceStats struct {
+	Sheets      int                    `json:"sheets"`
+	Unreadable  int                    `json:"unreadable"` // sheets with no readable row
+	Rows        int                    `json:"rows"`
+	Failed      int                    `json:"failed"` // rows with an error
+	FailureRate float64                `json:"failureRate"`
+	Mean        float64                `json:"meanConfidence"` // over rows without an error
+	Histogram   [confidenceBuckets]int `json:"histogram"`      // bucket i counts confidences in [i/10, (i+1)/10)
+
+	sum float64 // of the confidences behind Mean
+}
+
+// summarizeConfidence computes the confidence distribution of one sheet.
+func summarizeConfidence(results []ScanResult) confidenceStats {
+	var s confidenceStats
+	s.add(results)
+	return s
+}
+
+// add folds the rows of one sheet into s.
+func (s *confidenceStats) add(results []ScanResult) {
+	s.Sheets++
+	if len(results) == 0 {
+		s.Unreadable++
+	}
+	for _, r := range results {
+		s.Rows++
+		if r.Error != "" {
+			s.Failed++
+			continue
+		}
+		s.sum += r.Confidence
+		s.Histogram[min(int(r.Confidence*confidenceBuckets), confidenceBuckets-1)]++
+	}
+	if ok := s.Rows - s.Failed; ok > 0 {
+		s.Mean = s.sum / float64(ok)
+	}
+	if s.Rows > 0 {
+		s.FailureRate = float64(s.Failed) / float64(s.Rows)
+	}
+}
+
+// HandleStats reports the confidence distribution and failure rate across the
+// retained uploads.
+func HandleStats(w http.ResponseWriter, req *http.Request) {
+	var stats confidenceStats
+	for _, results := range uploads.decoded() {
+		stats.add(results)
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
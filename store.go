@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Store persists the inventory between restarts.
+type Store interface {
+	Load() (StoredState, error)
+	Save(state StoredState) error
+}
+
+// StoredState is everything a Store persists: the inventory, the product
+// code aliases and the lifetime count of processed sheets.
+type StoredState struct {
+	Items   Inventory
+	Aliases Aliases
+	Scans   int64
+}
+
+// inventoryFileVersion is written to inventory files that hold locations.
+// Files without a version are the original flat map of products, which is
+// loaded into defaultLocation.
+const inventoryFileVersion = 2
+
+// inventoryFile is the JSON layout of the inventory file.
+type inventoryFile struct {
+	Version   int       `json:"version"`
+	Locations Inventory `json:"locations"`
+	Aliases   Aliases   `json:"aliases,omitempty"`
+	Scans     int64     `json:"scans,omitempty"`
+}
+
+// fileStore keeps the inventory in a JSON file that is replaced atomically on save.
+type fileStore struct {
+	path string
+}
+
+// Load reads the inventory file. A missing file yields an empty inventory.
+func (s fileStore) Load() (StoredState, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return StoredState{Items: Inventory{}}, nil
+	}
+	if err != nil {
+		return StoredState{}, err
+	}
+	var file inventoryFile
+	if err := json.Unmarshal(data, &file); err == nil && file.Version > 0 {
+		if file.Locations == nil {
+			file.Locations = Inventory{}
+		}
+		return StoredState{Items: file.Locations, Aliases: file.Aliases, Scans: file.Scans}, nil
+	}
+	legacy := map[string]Product{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return StoredState{}, err
+	}
+	return StoredState{Items: Inventory{defaultLocation: legacy}}, nil
+}
+
+// Save writes state to a temporary file next to the inventory file and renames
+// it into place, so a failed write never leaves a truncated file behind.
+func (s fileStore) Save(state StoredState) error {
+	data, err := json.MarshalIndent(inventoryFile{Version: inventoryFileVersion, Locations: state.Items, Aliases: state.Aliases, Scans: state.Scans}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// memoryStore keeps nothing; it is used when persistence is disabled.
+type memoryStore struct{}
+
+func (memoryStore) Load() (StoredState, error) { return StoredState{Items: Inventory{}}, nil }
+func (memoryStore) Save(StoredState) error     { return nil }
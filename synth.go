@@ -0,0 +1,206 @@
+//go:build !nocv
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"gocv.io/x/gocv"
+)
+
+// syntheticRow is one row to draw on a synthetic sheet.
+type syntheticRow struct {
+	Key  string
+	Tens int
+	Ones int
+}
+
+// generateSheet draws a white sheet laid out by tmpl. Row i gets rows[i].Key
+// and its count drawn into the fields with those roles, as QR codes or filled
+// bubbles, so the whole decode pipeline can be exercised without a physical
+// sheet. Keys marked on bubbles must be listed in tmpl.Keys.
+// The caller must Close the returned Mat.
+func generateSheet(tmpl ScanTemplate, rows []syntheticRow) (gocv.Mat, error) {
+	if len(rows) > tmpl.Rows {
+		return gocv.Mat{}, fmt.Errorf("template %q has %d rows, got %d", tmpl.Name, tmpl.Rows, len(rows))
+	}
+	sheet := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), tmpl.Height, tmpl.Width, gocv.MatTypeCV8UC3)
+
+	for i, row := range rows {
+		offset := tmpl.rowOffset(i)
+		if !tmpl.RowMarkerRect.Empty() {
+			gocv.Rectangle(&sheet, tmpl.RowMarkerRect.Add(offset), color.RGBA{0, 0, 0, 0}, -1)
+		}
+		// Only the key and count fields are drawn; extra fields stay blank.
+		layout := tmpl.layout()
+		keyDigits, err := syntheticKeyDigits(tmpl, layout, row.Key)
+		if err != nil {
+			sheet.Close()
+			return gocv.Mat{}, fmt.Errorf("row %d: %w", i, err)
+		}
+		for j, f := range layout.key {
+			rect := f.Rect.Add(offset)
+			if f.Type == FieldBubbles {
+				drawBubbles(&sheet, rect, tmpl.Sections.NumSections, tmpl.section(keyDigits[j]))
+			} else if err := drawQR(&sheet, rect, row.Key); err != nil {
+				sheet.Close()
+				return gocv.Mat{}, fmt.Errorf("row %d: %w", i, err)
+			}
+		}
+		if layout.count != nil {
+			if err := drawQR(&sheet, layout.count.Rect.Add(offset), strconv.Itoa(row.Tens*10+row.Ones)); err != nil {
+				sheet.Close()
+				return gocv.Mat{}, fmt.Errorf("row %d: %w", i, err)
+			}
+			continue
+		}
+		drawBubbles(&sheet, layout.tens.Rect.Add(offset), tmpl.Sections.NumSections, tmpl.section(row.Tens))
+		drawBubbles(&sheet, layout.ones.Rect.Add(offset), tmpl.Sections.NumSections, tmpl.section(row.Ones))
+	}
+	return sheet, nil
+}
+
+// syntheticKeyDigits returns the digit to mark on each key bubbles field for
+// key: its index in tmpl.Keys, most significant digit first. It returns nil
+// for QR keys.
+func syntheticKeyDigits(tmpl ScanTemplate, layout rowLayout, key string) ([]int, error) {
+	if !layout.keyFromBubbles() {
+		return nil, nil
+	}
+	n := slices.Index(tmpl.Keys, key)
+	if n < 0 {
+		return nil, fmt.Errorf("key %q is not in the template's keys", key)
+	}
+	digits := make([]int, len(layout.key))
+	for j := len(digits) - 1; j >= 0; j-- {
+		digits[j] = n % 10
+		n /= 10
+	}
+	return digits, nil
+}
+
+// drawQR encodes text as a QR code scaled to fill rect.
+func drawQR(sheet *gocv.Mat, rect image.Rectangle, text string) error {
+	hints := map[gozxing.EncodeHintType]interface{}{gozxing.EncodeHintType_MARGIN: 1}
+	bits, err := qrcode.NewQRCodeWriter().Encode(text, gozxing.BarcodeFormat_QR_CODE, rect.Dx(), rect.Dy(), hints)
+	if err != nil {
+		return err
+	}
+	code, err := gocv.ImageToMatRGB(bits)
+	if err != nil {
+		return err
+	}
+	defer code.Close()
+
+	region := sheet.Region(rect)
+	defer region.Close()
+	gocv.Resize(code, &region, rect.Size(), 0, 0, gocv.InterpolationNearestNeighbor)
+	return nil
+}
+
+// drawBubbles outlines one bubble per section of rect and fills the one at index marked.
+func drawBubbles(sheet *gocv.Mat, rect image.Rectangle, numSections, marked int) {
+	black := color.RGBA{0, 0, 0, 0}
+	sectionWidth := float64(rect.Dx()) / float64(numSections)
+	radius := int(min(sectionWidth, float64(rect.Dy())) / 2 * 0.8)
+	for i := range numSections {
+		center := image.Pt(rect.Min.X+int((float64(i)+0.5)*sectionWidth), rect.Min.Y+rect.Dy()/2)
+		thickness := 1
+		if i == marked {
+			thickness = -1 // filled
+		}
+		gocv.Circle(sheet, center, radius, black, thickness)
+	}
+}
+
+// sampleRows returns n rows with distinct keys and digits, for synthetic
+// sheets of tmpl. Keys are taken in turn from tmpl.Keys when it lists any.
+func sampleRows(tmpl ScanTemplate, n int) []syntheticRow {
+	rows := make([]syntheticRow, n)
+	for i := range rows {
+		key := fmt.Sprintf("SKU-%02d", i+1)
+		if len(tmpl.Keys) > 0 {
+			key = tmpl.Keys[i%len(tmpl.Keys)]
+		}
+		rows[i] = syntheticRow{Key: key, Tens: i % 10, Ones: (i*3 + 1) % 10}
+	}
+	return rows
+}
+
+// writeSyntheticSheet draws a sample sheet for tmpl and saves it to path.
+func writeSyntheticSheet(path string, tmpl ScanTemplate) error {
+	sheet, err := generateSheet(tmpl, sampleRows(tmpl, tmpl.Rows))
+	if err != nil {
+		return err
+	}
+	defer sheet.Close()
+	if !gocv.IMWrite(path, sheet) {
+		return fmt.Errorf("error writing image: %s", path)
+	}
+	return nil
+}
+
+// runSelfTest draws a known synthetic sheet, writes it to disk, and runs the
+// full decode on it, reporting whether gocv read the image, whether the QR
+// codes decoded, and whether the bubbles were detected.
+func runSelfTest(tmpl ScanTemplate) []diagCheck {
+	rows := sampleRows(tmpl, 3)
+	var checks []diagCheck
+	fail := func(name string, err error) []diagCheck {
+		return append(checks, diagCheck{Name: name, Detail: err.Error()})
+	}
+
+	sheet, err := generateSheet(tmpl, rows)
+	if err != nil {
+		return fail("generate sample sheet (gocv + gozxing encoder)", err)
+	}
+	defer sheet.Close()
+	checks = append(checks, diagCheck{Name: "generate sample sheet (gocv + gozxing encoder)", OK: true})
+
+	f, err := os.CreateTemp("", "selftest-*.png")
+	if err != nil {
+		return fail("write sample sheet", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if !gocv.IMWrite(f.Name(), sheet) {
+		return fail("write sample sheet", fmt.Errorf("gocv.IMWrite failed for %s", f.Name()))
+	}
+
+	decoded, err := DecodeDocument(f.Name(), tmpl)
+	if err != nil && decoded.Results == nil {
+		return fail("gocv read the image", err)
+	}
+	checks = append(checks, diagCheck{Name: "gocv read the image", OK: true})
+
+	byRow := make(map[int]ScanResult, len(decoded.Results))
+	for _, r := range decoded.Results {
+		byRow[r.Row] = r
+	}
+	qr := diagCheck{Name: "QR codes decoded (gozxing)", OK: true}
+	bubbles := diagCheck{Name: "bubbles detected", OK: true}
+	for i, want := range rows {
+		got := byRow[i]
+		if got.Key != want.Key {
+			qr.OK = false
+			qr.Detail = fmt.Sprintf("row %d: got %q, want %q", i, got.Key, want.Key)
+			continue
+		}
+		if got.Count != want.Tens*10+want.Ones {
+			bubbles.OK = false
+			bubbles.Detail = fmt.Sprintf("row %d: got %d, want %d", i, got.Count, want.Tens*10+want.Ones)
+		}
+	}
+	if !qr.OK {
+		bubbles.OK = false
+		bubbles.Detail = "skipped: no QR decoded"
+	}
+	return append(checks, qr, bubbles)
+}
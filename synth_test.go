@@ -0,0 +1,86 @@
+//go:build !nocv
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// writeTestSheet draws rows on a synthetic sheet for tmpl, saves it as a PNG
+// in a temporary directory and returns its path.
+func writeTestSheet(tb testing.TB, tmpl ScanTemplate, rows []syntheticRow) string {
+	tb.Helper()
+	sheet, err := generateSheet(tmpl, rows)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer sheet.Close()
+	path := filepath.Join(tb.TempDir(), "sheet.png")
+	if !gocv.IMWrite(path, sheet) {
+		tb.Fatalf("writing %s failed", path)
+	}
+	return path
+}
+
+// withoutAnnotation returns tmpl set to decode with the default settings,
+// except that decoding does not write example.png into the package directory.
+func withoutAnnotation(tmpl ScanTemplate) ScanTemplate {
+	cfg := defaultConfig()
+	cfg.Decode.NoAnnotate = true
+	return cfg.decoding(tmpl)
+}
+
+func TestSyntheticRoundTrip(t *testing.T) {
+	countQR := defaultTemplate
+	countQR.Name = "count-qr"
+	countQR.Fields = []FieldSpec{
+		{Name: fieldKey, Type: FieldQR, Rect: defaultTemplate.KeyRect},
+		{Name: "count", Type: FieldQR, Rect: image.Rect(534, 540, 599, 605), Role: RoleCount},
+	}
+
+	bubbleKeys := defaultTemplate
+	bubbleKeys.Name = "bubble-keys"
+	bubbleKeys.Keys = make([]string, bubbleKeys.Rows)
+	for i := range bubbleKeys.Keys {
+		bubbleKeys.Keys[i] = fmt.Sprintf("BIN-%02d", i)
+	}
+	bubbleKeys.Fields = []FieldSpec{
+		{Name: "key-tens", Type: FieldBubbles, Rect: image.Rect(70, 541, 370, 576), Role: RoleKey},
+		{Name: "key-ones", Type: FieldBubbles, Rect: image.Rect(385, 541, 685, 576), Role: RoleKey},
+		{Name: fieldTens, Type: FieldBubbles, Rect: image.Rect(700, 541, 1000, 576)},
+		{Name: fieldOnes, Type: FieldBubbles, Rect: image.Rect(1015, 541, 1315, 576)},
+	}
+
+	for _, tmpl := range []ScanTemplate{defaultTemplate, countQR, bubbleKeys} {
+		t.Run(tmpl.Name, func(t *testing.T) {
+			if err := tmpl.validate(); err != nil {
+				t.Fatal(err)
+			}
+			rows := sampleRows(tmpl, tmpl.Rows)
+			sheet, err := DecodeDocument(writeTestSheet(t, tmpl, rows), withoutAnnotation(tmpl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			byRow := make(map[int]ScanResult, len(sheet.Results))
+			for _, r := range sheet.Results {
+				byRow[r.Row] = r
+			}
+			for i, want := range rows {
+				got, ok := byRow[i]
+				switch {
+				case !ok:
+					t.Errorf("row %d: not decoded", i)
+				case got.Error != "":
+					t.Errorf("row %d: %s", i, got.Error)
+				case got.Key != want.Key || got.Count != want.Tens*10+want.Ones:
+					t.Errorf("row %d: got %s=%d, want %s=%d", i, got.Key, got.Count, want.Key, want.Tens*10+want.Ones)
+				}
+			}
+		})
+	}
+}
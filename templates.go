@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// templateRegistry holds the scan templates available by name.
+type templateRegistry struct {
+	mu    sync.RWMutex
+	items map[string]ScanTemplate
+	dir   string // where templates are loaded from and saved to; set by loadDir
+}
+
+// ErrNoTemplateDir is returned by save when no -templates directory is set.
+var ErrNoTemplateDir = errors.New("no templates directory configured")
+
+var scanTemplates = templateRegistry{items: map[string]ScanTemplate{defaultTemplate.Name: defaultTemplate}}
+
+// lookup returns the named template as registered. Requests look templates
+// up through Config.template, which also picks the -template one for an
+// empty name.
+func (r *templateRegistry) lookup(name string) (ScanTemplate, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tmpl, ok := r.items[name]
+	return tmpl, ok
+}
+
+// names returns the template names in sorted order.
+func (r *templateRegistry) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Sorted(maps.Keys(r.items))
+}
+
+// put adds or replaces a template.
+func (r *templateRegistry) put(tmpl ScanTemplate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items[tmpl.Name] = tmpl
+}
+
+// loadDir adds every *.json template in dir. A template without a name is
+// named after its file.
+func (r *templateRegistry) loadDir(dir string) error {
+	r.mu.Lock()
+	r.dir = dir
+	r.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tmpl := defaultTemplate
+		if err := json.Unmarshal(data, &tmpl); err != nil {
+			return fmt.Errorf("template %s: %w", path, err)
+		}
+		if err := tmpl.validate(); err != nil {
+			return fmt.Errorf("template %s: %w", path, err)
+		}
+		if tmpl.Name == "" || tmpl.Name == defaultTemplate.Name {
+			tmpl.Name = filepath.Base(path[:len(path)-len(".json")])
+		}
+		r.put(tmpl)
+	}
+	return nil
+}
+
+// save validates tmpl, writes it to the templates directory as <name>.json
+// and only then swaps it into the registry, so a template that could not be
+// persisted is never used.
+func (r *templateRegistry) save(tmpl ScanTemplate) error {
+	if err := tmpl.validate(); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	dir := r.dir
+	r.mu.RUnlock()
+	if dir == "" {
+		return ErrNoTemplateDir
+	}
+	data, err := json.MarshalIndent(tmpl, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, tmpl.Name+".json")
+	tmp, err := os.CreateTemp(dir, tmpl.Name+".json.tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	r.put(tmpl)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeDisplay controls how timestamps are shown to operators: in the dashboard
+// and in every report or export that carries a time. Set from -tz and -time-format.
+var timeDisplay = struct {
+	Location *time.Location
+	Layout   string
+}{
+	Location: time.Local,
+	Layout:   "2006-01-02 15:04:05 MST",
+}
+
+// setTimeDisplay configures the zone (an IANA name such as "America/Mexico_City";
+// empty keeps the server's local zone) and layout used by formatTime.
+func setTimeDisplay(tz, layout string) error {
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return err
+		}
+		timeDisplay.Location = loc
+	}
+	if layout != "" {
+		timeDisplay.Layout = layout
+	}
+	return nil
+}
+
+// formatTime renders t in the configured zone and layout. The zero time,
+// which products saved before timestamps existed carry, renders as a dash.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return emptyValue
+	}
+	return t.In(timeDisplay.Location).Format(timeDisplay.Layout)
+}
+
+// timeAgo renders how long ago t was in the operator's locale, e.g. "3h ago".
+func timeAgo(locale string, t time.Time) string {
+	if t.IsZero() {
+		return translate(locale, "time.never")
+	}
+	d := time.Since(t)
+	var amount string
+	switch {
+	case d < time.Minute:
+		return translate(locale, "time.justNow")
+	case d < time.Hour:
+		amount = fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		amount = fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		amount = fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+	return translate(locale, "time.ago", amount)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRetainedUploads is how many original uploads are kept in memory for
+// recalibration and re-decoding.
+const maxRetainedUploads = 10
+
+// thumbnailSize is the longest side, in pixels, of upload thumbnails.
+const thumbnailSize = 320
+
+// retainedUpload is the original bytes of one uploaded sheet and the template,
+// location and results of its latest decode.
+type retainedUpload struct {
+	ID        string
+	Time      time.Time
+	Data      []byte
+	Thumbnail []byte // JPEG preview; nil when it could not be made
+	Decoded   bool
+	Template  string
+	Location  string // picked on upload, replaced by the sheet's location QR
+	Results   []ScanResult
+	// Applied holds the sheets dispatched to the inventory from this upload,
+	// with only the rows that applied. Decoding alone applies nothing.
+	Applied []Sheet
+
+	// Original and Annotated name the files kept for the upload under
+	// -upload-dir; empty when it is not archived.
+	Original  string
+	Annotated string
+}
+
+// uploadLog keeps the most recent uploads, oldest first.
+type uploadLog struct {
+	mu    sync.Mutex
+	items []retainedUpload
+}
+
+var uploads uploadLog
+
+// add retains data uploaded for location with a thumbnail of it, archiving it
+// when cfg has an -upload-dir, and returns the ID it can be fetched with. QR
+// codes cached for earlier uploads are dropped.
+func (l *uploadLog) add(cfg *Config, data []byte, location string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	thumb, err := scanner.Thumbnail(data, thumbnailSize, cfg.Decode.Limits)
+	if err != nil && !errors.Is(err, ErrScanningDisabled) {
+		log.Printf("Thumbnail of upload %s: %v", id, err)
+	}
+	var original string
+	if cfg.Archive.Dir != "" {
+		if original, err = cfg.Archive.archiveOriginal(id, data); err != nil {
+			alertf("Archiving upload %s failed: %v", id, err)
+		}
+	}
+
+	qrCache.Reset()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.items = append(l.items, retainedUpload{ID: id, Time: time.Now(), Data: data, Thumbnail: thumb, Location: location, Original: original})
+	if len(l.items) > maxRetainedUploads {
+		l.items = l.items[len(l.items)-maxRetainedUploads:]
+	}
+	return id
+}
+
+// get returns the bytes of the upload with the given ID.
+func (l *uploadLog) get(id string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, u := range l.items {
+		if u.ID == id {
+			return u.Data, true
+		}
+	}
+	return nil, false
+}
+
+// find returns a copy of the upload with the given ID.
+func (l *uploadLog) find(id string) (retainedUpload, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, u := range l.items {
+		if u.ID == id {
+			return u, true
+		}
+	}
+	return retainedUpload{}, false
+}
+
+// recordDecode records the template and decoded sheet of the upload with the
+// given ID, archiving its annotated sheet when cfg has an -upload-dir.
+// Attempts refused because scanning is disabled are not recorded.
+func (l *uploadLog) recordDecode(cfg *Config, id string, tmpl ScanTemplate, sheet Sheet, err error) {
+	if errors.Is(err, ErrScanningDisabled) {
+		return
+	}
+	var annotated string
+	if data, ok := l.get(id); ok && cfg.Archive.Dir != "" && err == nil {
+		var archErr error
+		if annotated, archErr = cfg.Archive.archiveAnnotated(id, data, tmpl); archErr != nil {
+			alertf("Archiving the annotated sheet of upload %s failed: %v", id, archErr)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.items {
+		if l.items[i].ID == id {
+			l.items[i].Decoded = true
+			l.items[i].Template = tmpl.Name
+			l.items[i].Results = sheet.Results
+			if sheet.Location != "" {
+				l.items[i].Location = sheet.Location
+			}
+			if annotated != "" {
+				l.items[i].Annotated = annotated
+			}
+		}
+	}
+}
+
+// recordApplied adds the rows of sheet that were dispatched to the inventory
+// to its upload's Applied sheets.
+func (l *uploadLog) recordApplied(sheet Sheet) {
+	if sheet.UploadID == "" {
+		return
+	}
+	sheet = appliedRows(sheet)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.items {
+		if l.items[i].ID == sheet.UploadID {
+			l.items[i].Applied = append(l.items[i].Applied, sheet)
+		}
+	}
+}
+
+// replaceApplied records the rows of sheet that read as everything its upload
+// contributed to the inventory, after a reprocess replaced the earlier
+// contributions.
+func (l *uploadLog) replaceApplied(sheet Sheet) {
+	sheet = appliedRows(sheet)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.items {
+		if l.items[i].ID == sheet.UploadID {
+			l.items[i].Applied = []Sheet{sheet}
+		}
+	}
+}
+
+// appliedRows returns sheet with only the rows the inventory takes: those
+// read without error and with a key.
+func appliedRows(sheet Sheet) Sheet {
+	sheet.Results = slices.DeleteFunc(slices.Clone(sheet.Results), func(r ScanResult) bool { return r.Error != "" || r.Key == "" })
+	return sheet
+}
+
+// decoded returns the latest results of every retained upload that has been decoded.
+func (l *uploadLog) decoded() [][]ScanResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out [][]ScanResult
+	for _, u := range l.items {
+		if u.Decoded {
+			out = append(out, u.Results)
+		}
+	}
+	return out
+}
+
+// list returns the retained uploads, oldest first.
+func (l *uploadLog) list() []retainedUpload {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.items)
+}
+
+// thumbnail returns the thumbnail of the upload with the given ID.
+func (l *uploadLog) thumbnail(id string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, u := range l.items {
+		if u.ID == id {
+			return u.Thumbnail, u.Thumbnail != nil
+		}
+	}
+	return nil, false
+}
+
+// HandleThumbnail serves the JPEG thumbnail of a retained upload.
+func HandleThumbnail(w http.ResponseWriter, req *http.Request) {
+	thumb, ok := uploads.thumbnail(req.PathValue("id"))
+	if !ok {
+		httpError(w, req, "error.noUpload", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(thumb)
+}
+
+// latest returns the bytes of the most recent upload, or nil if there is none.
+func (l *uploadLog) latest() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.items) == 0 {
+		return nil
+	}
+	return l.items[len(l.items)-1].Data
+}
+
+// HandleRedecode re-runs the scanner on a retained upload with the template
+// named by the template parameter. It only previews the results unless
+// apply=true is posted, so the operator can check them before applying; a
+// preview leaves the upload's recorded decode as it was. Uploads already
+// applied to the inventory, or staged for confirmation, can't be applied
+// again; /reprocess corrects applied ones.
+func HandleRedecode(w http.ResponseWriter, req *http.Request) {
+	cfg := configFor(req)
+	id := req.PathValue("id")
+	u, ok := uploads.find(id)
+	if !ok {
+		httpError(w, req, "error.noUpload", http.StatusNotFound)
+		return
+	}
+	tmpl, ok := cfg.template(req.FormValue("template"))
+	if !ok {
+		httpError(w, req, "error.unknownTemplate", http.StatusBadRequest)
+		return
+	}
+	apply, _ := strconv.ParseBool(req.FormValue("apply"))
+	if apply && (len(u.Applied) > 0 || stagedSheets.holds(id)) {
+		httpError(w, req, "error.alreadyApplied", http.StatusConflict)
+		return
+	}
+	mode, err := countModeFor(req.FormValue("mode"), tmpl)
+	if err != nil {
+		httpError(w, req, "error.invalidMode", http.StatusBadRequest)
+		return
+	}
+
+	path, err := writeTempImage(u.Data, "")
+	if err != nil {
+		httpError(w, req, "error.tempFile", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(path)
+
+	sheet, err := scanner.Decode(path, tmpl)
+	if apply {
+		uploads.recordDecode(cfg, id, tmpl, sheet, err)
+	}
+	if err != nil {
+		httpError(w, req, decodeErrorKey(err), decodeErrorStatus(err))
+		return
+	}
+	if abandoned(req) {
+		return
+	}
+	sheet = finishSheet(sheet, id, locationFor(req), mode)
+	sheetDecoded(id, sheet)
+	writeScanResponse(w, cfg.Commit, id, sheet, apply)
+}
+
+// HandleDebugZip streams a zip of every retained upload annotated with the
+// template it was last decoded with, named by upload time and ID. Uploads
+// that can't be annotated are included as the original bytes with a .txt
+// note of the error.
+func HandleDebugZip(w http.ResponseWriter, req *http.Request) {
+	if err := scanningDisabled(); err != nil {
+		httpError(w, req, "error.noScanner", http.StatusServiceUnavailable)
+		return
+	}
+	cfg := configFor(req)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="debug.zip"`)
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	for _, u := range uploads.list() {
+		if err := req.Context().Err(); err != nil {
+			// The archive so far is still a valid zip; say why it is short.
+			log.Printf("[%s] debug.zip cut short: %v", requestID(req), err)
+			if f, err := zw.Create("TRUNCATED.txt"); err == nil {
+				fmt.Fprintf(f, "Stopped before annotating every upload: %v\n", err)
+			}
+			return
+		}
+		tmpl, ok := cfg.template(u.Template)
+		if !ok {
+			tmpl = cfg.decoding(defaultTemplate)
+		}
+		base := u.Time.Format("20060102-150405") + "-" + u.ID
+		files := map[string][]byte{}
+		if _, png, err := scanner.Annotate(u.Data, tmpl); err != nil {
+			files[base+".img"] = u.Data
+			files[base+".txt"] = []byte(err.Error() + "\n")
+		} else {
+			files[base+".png"] = png
+		}
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: u.Time})
+			if err != nil {
+				log.Printf("Writing debug.zip: %v", err)
+				return
+			}
+			if _, err := f.Write(files[name]); err != nil {
+				log.Printf("Writing debug.zip: %v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+// maxAutoSections bounds how many bubbles section auto-detection accepts;
+// more means the projection picked up noise rather than printed bubbles.
+const maxAutoSections = 20
+
+// minBubbleGap is the number of blank columns that must separate two bubbles
+// for them to be counted separately.
+const minBubbleGap = 2
+
+// columnProjection sums the marked pixels of each column of a binary image
+// stored row-major in pix.
+func columnProjection(pix []byte, width, height int) []int {
+	proj := make([]int, width)
+	for y := range height {
+		row := pix[y*width : (y+1)*width]
+		for x, v := range row {
+			if v != 0 {
+				proj[x]++
+			}
+		}
+	}
+	return proj
+}
+
+// sectionSpans returns the [start, end) columns of n sections across a
+// region width pixels wide. Without insets or a gap the region is divided
+// evenly, the last section taking any remainder. Otherwise n bubbles of equal
+// width are laid out from cfg.LeftInset to width-cfg.RightInset with cfg.Gap
+// blank columns between neighbours, and each section covers one bubble. It
+// returns nil when the layout leaves no room for the bubbles.
+func sectionSpans(width, n int, cfg SectionConfig) [][2]int {
+	if cfg.LeftInset == 0 && cfg.RightInset == 0 && cfg.Gap == 0 {
+		bounds := make([]int, n+1)
+		for i := range n {
+			bounds[i] = int(float32(i) * float32(width) / float32(n))
+		}
+		bounds[n] = width
+		return boundsToSpans(bounds)
+	}
+	inner := width - cfg.LeftInset - cfg.RightInset
+	bubble := float64(inner-(n-1)*cfg.Gap) / float64(n)
+	if cfg.LeftInset < 0 || cfg.RightInset < 0 || cfg.Gap < 0 || bubble < 1 {
+		return nil
+	}
+	spans := make([][2]int, n)
+	for i := range spans {
+		start := float64(cfg.LeftInset) + float64(i)*(bubble+float64(cfg.Gap))
+		spans[i] = [2]int{int(start), int(start + bubble)}
+	}
+	return spans
+}
+
+// boundsToSpans turns n+1 contiguous section boundaries into n spans.
+func boundsToSpans(bounds []int) [][2]int {
+	spans := make([][2]int, len(bounds)-1)
+	for i := range spans {
+		spans[i] = [2]int{bounds[i], bounds[i+1]}
+	}
+	return spans
+}
+
+// detectSectionBounds finds the printed bubbles in a column projection of a
+// bubble region: runs of inked columns separated by at least minBubbleGap
+// blank ones. It returns the section boundaries (len = bubbles + 1, from 0 to
+// len(proj)) placed halfway between neighbouring bubble centers, and false
+// when the result is not a plausible row of evenly spaced bubbles.
+func detectSectionBounds(proj []int, height int) ([]int, bool) {
+	// Ignore specks: a column needs a few pixels of ink to count.
+	minInk := max(2, height/20)
+	var centers []int
+	start, gap := -1, 0
+	for x := 0; x <= len(proj); x++ {
+		inked := x < len(proj) && proj[x] >= minInk
+		switch {
+		case inked && start < 0:
+			start, gap = x, 0
+		case inked:
+			gap = 0
+		case start >= 0:
+			gap++
+			if gap >= minBubbleGap || x == len(proj) {
+				end := x - gap + 1
+				centers = append(centers, (start+end)/2)
+				start = -1
+			}
+		}
+	}
+	if len(centers) < 2 || len(centers) > maxAutoSections {
+		return nil, false
+	}
+
+	// Bubbles are printed at a regular pitch; reject uneven spacing.
+	pitch := float64(centers[len(centers)-1]-centers[0]) / float64(len(centers)-1)
+	for i := 1; i < len(centers); i++ {
+		if d := float64(centers[i] - centers[i-1]); d < 0.75*pitch || d > 1.25*pitch {
+			return nil, false
+		}
+	}
+
+	bounds := make([]int, len(centers)+1)
+	for i := 1; i < len(centers); i++ {
+		bounds[i] = (centers[i-1] + centers[i]) / 2
+	}
+	bounds[len(centers)] = len(proj)
+	return bounds, true
+}
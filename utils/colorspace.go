@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnsupportedColor is returned for images in a color space the decoder
+// would silently misread, such as CMYK TIFFs.
+var ErrUnsupportedColor = errors.New("unsupported image color space")
+
+// TIFF tags and photometric interpretations read by CheckColorSpace.
+const (
+	tiffTagPhotometric = 262
+
+	photometricWhiteIsZero = 0
+	photometricBlackIsZero = 1
+	photometricRGB         = 2
+	photometricPalette     = 3
+	photometricSeparated   = 5 // usually CMYK
+	photometricYCbCr       = 6
+	photometricCIELab      = 8
+)
+
+// CheckColorSpace reads the first image header of TIFF data in r and fails
+// with ErrUnsupportedColor, naming the color space, unless it is grayscale,
+// RGB, palette or YCbCr. Other formats are always grayscale or RGB and pass,
+// as do TIFFs whose header cannot be read; those fail later when decoded.
+func CheckColorSpace(r io.ReaderAt) error {
+	var head [8]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(head[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	ifd := int64(order.Uint32(head[4:]))
+	var count [2]byte
+	if _, err := r.ReadAt(count[:], ifd); err != nil {
+		return nil
+	}
+	for i := range int64(order.Uint16(count[:])) {
+		var entry [12]byte
+		if _, err := r.ReadAt(entry[:], ifd+2+12*i); err != nil {
+			return nil
+		}
+		if order.Uint16(entry[:2]) != tiffTagPhotometric {
+			continue
+		}
+		// A SHORT value sits in the first two bytes of the value field.
+		switch p := order.Uint16(entry[8:10]); p {
+		case photometricWhiteIsZero, photometricBlackIsZero, photometricRGB, photometricPalette, photometricYCbCr:
+			return nil
+		case photometricSeparated:
+			return fmt.Errorf("%w: CMYK TIFF; save the scan as RGB or grayscale", ErrUnsupportedColor)
+		case photometricCIELab:
+			return fmt.Errorf("%w: CIELab TIFF; save the scan as RGB or grayscale", ErrUnsupportedColor)
+		default:
+			return fmt.Errorf("%w: TIFF photometric interpretation %d", ErrUnsupportedColor, p)
+		}
+	}
+	return nil
+}
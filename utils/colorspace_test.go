@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// tiffEntry is one SHORT-valued IFD entry of a test TIFF header.
+type tiffEntry struct {
+	tag, value uint16
+}
+
+// tiffHeader returns the header and first IFD of a TIFF in the given byte
+// order holding entries; no pixel data follows.
+func tiffHeader(order binary.ByteOrder, entries ...tiffEntry) []byte {
+	var buf bytes.Buffer
+	if order == binary.ByteOrder(binary.BigEndian) {
+		buf.WriteString("MM\x00*")
+	} else {
+		buf.WriteString("II*\x00")
+	}
+	binary.Write(&buf, order, uint32(8))
+	binary.Write(&buf, order, uint16(len(entries)))
+	for _, e := range entries {
+		const typeShort = 3
+		binary.Write(&buf, order, [4]uint16{e.tag, typeShort, 1, 0}) // the count is 1 as a uint32
+		binary.Write(&buf, order, [2]uint16{e.value, 0})
+	}
+	binary.Write(&buf, order, uint32(0)) // no next IFD
+	return buf.Bytes()
+}
+
+// photometric returns the IFD entry giving a photometric interpretation.
+func photometric(p uint16) tiffEntry {
+	return tiffEntry{tiffTagPhotometric, p}
+}
+
+func TestCheckColorSpace(t *testing.T) {
+	const tagBitsPerSample, tagWidth = 258, 256
+	var png16 bytes.Buffer
+	if err := png.Encode(&png16, image.NewRGBA64(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		wantErr string // substring of the error; empty means accepted
+	}{
+		{"rgb", tiffHeader(binary.LittleEndian, photometric(photometricRGB)), ""},
+		{"rgb big-endian", tiffHeader(binary.BigEndian, photometric(photometricRGB)), ""},
+		{"gray black is zero", tiffHeader(binary.LittleEndian, photometric(photometricBlackIsZero)), ""},
+		{"gray white is zero", tiffHeader(binary.BigEndian, photometric(photometricWhiteIsZero)), ""},
+		{"palette", tiffHeader(binary.LittleEndian, photometric(photometricPalette)), ""},
+		{"ycbcr", tiffHeader(binary.LittleEndian, photometric(photometricYCbCr)), ""},
+		{"16-bit rgb", tiffHeader(binary.LittleEndian, tiffEntry{tagWidth, 4}, tiffEntry{tagBitsPerSample, 16}, photometric(photometricRGB)), ""},
+		{"cmyk", tiffHeader(binary.LittleEndian, photometric(photometricSeparated)), "CMYK"},
+		{"cmyk big-endian", tiffHeader(binary.BigEndian, tiffEntry{tagBitsPerSample, 8}, photometric(photometricSeparated)), "CMYK"},
+		{"cielab", tiffHeader(binary.LittleEndian, photometric(photometricCIELab)), "CIELab"},
+		{"unknown photometric", tiffHeader(binary.BigEndian, photometric(32844)), "photometric interpretation 32844"},
+		{"no photometric tag", tiffHeader(binary.LittleEndian, tiffEntry{tagWidth, 4}), ""},
+		{"truncated ifd", tiffHeader(binary.LittleEndian, photometric(photometricSeparated))[:12], ""},
+		{"16-bit png", png16.Bytes(), ""},
+		{"not an image", []byte("name,count\nSKU-1,4\n"), ""},
+		{"empty", nil, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckColorSpace(bytes.NewReader(tc.data))
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("CheckColorSpace = %v, want nil", err)
+			case tc.wantErr != "" && !errors.Is(err, ErrUnsupportedColor):
+				t.Errorf("CheckColorSpace = %v, want ErrUnsupportedColor", err)
+			case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+				t.Errorf("CheckColorSpace = %v, want it to mention %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Package utils reads the regions of a scanned sheet: QR codes and rows of
+// bubbles. The readers need OpenCV (gocv) and are left out of builds with the
+// nocv tag; the configuration types in this file are always available.
+package utils
+
+import (
+	"errors"
+	"image"
+	"slices"
+)
+
+// ErrQRTooSmall is returned when a QR code did not decode and its modules are
+// smaller than QRConfig.MinModuleSize.
+var ErrQRTooSmall = errors.New("QR code too small for this scan resolution; scan at a higher DPI")
+
+// ErrSmudged describes a SectionReading flagged Smudged: the mark could be
+// in either of two neighbouring sections.
+var ErrSmudged = errors.New("smudge or double mark across neighbouring bubbles")
+
+// ErrOutsideImage is returned for a region that does not lie on the image,
+// as when a template does not match the scan's size or orientation.
+var ErrOutsideImage = errors.New("region falls outside the image")
+
+// Padding grows a region by X pixels left and right and Y pixels above and
+// below before it is read, so ink sitting on the edge of a slightly drifted
+// print is not clipped. The zero Padding reads the region as given.
+type Padding struct {
+	X int `json:"x,omitempty"`
+	Y int `json:"y,omitempty"`
+}
+
+// Expand returns rect grown by p and clamped to bounds.
+func (p Padding) Expand(rect, bounds image.Rectangle) image.Rectangle {
+	return image.Rect(rect.Min.X-p.X, rect.Min.Y-p.Y, rect.Max.X+p.X, rect.Max.Y+p.Y).Intersect(bounds)
+}
+
+// MaskShape selects which pixels of a section are counted.
+type MaskShape string
+
+const (
+	MaskRect    MaskShape = "rect"    // count the whole section (the default)
+	MaskEllipse MaskShape = "ellipse" // count inside the ellipse inscribed in the section
+	MaskCircle  MaskShape = "circle"  // count inside the largest centered circle
+)
+
+// MarkMode selects how a pixel is judged to be part of a mark.
+type MarkMode string
+
+const (
+	MarkIntensity MarkMode = "intensity" // gray level below DarkThreshold (the default; suits pencil)
+	MarkColor     MarkMode = "color"     // saturated in HSV, or dark; catches blue pen as well as black
+)
+
+// SectionConfig holds the parameters used to split a bubble region into sections
+// and decide which section is marked.
+type SectionConfig struct {
+	NumSections     int     `json:"numSections"`
+	DarkThreshold   float64 `json:"darkThreshold"`   // pixel intensities below this are considered "dark"
+	ThresholdFactor float64 `json:"thresholdFactor"` // how far above the average a section must be to stand out
+
+	// Mask restricts counting to the expected bubble shape so printed outlines
+	// and guides around it are ignored. MaskScale sizes the mask relative to
+	// the section (1 touches the section edges; 0 means 1).
+	Mask      MaskShape `json:"mask,omitempty"`
+	MaskScale float64   `json:"maskScale,omitempty"`
+
+	// InnerMargin trims this many pixels off the left and right edge of each
+	// section before counting, so divider lines printed on the section
+	// boundaries are not counted as marks. Zero counts the whole section.
+	InnerMargin int `json:"innerMargin,omitempty"`
+
+	// Mode selects intensity or color mark detection; empty means intensity.
+	// In color mode a pixel is marked if its HSV saturation is at least
+	// MinSaturation (0-255; 0 means 80) or its value is below DarkThreshold.
+	Mode          MarkMode `json:"mode,omitempty"`
+	MinSaturation float64  `json:"minSaturation,omitempty"`
+
+	// Ignore lists 0-based section indices that are pre-printed registration
+	// bubbles. They are still measured but never win and are left out of the
+	// average the standout is compared against.
+	Ignore []int `json:"ignore,omitempty"`
+
+	// SmudgeCloseness flags a reading as Smudged instead of picking the
+	// standout when the runner-up section is its neighbour and trails it by
+	// less than this fraction of the standout's count (0.2 means within
+	// 20%): a smudge or a mark straddling the boundary darkens both. 0
+	// never flags one.
+	SmudgeCloseness float64 `json:"smudgeCloseness,omitempty"`
+
+	// Padding grows the bubble region before it is split into sections.
+	Padding Padding `json:"padding"`
+
+	// LeftInset, RightInset and Gap describe where the bubbles are printed
+	// when they do not evenly fill the region: the blank pixels before the
+	// first bubble, after the last one (both measured on the padded region),
+	// and between neighbours. Sections then cover one bubble each instead of
+	// width/NumSections. All zero divides the region evenly.
+	LeftInset  int `json:"leftInset,omitempty"`
+	RightInset int `json:"rightInset,omitempty"`
+	Gap        int `json:"gap,omitempty"`
+
+	// AutoSections infers the number of sections from the printed bubbles
+	// (peaks in the column projection of the region) instead of NumSections,
+	// which is still used when detection finds no plausible evenly spaced row.
+	AutoSections bool `json:"autoSections,omitempty"`
+
+	// IntegralCounts thresholds the whole region once and takes each
+	// section's mark count from its integral image, instead of thresholding
+	// every section separately. The counts are the same; it only applies to
+	// the default dark-pixel detector without a bubble Mask.
+	IntegralCounts bool `json:"integralCounts,omitempty"`
+
+	// NoAnnotate skips drawing the region, its dividers and the standout on
+	// the image. It is set by decode-only callers, never by templates.
+	NoAnnotate bool `json:"-"`
+}
+
+// DefaultSectionConfig returns the parameters ProcessHorizontalSections uses
+// for the given number of sections.
+func DefaultSectionConfig(numSections int) SectionConfig {
+	return SectionConfig{
+		NumSections:     numSections,
+		DarkThreshold:   100.0,
+		ThresholdFactor: 0.5, // 50% higher than the average dark pixel count is considered significant
+	}
+}
+
+// QRReading is a decoded QR region: the text and where the code was found.
+type QRReading struct {
+	Text string `json:"text"`
+	// Center is the middle of the code in image coordinates, halfway
+	// between its bottom-left and top-right finder patterns. Located is
+	// false when the code did not decode, and then Center is zero.
+	Center  image.Point `json:"center"`
+	Located bool        `json:"located"`
+}
+
+// SectionReading is the full outcome of reading a bubble region: the standout
+// section and the dark pixel count of every section, so close calls can be
+// judged by a reviewer.
+type SectionReading struct {
+	Standout   int       `json:"standout"`
+	Marked     bool      `json:"marked"` // a section stood out; Standout is 0 either way when none did
+	DarkCounts []int     `json:"darkCounts"`
+	Fill       []float64 `json:"fill"`              // dark pixels over section area, 0..1
+	Ignored    []int     `json:"ignored,omitempty"` // see SectionConfig.Ignore
+	Sections   int       `json:"sections"`          // sections read; detected with SectionConfig.AutoSections
+	// Smudged is set when the standout's neighbour was too close behind it
+	// to tell which one was meant; see SectionConfig.SmudgeCloseness.
+	// Standout and Marked still describe the fuller of the two.
+	Smudged bool `json:"smudged,omitempty"`
+}
+
+// Confidence rates how clearly the fullest section leads, from 0 (a tie, or
+// no dark pixels at all) to 1 (only one section has any dark pixels). It is
+// the margin between the two fullest sections relative to the fullest. It
+// does not look at Marked, so a column where nothing stood out is rated by
+// whatever noise it holds; callers decide what a blank column is worth.
+func (r SectionReading) Confidence() float64 {
+	best, second := 0.0, 0.0
+	for i, f := range r.Fill {
+		if slices.Contains(r.Ignored, i) {
+			continue
+		}
+		switch {
+		case f > best:
+			best, second = f, best
+		case f > second:
+			second = f
+		}
+	}
+	if best == 0 {
+		return 0
+	}
+	return (best - second) / best
+}
+
+// QRConfig controls how hard ProcessQRRegionWithConfig tries to find a QR code.
+type QRConfig struct {
+	// FinderPatterns enables a second pass when the region itself does not
+	// decode: the three corner finder patterns are located in a larger area
+	// and the image is cropped precisely to the code before decoding again.
+	// This rescues codes that are partly clipped by the template rectangle.
+	FinderPatterns bool `json:"finderPatterns,omitempty"`
+	// SearchMargin is how far (in pixels) beyond the region the finder
+	// pattern search looks. 0 means half the region size.
+	SearchMargin int `json:"searchMargin,omitempty"`
+	// Padding grows the QR region before it is decoded.
+	Padding Padding `json:"padding"`
+	// MinModuleSize is the smallest QR module, in pixels, that decodes
+	// reliably. When a code fails to decode and its modules look smaller,
+	// ErrQRTooSmall is returned so the operator knows to scan at a higher
+	// DPI. 0 disables the check.
+	MinModuleSize float64 `json:"minModuleSize,omitempty"`
+	// JSONPayload parses product codes as JSON objects with sku, lot and
+	// exp members; see ParseQRPayload. Codes that are not such objects are
+	// still read as bare keys.
+	JSONPayload bool `json:"jsonPayload,omitempty"`
+	// NoAnnotate skips drawing the region and the decoded text on the
+	// image. It is set by decode-only callers, never by templates.
+	NoAnnotate bool `json:"-"`
+	// Cache, when set, answers regions already read on the same image
+	// without decoding them again. Like NoAnnotate it is set per decode.
+	Cache *QRImageCache `json:"-"`
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// ExifOrientation returns the EXIF orientation tag (1-8) of JPEG data read
+// from r, or 1 (upright) when there is none or it can't be parsed. 3 means
+// the image must be turned 180°, 6 turned 90° clockwise and 8 turned 90°
+// counterclockwise to appear upright.
+func ExifOrientation(r io.Reader) int {
+	// EXIF sits in an APP1 segment near the start of the file.
+	head := make([]byte, 128<<10)
+	n, _ := io.ReadFull(r, head)
+	data := head[:n]
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xD9 || marker == 0xDA { // end of image, start of scan
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + size
+		if size < 2 || end > len(data) {
+			return 1
+		}
+		if marker == 0xE1 && bytes.HasPrefix(data[pos+4:end], []byte("Exif\x00\x00")) {
+			return tiffOrientation(data[pos+10 : end])
+		}
+		pos = end
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from IFD0 of a TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 { // Orientation, a SHORT
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
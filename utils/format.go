@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ErrNotImage is returned by DetectImageFormat for data that is not an image
+// format the decoder accepts.
+var ErrNotImage = errors.New("not a supported image")
+
+// DetectImageFormat sniffs the first bytes of r and returns the canonical
+// format name ("png", "jpeg", "gif", "bmp", "webp" or "tiff"), which is also
+// the usual file extension. It does not trust any file name or declared type.
+func DetectImageFormat(r io.Reader) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	head = head[:n]
+
+	// http.DetectContentType does not know TIFF.
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "tiff", nil
+	}
+	switch http.DetectContentType(head) {
+	case "image/png":
+		return "png", nil
+	case "image/jpeg":
+		return "jpeg", nil
+	case "image/gif":
+		return "gif", nil
+	case "image/bmp":
+		return "bmp", nil
+	case "image/webp":
+		return "webp", nil
+	}
+	return "", ErrNotImage
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// encoded returns a small image encoded with enc.
+func encoded(t *testing.T, enc func(*bytes.Buffer, image.Image) error) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := enc(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"png", encoded(t, func(b *bytes.Buffer, m image.Image) error { return png.Encode(b, m) }), "png"},
+		{"jpeg", encoded(t, func(b *bytes.Buffer, m image.Image) error { return jpeg.Encode(b, m, nil) }), "jpeg"},
+		{"gif", encoded(t, func(b *bytes.Buffer, m image.Image) error { return gif.Encode(b, m, nil) }), "gif"},
+		{"bmp", []byte("BM\x36\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00"), "bmp"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "webp"},
+		{"tiff little-endian", []byte("II*\x00\x08\x00\x00\x00"), "tiff"},
+		{"tiff big-endian", []byte("MM\x00*\x00\x00\x00\x08"), "tiff"},
+		{"png signature only", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...), "png"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := DetectImageFormat(bytes.NewReader(tc.data))
+			if err != nil || got != tc.want {
+				t.Errorf("DetectImageFormat = %q, %v; want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDetectImageFormatRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"text", "name,count\nSKU-1,4\n"},
+		{"html", "<!DOCTYPE html><html><body><img src=x></body></html>"},
+		{"pdf", "%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"},
+		{"zip", "PK\x03\x04\x14\x00\x00\x00"},
+		{"truncated tiff magic", "II*"},
+		{"svg", `<svg xmlns="http://www.w3.org/2000/svg"/>`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := DetectImageFormat(strings.NewReader(tc.data))
+			if !errors.Is(err, ErrNotImage) {
+				t.Errorf("DetectImageFormat = %q, %v; want ErrNotImage", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+//go:build !nocv
+
+package utils
+
+import (
+	"image"
+	"image/color"
+
+	"gocv.io/x/gocv"
+)
+
+// LocateMarker finds the largest roughly square dark blob in area, such as a
+// printed reference square, and returns its bounding box in image coordinates.
+// When annotate is set the box found is drawn on img in blue.
+func LocateMarker(img *gocv.Mat, area image.Rectangle, darkThreshold float64, annotate bool) (image.Rectangle, bool) {
+	area = area.Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+	if area.Empty() {
+		return image.Rectangle{}, false
+	}
+	region := img.Region(area)
+	defer region.Close()
+
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(region, &gray, gocv.ColorBGRToGray)
+	thresh := gocv.NewMat()
+	defer thresh.Close()
+	gocv.Threshold(gray, &thresh, float32(darkThreshold), 255, gocv.ThresholdBinaryInv)
+
+	contours := gocv.FindContours(thresh, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+	var best image.Rectangle
+	for i := 0; i < contours.Size(); i++ {
+		box := gocv.BoundingRect(contours.At(i))
+		w, h := box.Dx(), box.Dy()
+		if w < 5 || h < 5 {
+			continue
+		}
+		if ratio := float64(w) / float64(h); ratio < 0.8 || ratio > 1.25 {
+			continue
+		}
+		if w*h > best.Dx()*best.Dy() {
+			best = box
+		}
+	}
+	if best.Empty() {
+		return image.Rectangle{}, false
+	}
+	best = best.Add(area.Min)
+	if annotate {
+		gocv.Rectangle(img, best, color.RGBA{0, 0, 255, 0}, 2)
+	}
+	return best, true
+}
+
+// MarkerPresent reports whether the printed square marker expected in rect is
+// there: at least minFill of its pixels must be darker than darkThreshold.
+// When annotate is set the rectangle is drawn on img, green when the marker
+// was found and red when it was not.
+func MarkerPresent(img *gocv.Mat, rect image.Rectangle, darkThreshold, minFill float64, annotate bool) bool {
+	rect = rect.Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+	if rect.Empty() {
+		return false
+	}
+	region := img.Region(rect)
+	defer region.Close()
+
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(region, &gray, gocv.ColorBGRToGray)
+	thresh := gocv.NewMat()
+	defer thresh.Close()
+	gocv.Threshold(gray, &thresh, float32(darkThreshold), 255, gocv.ThresholdBinaryInv)
+
+	found := float64(gocv.CountNonZero(thresh)) >= minFill*float64(rect.Dx()*rect.Dy())
+	if !annotate {
+		return found
+	}
+	c := color.RGBA{255, 0, 0, 0}
+	if found {
+		c = color.RGBA{0, 255, 0, 0}
+	}
+	gocv.Rectangle(img, rect, c, 2)
+	return found
+}
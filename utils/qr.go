@@ -1,9 +1,13 @@
+//go:build !nocv
+
 package utils
 
 import (
 	"fmt"
+	"hash/maphash"
 	"image"
 	"image/color"
+	"sort"
 
 	"github.com/makiuchi-d/gozxing"
 	"github.com/makiuchi-d/gozxing/qrcode"
@@ -14,10 +18,20 @@ import (
 // then uses gozxing to detect and decode a QR code.
 // It returns the decoded text or an error.
 func DecodeQRCodeZXing(mat gocv.Mat) (string, error) {
+	result, err := decodeQRCodeZXing(mat)
+	if err != nil {
+		return "", err
+	}
+	return result.GetText(), nil
+}
+
+// decodeQRCodeZXing is DecodeQRCodeZXing returning the whole gozxing result,
+// whose points locate the code in mat.
+func decodeQRCodeZXing(mat gocv.Mat) (*gozxing.Result, error) {
 	// Convert gocv.Mat to image.Image.
 	img, err := mat.ToImage()
 	if err != nil {
-		return "", fmt.Errorf("failed to convert Mat to image: %v", err)
+		return nil, fmt.Errorf("failed to convert Mat to image: %v", err)
 	}
 
 	// Create a LuminanceSource from the image.
@@ -25,16 +39,12 @@ func DecodeQRCodeZXing(mat gocv.Mat) (string, error) {
 	// Create a BinaryBitmap using HybridBinarizer.
 	bitmap, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(source))
 	if err != nil {
-		return "", fmt.Errorf("failed to create binary bitmap: %v", err)
+		return nil, fmt.Errorf("failed to create binary bitmap: %v", err)
 	}
 
 	// Create a QR code reader.
 	reader := qrcode.NewQRCodeReader()
-	result, err := reader.Decode(bitmap, nil)
-	if err != nil {
-		return "", err
-	}
-	return result.GetText(), nil
+	return reader.Decode(bitmap, nil)
 }
 
 // ProcessQRRegion extracts a subregion defined by rect from the given image,
@@ -42,6 +52,98 @@ func DecodeQRCodeZXing(mat gocv.Mat) (string, error) {
 // draws the rectangle and decoded text on the original image.
 // It returns the decoded QR text or an error.
 func ProcessQRRegion(img *gocv.Mat, rect image.Rectangle) (string, error) {
+	return ProcessQRRegionWithConfig(img, rect, QRConfig{})
+}
+
+// ProcessQRRegionWithConfig is ProcessQRRegion with the optional finder
+// pattern fallback described by cfg.
+func ProcessQRRegionWithConfig(img *gocv.Mat, rect image.Rectangle, cfg QRConfig) (string, error) {
+	reading, err := ReadQRRegion(img, rect, cfg)
+	return reading.Text, err
+}
+
+// ReadQRRegion is ProcessQRRegionWithConfig also reporting where in img the
+// code was found.
+func ReadQRRegion(img *gocv.Mat, rect image.Rectangle, cfg QRConfig) (QRReading, error) {
+	rect = cfg.Padding.Expand(rect, image.Rect(0, 0, img.Cols(), img.Rows()))
+	if rect.Empty() {
+		return QRReading{}, ErrOutsideImage
+	}
+	r, ok := cfg.Cache.get(rect, cfg)
+	if !ok {
+		r = readQR(img, rect, cfg)
+		cfg.Cache.put(rect, cfg, r)
+	} else if !cfg.NoAnnotate && !r.crop.Empty() {
+		gocv.Rectangle(img, r.crop, color.RGBA{255, 0, 255, 0}, 1)
+	}
+
+	if cfg.NoAnnotate {
+		return r.reading, r.err
+	}
+	// Draw the rectangle on the original image.
+	gocv.Rectangle(img, rect, color.RGBA{0, 255, 0, 0}, 2)
+	// Put the decoded QR text above the rectangle.
+	ptText := image.Pt(rect.Min.X, rect.Max.Y+10)
+	gocv.PutText(img, r.reading.Text, ptText, gocv.FontHersheyPlain, 1.2, color.RGBA{0, 0, 255, 0}, 2)
+
+	return r.reading, r.err
+}
+
+// readQR decodes the padded region rect of img, falling back to the finder
+// patterns and checking the module size as cfg says.
+func readQR(img *gocv.Mat, rect image.Rectangle, cfg QRConfig) qrCached {
+	r := qrCached{reading: decodeRegion(img, rect)}
+
+	var module float64 // estimated module size, from the finder patterns when found
+	if r.reading.Text == "" && (cfg.FinderPatterns || cfg.MinModuleSize > 0) {
+		crop, size, ok := locateQRByFinderPatterns(img, rect, cfg.SearchMargin)
+		if ok {
+			module = size
+		}
+		if ok && cfg.FinderPatterns {
+			r.reading, r.crop = decodeRegion(img, crop), crop
+			// Mark the precise crop so it can be told apart from the template rectangle.
+			if !cfg.NoAnnotate {
+				gocv.Rectangle(img, crop, color.RGBA{255, 0, 255, 0}, 1)
+			}
+		}
+	}
+	if r.reading.Text == "" && cfg.MinModuleSize > 0 {
+		if module == 0 && printed(img, rect) {
+			// The smallest code (version 1) is 21 modules wide, so no code
+			// filling the region can have larger modules than this.
+			module = float64(max(rect.Dx(), rect.Dy())) / 21
+		}
+		// Blank regions (empty rows) have no module size and are not errors.
+		if module > 0 && module < cfg.MinModuleSize {
+			r.err = fmt.Errorf("%w (about %.1f px per module, need %.1f)", ErrQRTooSmall, module, cfg.MinModuleSize)
+		}
+	}
+	return r
+}
+
+// ForImage returns the cache's view of img, keyed by a hash of its pixels, for
+// QRConfig.Cache. It must be taken before anything is drawn on img.
+func (c *QRCache) ForImage(img *gocv.Mat) *QRImageCache {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	fmt.Fprintf(&h, "%dx%d/%d:", img.Cols(), img.Rows(), img.Type())
+	h.Write(img.ToBytes())
+	return &QRImageCache{cache: c, image: h.Sum64()}
+}
+
+// printed reports whether rect of img holds enough ink to be a code rather
+// than blank paper.
+func printed(img *gocv.Mat, rect image.Rectangle) bool {
+	region := img.Region(rect)
+	defer region.Close()
+	mean := region.Mean()
+	return (mean.Val1+mean.Val2+mean.Val3)/3 < 200
+}
+
+// decodeRegion converts rect of img to grayscale and decodes the QR code in it,
+// returning the zero QRReading when nothing decodes.
+func decodeRegion(img *gocv.Mat, rect image.Rectangle) QRReading {
 	// Extract the sub-mat from the original image.
 	subMat := img.Region(rect)
 	defer subMat.Close()
@@ -51,14 +153,121 @@ func ProcessQRRegion(img *gocv.Mat, rect image.Rectangle) (string, error) {
 	defer gray.Close()
 	gocv.CvtColor(subMat, &gray, gocv.ColorBGRToGray)
 
-	// Decode the QR code using the utility function.
-	qrText, _ := DecodeQRCodeZXing(gray)
+	result, err := decodeQRCodeZXing(gray)
+	if err != nil {
+		return QRReading{}
+	}
+	reading := QRReading{Text: result.GetText()}
+	// The points are the bottom-left, top-left and top-right finder patterns,
+	// sometimes followed by an alignment pattern.
+	if pts := result.GetResultPoints(); len(pts) >= 3 {
+		reading.Center = rect.Min.Add(image.Pt(int((pts[0].GetX()+pts[2].GetX())/2), int((pts[0].GetY()+pts[2].GetY())/2)))
+		reading.Located = true
+	}
+	return reading
+}
 
-	// Draw the rectangle on the original image.
-	gocv.Rectangle(img, rect, color.RGBA{0, 255, 0, 0}, 2)
-	// Put the decoded QR text above the rectangle.
-	ptText := image.Pt(rect.Min.X, rect.Max.Y+10)
-	gocv.PutText(img, qrText, ptText, gocv.FontHersheyPlain, 1.2, color.RGBA{0, 0, 255, 0}, 2)
+// finderCandidate is a square contour that may be part of a finder pattern.
+type finderCandidate struct {
+	box    image.Rectangle
+	nested int // how many candidates share its center, including itself
+}
+
+// locateQRByFinderPatterns searches rect grown by margin for the three nested
+// squares that mark a QR code's corners and returns the rectangle covering
+// the whole code plus a quiet zone, in image coordinates, and the module size
+// in pixels measured from the patterns.
+func locateQRByFinderPatterns(img *gocv.Mat, rect image.Rectangle, margin int) (image.Rectangle, float64, bool) {
+	if margin <= 0 {
+		margin = max(rect.Dx(), rect.Dy()) / 2
+	}
+	bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+	area := rect.Inset(-margin).Intersect(bounds)
+	if area.Empty() {
+		return image.Rectangle{}, 0, false
+	}
+
+	subMat := img.Region(area)
+	defer subMat.Close()
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(subMat, &gray, gocv.ColorBGRToGray)
+	binary := gocv.NewMat()
+	defer binary.Close()
+	gocv.Threshold(gray, &binary, 0, 255, gocv.ThresholdBinaryInv|gocv.ThresholdOtsu)
+
+	contours := gocv.FindContours(binary, gocv.RetrievalList, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	// Keep roughly square contours; a finder pattern's 7:5:3 rings produce
+	// several of them around the same center.
+	var candidates []finderCandidate
+	for i := 0; i < contours.Size(); i++ {
+		box := gocv.BoundingRect(contours.At(i))
+		w, h := box.Dx(), box.Dy()
+		if w < 5 || h < 5 {
+			continue
+		}
+		if ratio := float64(w) / float64(h); ratio < 0.75 || ratio > 1.33 {
+			continue
+		}
+		candidates = append(candidates, finderCandidate{box: box})
+	}
+	for i := range candidates {
+		ci := center(candidates[i].box)
+		tolerance := max(2, candidates[i].box.Dx()/7)
+		for j := range candidates {
+			cj := center(candidates[j].box)
+			if abs(ci.X-cj.X) <= tolerance && abs(ci.Y-cj.Y) <= tolerance {
+				candidates[i].nested++
+			}
+		}
+	}
 
-	return qrText, nil
+	// The outermost ring of each nested group is a finder pattern.
+	var finders []image.Rectangle
+	for _, c := range candidates {
+		if c.nested < 2 {
+			continue
+		}
+		inside := false
+		for _, f := range finders {
+			if c.box.In(f) {
+				inside = true
+				break
+			}
+		}
+		if inside {
+			continue
+		}
+		// Replace any previously kept ring this one encloses.
+		kept := finders[:0]
+		for _, f := range finders {
+			if !f.In(c.box) {
+				kept = append(kept, f)
+			}
+		}
+		finders = append(kept, c.box)
+	}
+	if len(finders) < 3 {
+		return image.Rectangle{}, 0, false
+	}
+
+	// Use the three largest patterns; together they span the whole code.
+	sort.Slice(finders, func(i, j int) bool { return finders[i].Dx() > finders[j].Dx() })
+	code := finders[0].Union(finders[1]).Union(finders[2])
+	module := float64(finders[2].Dx()) / 7 // a finder pattern is 7 modules wide
+	code = code.Inset(-2 * max(int(module), 1)).Add(area.Min).Intersect(bounds)
+	return code, module, !code.Empty()
+}
+
+func center(r image.Rectangle) image.Point {
+	return image.Pt((r.Min.X+r.Max.X)/2, (r.Min.Y+r.Max.Y)/2)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
 }
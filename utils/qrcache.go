@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"hash/maphash"
+	"image"
+	"sync"
+)
+
+// QRCache remembers what ReadQRRegion read in regions of an image, so
+// decoding the same image again, as recalibrating does with every change of
+// the bubble parameters, skips the gozxing pass for QR regions that have not
+// moved. It holds up to a fixed number of readings, dropping the oldest, and
+// should be Reset whenever a new image arrives.
+type QRCache struct {
+	mu    sync.Mutex
+	seed  maphash.Seed
+	size  int
+	items map[qrCacheKey]qrCached
+	order []qrCacheKey // oldest first
+}
+
+// qrCacheKey identifies a region of an image and the settings it was read with.
+type qrCacheKey struct {
+	image          uint64          // hash of the image's pixels; see QRCache.ForImage
+	rect           image.Rectangle // padded region
+	finderPatterns bool
+	searchMargin   int
+	minModuleSize  float64
+}
+
+// qrCached is one ReadQRRegion outcome.
+type qrCached struct {
+	reading QRReading
+	err     error
+	crop    image.Rectangle // finder pattern crop that was decoded, if any
+}
+
+// NewQRCache returns an empty cache holding up to size readings.
+func NewQRCache(size int) *QRCache {
+	return &QRCache{seed: maphash.MakeSeed(), size: size, items: make(map[qrCacheKey]qrCached)}
+}
+
+// Reset forgets every reading.
+func (c *QRCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.items)
+	c.order = nil
+}
+
+// QRImageCache is a QRCache seen through one image; see QRCache.ForImage and
+// QRConfig.Cache. A nil QRImageCache caches nothing.
+type QRImageCache struct {
+	cache *QRCache
+	image uint64
+}
+
+func (c *QRImageCache) key(rect image.Rectangle, cfg QRConfig) qrCacheKey {
+	return qrCacheKey{image: c.image, rect: rect, finderPatterns: cfg.FinderPatterns, searchMargin: cfg.SearchMargin, minModuleSize: cfg.MinModuleSize}
+}
+
+func (c *QRImageCache) get(rect image.Rectangle, cfg QRConfig) (qrCached, bool) {
+	if c == nil {
+		return qrCached{}, false
+	}
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	v, ok := c.cache.items[c.key(rect, cfg)]
+	return v, ok
+}
+
+func (c *QRImageCache) put(rect image.Rectangle, cfg QRConfig, v qrCached) {
+	if c == nil {
+		return
+	}
+	k := c.key(rect, cfg)
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	if _, ok := c.cache.items[k]; !ok {
+		c.cache.order = append(c.cache.order, k)
+	}
+	c.cache.items[k] = v
+	for len(c.cache.order) > c.cache.size {
+		delete(c.cache.items, c.cache.order[0])
+		c.cache.order = c.cache.order[1:]
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// QRPayload is what a product QR code identifies: the key and, for codes
+// carrying structured JSON, the lot and expiry printed with it.
+type QRPayload struct {
+	Key    string
+	Lot    string
+	Expiry string // as encoded, e.g. "2025-06"
+}
+
+// ParseQRPayload reads a product QR text of the form
+// {"sku":"X","lot":"Y","exp":"2025-06"}. Text that is not a JSON object
+// with a non-empty sku is returned whole as the key, so plain codes and
+// malformed JSON still identify a product.
+func ParseQRPayload(text string) QRPayload {
+	if !strings.HasPrefix(strings.TrimSpace(text), "{") {
+		return QRPayload{Key: text}
+	}
+	var v struct {
+		SKU string `json:"sku"`
+		Lot string `json:"lot"`
+		Exp string `json:"exp"`
+	}
+	if err := json.Unmarshal([]byte(text), &v); err != nil || strings.TrimSpace(v.SKU) == "" {
+		return QRPayload{Key: text}
+	}
+	return QRPayload{Key: strings.TrimSpace(v.SKU), Lot: v.Lot, Expiry: v.Exp}
+}
@@ -1,9 +1,12 @@
+//go:build !nocv
+
 package utils
 
 import (
 	"fmt"
 	"image"
 	"image/color"
+	"slices"
 
 	"gocv.io/x/gocv"
 )
@@ -14,73 +17,172 @@ import (
 // than the others, returns its 1-based index; otherwise, it returns 0.
 // It also draws the rectangle and vertical dividing lines on the original image and writes the standout section index.
 func ProcessHorizontalSections(img *gocv.Mat, rect image.Rectangle, numSections int) (int, error) {
+	return ProcessHorizontalSectionsWithConfig(img, rect, DefaultSectionConfig(numSections))
+}
+
+// ProcessHorizontalSectionsWithConfig is ProcessHorizontalSections with explicit
+// thresholds, so callers can tune them per sheet template.
+func ProcessHorizontalSectionsWithConfig(img *gocv.Mat, rect image.Rectangle, cfg SectionConfig) (int, error) {
+	reading, err := ReadHorizontalSections(img, rect, cfg)
+	return reading.Standout, err
+}
+
+// ProcessHorizontalSectionsWithDetector is ProcessHorizontalSections scoring
+// the sections with d instead of counting dark pixels.
+func ProcessHorizontalSectionsWithDetector(img *gocv.Mat, rect image.Rectangle, numSections int, d MarkDetector) (int, error) {
+	reading, err := ReadHorizontalSectionsWithDetector(img, rect, DefaultSectionConfig(numSections), d)
+	return reading.Standout, err
+}
+
+// MarkDetector scores how heavily one section of a bubble region is marked.
+// The section is the BGR pixels of the section, after InnerMargin is
+// trimmed. Scores are in pixels of ink, at most the section's area, so they
+// can be reported as counts and fill fractions; the standout is picked by
+// comparing the scores of a region's sections.
+type MarkDetector interface {
+	Score(section gocv.Mat) float64
+}
+
+// DarkPixelDetector is the default MarkDetector: it counts the mark pixels of
+// the section, judged per Config.Mode, inside the Config.Mask shape.
+type DarkPixelDetector struct {
+	Config SectionConfig
+}
+
+func (d DarkPixelDetector) Score(section gocv.Mat) float64 {
+	marks := markPixels(section, d.Config)
+	defer marks.Close()
+	applySectionMask(&marks, d.Config)
+	return float64(gocv.CountNonZero(marks))
+}
+
+// ReadHorizontalSections is ProcessHorizontalSectionsWithConfig returning the
+// per-section counts alongside the standout index.
+func ReadHorizontalSections(img *gocv.Mat, rect image.Rectangle, cfg SectionConfig) (SectionReading, error) {
+	return ReadHorizontalSectionsWithDetector(img, rect, cfg, DarkPixelDetector{Config: cfg})
+}
+
+// ReadHorizontalSectionsWithDetector is ReadHorizontalSections scoring the
+// sections with d. cfg still decides how the region is split and how far
+// the standout must lead.
+func ReadHorizontalSectionsWithDetector(img *gocv.Mat, rect image.Rectangle, cfg SectionConfig, d MarkDetector) (SectionReading, error) {
+	// A clipped region would split into sections at the wrong places.
+	bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+	if rect.Empty() || !rect.In(bounds) {
+		return SectionReading{}, fmt.Errorf("%w: %v", ErrOutsideImage, rect)
+	}
+	rect = cfg.Padding.Expand(rect, bounds)
 	// Extract the sub-mat from the given rectangle.
 	subMat := img.Region(rect)
 	defer subMat.Close()
 
-	// Convert the sub-mat to grayscale.
-	gray := gocv.NewMat()
-	defer gray.Close()
-	gocv.CvtColor(subMat, &gray, gocv.ColorBGRToGray)
+	numSections := cfg.NumSections
+	thresholdFactor := cfg.ThresholdFactor
 
-	// Define parameters.
-	const darkThreshold = 100.0 // pixel intensities below this are considered "dark"
-	const thresholdFactor = 0.5 // 50% higher than the average dark pixel count is considered significant
+	width := subMat.Cols()
+	height := subMat.Rows()
 
-	width := gray.Cols()
-	height := gray.Rows()
+	// Sections default to equal widths, or the bubble pitch given by the
+	// insets and gap; auto-detection places them between the printed
+	// bubbles it finds instead.
+	var spans [][2]int
+	if cfg.AutoSections && width > 0 {
+		// Mark pixels become white (255) in marks, everything else black.
+		marks := markPixels(subMat, cfg)
+		if bounds, ok := detectSectionBounds(columnProjection(marks.ToBytes(), width, height), height); ok {
+			spans = boundsToSpans(bounds)
+		}
+		marks.Close()
+	}
+	if spans == nil && numSections > 0 {
+		spans = sectionSpans(width, numSections, cfg)
+	}
+	numSections = len(spans)
 	if numSections <= 0 || width == 0 || height == 0 {
-		return 0, fmt.Errorf("invalid input dimensions or numSections")
+		return SectionReading{}, fmt.Errorf("invalid input dimensions or numSections")
 	}
 
-	// Determine the width of each section.
-	sectionWidth := float32(width) / float32(numSections)
-
 	// Count dark pixels for each section.
+	var integral *integralCounts
+	if dp, ok := d.(DarkPixelDetector); ok && cfg.IntegralCounts && (dp.Config.Mask == "" || dp.Config.Mask == MaskRect) {
+		integral = newIntegralCounts(subMat, dp.Config)
+		defer integral.Close()
+	}
 	darkCounts := make([]int, numSections)
+	fill := make([]float64, numSections)
 	totalCount := 0
 
 	for i := 0; i < numSections; i++ {
 		// Calculate ROI for this section.
-		xStart := int(float32(i) * sectionWidth)
-		xEnd := xStart + int(sectionWidth)
-		// Ensure the last section takes any remainder.
-		if i == numSections-1 {
-			xEnd = width
+		xStart, xEnd := spans[i][0], spans[i][1]
+		// Trim the boundaries, keeping at least one column.
+		if m := cfg.InnerMargin; m > 0 && xEnd-xStart > 2*m {
+			xStart, xEnd = xStart+m, xEnd-m
 		}
 		roi := image.Rect(xStart, 0, xEnd, height)
-		sectionMat := gray.Region(roi)
-
-		// Apply a threshold: use THRESH_BINARY_INV so that dark pixels become white.
-		threshMat := gocv.NewMat()
-		gocv.Threshold(sectionMat, &threshMat, darkThreshold, 255, gocv.ThresholdBinaryInv)
-		count := gocv.CountNonZero(threshMat)
+		var count int
+		if integral != nil {
+			count = integral.count(roi)
+		} else {
+			sectionMat := subMat.Region(roi)
+			count = int(d.Score(sectionMat))
+			sectionMat.Close()
+		}
 		darkCounts[i] = count
+		fill[i] = float64(count) / float64(roi.Dx()*roi.Dy())
 		totalCount += count
+	}
 
-		sectionMat.Close()
-		threshMat.Close()
+	// Registration bubbles are always filled; leave them out of the decision.
+	counted := numSections
+	for _, i := range cfg.Ignore {
+		if i >= 0 && i < numSections {
+			totalCount -= darkCounts[i]
+			counted--
+		}
+	}
+	if counted <= 0 {
+		return SectionReading{}, fmt.Errorf("every section is ignored")
 	}
 
-	avg := float64(totalCount) / float64(numSections)
-	maxCount := 0
-	maxIndex := -1
+	avg := float64(totalCount) / float64(counted)
+	maxCount, secondCount := 0, 0
+	maxIndex, secondIndex := -1, -1
 	for i, count := range darkCounts {
-		if count > maxCount {
-			maxCount = count
-			maxIndex = i
+		if slices.Contains(cfg.Ignore, i) {
+			continue
+		}
+		switch {
+		case count > maxCount:
+			secondCount, secondIndex = maxCount, maxIndex
+			maxCount, maxIndex = count, i
+		case count > secondCount:
+			secondCount, secondIndex = count, i
 		}
 	}
 
 	// Decide if a section stands out.
 	// (If the maximum dark count is more than (1+thresholdFactor) times the average, we consider it significant.)
 	standout := 0 // 0 means no standout
+	marked := false
 	if avg == 0 {
 		if maxCount > 0 {
 			standout = maxIndex // use 1-based indexing
+			marked = true
 		}
 	} else if float64(maxCount) > (1.0+thresholdFactor)*avg {
 		standout = maxIndex
+		marked = true
+	}
+
+	// Two neighbours almost equally dark are one mark spread across their
+	// boundary, or two marks; either way the standout would be a guess.
+	smudged := marked && cfg.SmudgeCloseness > 0 && (secondIndex == maxIndex-1 || secondIndex == maxIndex+1) &&
+		float64(maxCount-secondCount) < cfg.SmudgeCloseness*float64(maxCount)
+
+	reading := SectionReading{Standout: standout, Marked: marked, DarkCounts: darkCounts, Fill: fill, Ignored: cfg.Ignore, Sections: numSections, Smudged: smudged}
+	if cfg.NoAnnotate {
+		return reading, nil
 	}
 
 	// Draw the original rectangle on the image.
@@ -88,7 +190,7 @@ func ProcessHorizontalSections(img *gocv.Mat, rect image.Rectangle, numSections
 
 	// Draw vertical lines to mark the section boundaries.
 	for i := 1; i < numSections; i++ {
-		x := rect.Min.X + int(float32(i)*sectionWidth)
+		x := rect.Min.X + (spans[i-1][1]+spans[i][0])/2
 		pt1 := image.Pt(x, rect.Min.Y)
 		pt2 := image.Pt(x, rect.Max.Y)
 		gocv.Line(img, pt1, pt2, color.RGBA{255, 0, 0, 0}, 1)
@@ -96,8 +198,109 @@ func ProcessHorizontalSections(img *gocv.Mat, rect image.Rectangle, numSections
 
 	// Draw the standout section index as text above the rectangle.
 	text := fmt.Sprintf("Standout: %d", standout)
+	if smudged {
+		text = fmt.Sprintf("Smudge: %d/%d", min(maxIndex, secondIndex), max(maxIndex, secondIndex))
+	}
 	ptText := image.Pt(rect.Min.X+200, rect.Min.Y-10)
 	gocv.PutText(img, text, ptText, gocv.FontHersheyPlain, 1.2, color.RGBA{0, 0, 255, 0}, 2)
 
-	return standout, nil
+	return reading, nil
+}
+
+// integralCounts holds the integral image of a region's mark pixels, so the
+// mark count of any rectangle of the region takes four lookups.
+type integralCounts struct {
+	sum gocv.Mat // (rows+1)x(cols+1) CV_32S sums of the 0/255 mark image
+}
+
+// newIntegralCounts thresholds region per cfg.Mode and integrates the result.
+// The caller must Close it.
+func newIntegralCounts(region gocv.Mat, cfg SectionConfig) *integralCounts {
+	marks := markPixels(region, cfg)
+	defer marks.Close()
+	sum, sqsum, tilted := gocv.NewMat(), gocv.NewMat(), gocv.NewMat()
+	defer sqsum.Close()
+	defer tilted.Close()
+	gocv.Integral(marks, &sum, &sqsum, &tilted)
+	return &integralCounts{sum: sum}
+}
+
+// count returns the number of mark pixels in r, in region coordinates.
+func (c *integralCounts) count(r image.Rectangle) int {
+	s := &c.sum
+	total := s.GetIntAt(r.Max.Y, r.Max.X) - s.GetIntAt(r.Min.Y, r.Max.X) - s.GetIntAt(r.Max.Y, r.Min.X) + s.GetIntAt(r.Min.Y, r.Min.X)
+	return int(total) / 255
+}
+
+func (c *integralCounts) Close() error {
+	return c.sum.Close()
+}
+
+// defaultMinSaturation is the HSV saturation above which a pixel counts as
+// ink in color mode when SectionConfig.MinSaturation is unset.
+const defaultMinSaturation = 80
+
+// markPixels returns a binary image of region where mark pixels are 255,
+// judged per cfg.Mode. The caller must Close it.
+func markPixels(region gocv.Mat, cfg SectionConfig) gocv.Mat {
+	marks := gocv.NewMat()
+	if cfg.Mode != MarkColor {
+		// Use THRESH_BINARY_INV so that dark pixels become white.
+		gray := gocv.NewMat()
+		defer gray.Close()
+		gocv.CvtColor(region, &gray, gocv.ColorBGRToGray)
+		gocv.Threshold(gray, &marks, float32(cfg.DarkThreshold), 255, gocv.ThresholdBinaryInv)
+		return marks
+	}
+
+	hsv := gocv.NewMat()
+	defer hsv.Close()
+	gocv.CvtColor(region, &hsv, gocv.ColorBGRToHSV)
+	channels := gocv.Split(hsv)
+	defer func() {
+		for _, c := range channels {
+			c.Close()
+		}
+	}()
+	minSat := cfg.MinSaturation
+	if minSat <= 0 {
+		minSat = defaultMinSaturation
+	}
+
+	// Colored ink is saturated; black ink is not, but it is dark.
+	saturated := gocv.NewMat()
+	defer saturated.Close()
+	gocv.Threshold(channels[1], &saturated, float32(minSat), 255, gocv.ThresholdBinary)
+	dark := gocv.NewMat()
+	defer dark.Close()
+	gocv.Threshold(channels[2], &dark, float32(cfg.DarkThreshold), 255, gocv.ThresholdBinaryInv)
+	gocv.BitwiseOr(saturated, dark, &marks)
+	return marks
+}
+
+// applySectionMask clears the pixels of a thresholded section that fall outside
+// the bubble shape selected by cfg.Mask.
+func applySectionMask(thresh *gocv.Mat, cfg SectionConfig) {
+	if cfg.Mask == "" || cfg.Mask == MaskRect {
+		return
+	}
+	scale := cfg.MaskScale
+	if scale <= 0 {
+		scale = 1
+	}
+	w, h := thresh.Cols(), thresh.Rows()
+	axes := image.Pt(int(float64(w)/2*scale), int(float64(h)/2*scale))
+	if cfg.Mask == MaskCircle {
+		r := min(axes.X, axes.Y)
+		axes = image.Pt(r, r)
+	}
+
+	mask := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(0, 0, 0, 0), h, w, gocv.MatTypeCV8U)
+	defer mask.Close()
+	gocv.Ellipse(&mask, image.Pt(w/2, h/2), axes, 0, 0, 360, color.RGBA{255, 255, 255, 0}, -1)
+
+	masked := gocv.NewMat()
+	defer masked.Close()
+	gocv.BitwiseAnd(*thresh, mask, &masked)
+	masked.CopyTo(thresh)
 }
@@ -0,0 +1,94 @@
+//go:build !nocv
+
+package utils
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"slices"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// bubbleRow draws a white region of width x 40 pixels with a bubble outline
+// per section, filled at the marked sections and with a stray stroke across
+// the row, so sections have distinct counts. The caller must Close it.
+func bubbleRow(width, numSections int, marked ...int) gocv.Mat {
+	img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), 40, width, gocv.MatTypeCV8UC3)
+	black := color.RGBA{0, 0, 0, 0}
+	pitch := float64(width) / float64(numSections)
+	radius := int(min(pitch, 40) / 2 * 0.8)
+	for i := range numSections {
+		center := image.Pt(int((float64(i)+0.5)*pitch), 20)
+		thickness := 1
+		if slices.Contains(marked, i) {
+			thickness = -1
+		}
+		gocv.Circle(&img, center, radius, black, thickness)
+	}
+	gocv.Line(&img, image.Pt(width/7, 5), image.Pt(width/3, 33), black, 2)
+	return img
+}
+
+func TestIntegralCountsMatchSections(t *testing.T) {
+	for _, tc := range []struct {
+		width, sections, innerMargin int
+		mode                         MarkMode
+	}{
+		{400, 10, 0, ""},
+		{400, 10, 3, ""},
+		{1000, 100, 0, ""},
+		{1000, 100, 1, ""},
+		{1500, 7, 2, ""},
+		{400, 10, 0, MarkColor},
+	} {
+		t.Run(fmt.Sprintf("%dx%d-margin%d%s", tc.width, tc.sections, tc.innerMargin, tc.mode), func(t *testing.T) {
+			img := bubbleRow(tc.width, tc.sections, 3, tc.sections-1)
+			defer img.Close()
+			cfg := DefaultSectionConfig(tc.sections)
+			cfg.InnerMargin, cfg.Mode, cfg.NoAnnotate = tc.innerMargin, tc.mode, true
+			rect := image.Rect(0, 0, tc.width, 40)
+
+			want, err := ReadHorizontalSections(&img, rect, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.IntegralCounts = true
+			got, err := ReadHorizontalSections(&img, rect, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.DarkCounts, want.DarkCounts) {
+				t.Errorf("integral counts %v, per-section counts %v", got.DarkCounts, want.DarkCounts)
+			}
+			if got.Standout != want.Standout || got.Marked != want.Marked {
+				t.Errorf("integral standout %d (marked %v), per-section %d (marked %v)", got.Standout, got.Marked, want.Standout, want.Marked)
+			}
+		})
+	}
+}
+
+func BenchmarkReadHorizontalSections(b *testing.B) {
+	for _, sections := range []int{10, 100, 500} {
+		img := bubbleRow(sections*20, sections, sections/2)
+		rect := image.Rect(0, 0, sections*20, 40)
+		for _, integral := range []bool{false, true} {
+			cfg := DefaultSectionConfig(sections)
+			cfg.IntegralCounts, cfg.NoAnnotate = integral, true
+			name := fmt.Sprintf("sections=%d/per-section", sections)
+			if integral {
+				name = fmt.Sprintf("sections=%d/integral", sections)
+			}
+			b.Run(name, func(b *testing.B) {
+				for range b.N {
+					if _, err := ReadHorizontalSections(&img, rect, cfg); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		img.Close()
+	}
+}
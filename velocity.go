@@ -0,0 +1,97 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// reorderConfig is set from the -velocity-window and -reorder-cover flags.
+type reorderConfig struct {
+	Window time.Duration // audit history the consumption rate is averaged over
+	Cover  int           // days of consumption a suggested order should cover
+}
+
+// ReorderSuggestion is a product's consumption rate and, when it is being
+// used up, when and how much to reorder.
+type ReorderSuggestion struct {
+	Location  string     `json:"location"`
+	Key       string     `json:"key"`
+	Name      string     `json:"name"`
+	Value     int        `json:"value"`
+	Threshold int        `json:"threshold"`
+	PerDay    float64    `json:"perDay"`              // units consumed per day over the window
+	ReorderBy *time.Time `json:"reorderBy,omitempty"` // when the count is expected to reach the threshold
+	Quantity  int        `json:"quantity"`            // suggested order size; 0 when none is needed
+}
+
+// consumedAction reports whether an audited change can count as consumption.
+// Transfers only move stock, reprocessing corrects earlier scans and
+// restores roll back to a backup.
+func consumedAction(action string) bool {
+	switch action {
+	case "transfer-out", "transfer-in", "reprocess", "restore", "restore-remove":
+		return false
+	}
+	return true
+}
+
+// reorderSuggestions computes a suggestion for every product at the given
+// locations from the audit history of the last c.Window. Only decreases
+// count as consumption. Products that are not being used get a rate of 0 and
+// no suggestion unless they are already at their threshold.
+func reorderSuggestions(c reorderConfig, locs []string, now time.Time) ([]ReorderSuggestion, error) {
+	entries, err := audit.since(now.Add(-c.Window))
+	if err != nil {
+		return nil, err
+	}
+	type productAt struct{ loc, key string }
+	consumed := map[productAt]int{}
+	for _, e := range entries {
+		if e.Delta < 0 && consumedAction(e.Action) {
+			consumed[productAt{e.Location, e.Key}] -= e.Delta
+		}
+	}
+	days := c.Window.Hours() / 24
+
+	var out []ReorderSuggestion
+	for _, loc := range locs {
+		for key, prod := range db.snapshotLocation(loc) {
+			s := ReorderSuggestion{Location: loc, Key: key, Name: prod.Name, Value: prod.Value, Threshold: prod.Threshold}
+			s.PerDay = float64(consumed[productAt{loc, key}]) / days
+			switch {
+			case prod.LowStock():
+				s.ReorderBy = &now
+			case s.PerDay > 0:
+				by := now.Add(time.Duration(float64(prod.Value-prod.Threshold) / s.PerDay * 24 * float64(time.Hour)))
+				s.ReorderBy = &by
+			}
+			if s.ReorderBy != nil {
+				need := s.PerDay*float64(c.Cover) + float64(prod.Threshold-prod.Value)
+				s.Quantity = max(int(math.Ceil(need)), 0)
+			}
+			out = append(out, s)
+		}
+	}
+	slices.SortFunc(out, func(a, b ReorderSuggestion) int {
+		return cmp.Or(cmp.Compare(a.Location, b.Location), cmp.Compare(a.Key, b.Key))
+	})
+	return out, nil
+}
+
+// HandleAPIReorder returns the reorder suggestions for ?location= (the default
+// location when absent); ?location=* covers every location.
+func HandleAPIReorder(w http.ResponseWriter, req *http.Request) {
+	locs := []string{locationFor(req)}
+	if req.FormValue("location") == "*" {
+		locs = db.locations()
+	}
+	suggestions, err := reorderSuggestions(configFor(req).Reorder, locs, time.Now())
+	if err != nil {
+		httpError(w, req, "error.readAudit", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, suggestions)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// watchdogConfig configures the successWatchdog.
+type watchdogConfig struct {
+	Window    int     // sheets averaged over
+	Threshold float64 // alert below this average valid-row rate; 0 disables
+	Webhook   string  // optional URL the alert is also POSTed to as JSON
+}
+
+// successWatchdog tracks the share of valid rows over the most recent sheets
+// and raises an alert when the average drops below the -watchdog-threshold,
+// which usually means dirty scanner glass or a changed print run. It alerts
+// once per drop and logs when the rate recovers.
+type successWatchdog struct {
+	mu       sync.Mutex
+	rates    []float64
+	alerting bool
+}
+
+// watchdogMinSheets is how many sheets must be seen before the watchdog judges.
+const watchdogMinSheets = 5
+
+var watchdog successWatchdog
+
+// watchdogEvent is the JSON body POSTed to the watchdog webhook.
+type watchdogEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Rate      float64   `json:"rate"`
+	Threshold float64   `json:"threshold"`
+	Sheets    int       `json:"sheets"`
+}
+
+// observe records the outcome of decoding one uploaded sheet and judges the
+// rate per c. Sheets that failed to decode count as a rate of 0; refusals
+// because scanning is disabled are not counted.
+func (w *successWatchdog) observe(c watchdogConfig, sheet Sheet, err error) {
+	window, threshold := c.Window, c.Threshold
+	if threshold <= 0 || errors.Is(err, ErrScanningDisabled) {
+		return
+	}
+	rate := 0.0
+	if err == nil && len(sheet.Results) > 0 {
+		rate = float64(sheet.validRows()) / float64(len(sheet.Results))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rates = append(w.rates, rate)
+	if len(w.rates) > window {
+		w.rates = w.rates[len(w.rates)-window:]
+	}
+	if len(w.rates) < min(window, watchdogMinSheets) {
+		return
+	}
+	sum := 0.0
+	for _, r := range w.rates {
+		sum += r
+	}
+	avg := sum / float64(len(w.rates))
+	switch {
+	case avg < threshold && !w.alerting:
+		w.alerting = true
+		alertf("Decode success rate is %.0f%% over the last %d sheets (alert below %.0f%%); check the scanner glass and the printed sheets", avg*100, len(w.rates), threshold*100)
+		if url := c.Webhook; url != "" {
+			go postWebhook("Watchdog", url, watchdogEvent{Event: "success-rate-low", Time: time.Now(), Rate: avg, Threshold: threshold, Sheets: len(w.rates)})
+		}
+	case avg >= threshold && w.alerting:
+		w.alerting = false
+		log.Printf("Decode success rate recovered to %.0f%% over the last %d sheets", avg*100, len(w.rates))
+	}
+}
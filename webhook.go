@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookClient sends webhook and export requests.
+var webhookClient = http.Client{Timeout: 10 * time.Second}
+
+// postWebhook POSTs event as JSON to url, logging failures under name.
+func postWebhook(name, url string, event any) {
+	if err := sendJSON(http.MethodPost, url, nil, event); err != nil {
+		log.Printf("%s webhook: %v", name, err)
+	}
+}
+
+// sendJSON sends v as a JSON request body to url with the extra headers and
+// fails on transport errors and non-2xx replies.
+func sendJSON(method, url string, header http.Header, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return nil
+}